@@ -1,45 +1,211 @@
 package broker
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
 )
 
+// How CloudEvents are carried by Kafka messages.
+const (
+	StructuredMode = "structured" // The whole event is the message value.
+	BinaryMode     = "binary"     // Attributes are ce_ headers, the data is the message value.
+)
+
 type BrokerHandler struct {
-	producer *kafka.Producer
-	logger   *log.Logger
+	producer    *kafka.Producer
+	logger      *log.Logger
+	servers     string
+	contentMode string
+	done        chan struct{} // Closed when the delivery reports are drained.
+
+	mu        sync.Mutex
+	delivered int64
+	failed    int64
+}
+
+// Delivery counts of the messages published so far.
+type Stats struct {
+	Delivered int64 `json:"delivered"`
+	Failed    int64 `json:"failed"`
+}
+
+// Configure broker handler by changing bootstrap servers or content mode.
+type BrokerOption func(*BrokerHandler)
+
+// Kafka bootstrap servers, KAFKA_URL when not set.
+func WithBootstrapServers(servers string) BrokerOption {
+	return func(bh *BrokerHandler) {
+		bh.servers = servers
+	}
+}
+
+// Content mode of CloudEvents, KAFKA_CONTENT_MODE or StructuredMode when not set.
+func WithContentMode(mode string) BrokerOption {
+	return func(bh *BrokerHandler) {
+		bh.contentMode = mode
+	}
 }
 
-func NewBrokerHandler(logger *log.Logger) (*BrokerHandler, error) {
-	logger.Printf("INFO:Connecting to kafka.. [%s]", os.Getenv("KAFKA_URL"))
+func NewBrokerHandler(logger *log.Logger, opts ...BrokerOption) (*BrokerHandler, error) {
+	bh := &BrokerHandler{
+		logger:      logger,
+		servers:     os.Getenv("KAFKA_URL"),
+		contentMode: os.Getenv("KAFKA_CONTENT_MODE"),
+		done:        make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(bh)
+	}
+	switch bh.contentMode {
+	case "":
+		bh.contentMode = StructuredMode
+	case StructuredMode, BinaryMode:
+	default:
+		logger.Printf("ERROR:Kafka|Unknown content mode [%s]", bh.contentMode)
+		return nil, fmt.Errorf("unknown kafka content mode [%s]", bh.contentMode)
+	}
+
+	logger.Printf("INFO:Connecting to kafka.. [%s]", bh.servers)
 	producer, err := kafka.NewProducer(&kafka.ConfigMap{
-		"bootstrap.servers": os.Getenv("KAFKA_URL"),
+		"bootstrap.servers": bh.servers,
 		"acks":              "all"})
 
 	if err != nil {
 		logger.Printf("ERROR:Kafka|Could not connect to kafka [%s]", err)
 		return nil, err
 	}
-	logger.Printf("INFO:Kafka|Connected to [%s]", os.Getenv("KAFKA_URL"))
+	logger.Printf("INFO:Kafka|Connected to [%s]", bh.servers)
+	bh.producer = producer
+	go bh.handleEvents()
 
-	return &BrokerHandler{
-		producer: producer,
-		logger:   logger,
-	}, err
+	return bh, nil
 }
 
+// Queues the message, its delivery report is handled in the background. Returns an error if it could not be queued.
 func (bh *BrokerHandler) Publish(topic string, payload []byte) error {
-	err := bh.producer.Produce(&kafka.Message{
-		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
-		Value:          payload},
-		nil,
-	)
-	bh.logger.Println("INFO:Kafka|Event published")
+	err := bh.producer.Produce(bh.message(topic, payload), nil)
 	if err != nil {
-		bh.logger.Println("ERROR:Kafka|Could not publish event.")
+		bh.logger.Printf("ERROR:Kafka|Could not queue event. [%s]", err)
 		return err
 	}
+	bh.logger.Println("INFO:Kafka|Event queued")
 	return nil
 }
+
+// Publishes the message and waits until the broker acknowledged it or the context is done.
+func (bh *BrokerHandler) PublishSync(ctx context.Context, topic string, payload []byte) error {
+	deliveries := make(chan kafka.Event, 1)
+	err := bh.producer.Produce(bh.message(topic, payload), deliveries)
+	if err != nil {
+		bh.logger.Printf("ERROR:Kafka|Could not queue event. [%s]", err)
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		// The report still arrives on the buffered channel, nobody reads it.
+		bh.logger.Printf("WARNING:Kafka|Stopped waiting for delivery [%s]", ctx.Err())
+		return ctx.Err()
+	case event := <-deliveries:
+		return bh.report(event.(*kafka.Message))
+	}
+}
+
+// Delivery counts of the messages published so far.
+func (bh *BrokerHandler) Stats() Stats {
+	bh.mu.Lock()
+	defer bh.mu.Unlock()
+	return Stats{Delivered: bh.delivered, Failed: bh.failed}
+}
+
+// Waits up to timeout for queued messages to be delivered and closes the producer.
+// Returns an error if some messages were not delivered in time, they are lost.
+func (bh *BrokerHandler) Close(timeout time.Duration) error {
+	bh.logger.Printf("INFO:Kafka|Flushing..")
+	remaining := bh.producer.Flush(int(timeout.Milliseconds()))
+	bh.producer.Close()
+	<-bh.done
+	if remaining > 0 {
+		bh.logger.Printf("ERROR:Kafka|[%d] events not delivered before close.", remaining)
+		return fmt.Errorf("%d events not delivered before close", remaining)
+	}
+	bh.logger.Printf("INFO:Kafka|Closed.")
+	return nil
+}
+
+// Reads delivery reports and client errors until the producer is closed.
+func (bh *BrokerHandler) handleEvents() {
+	defer close(bh.done)
+	for event := range bh.producer.Events() {
+		switch e := event.(type) {
+		case *kafka.Message:
+			bh.report(e)
+		case kafka.Error:
+			bh.logger.Printf("ERROR:Kafka|%s", e)
+		}
+	}
+}
+
+// Counts and logs the delivery report of the message. Returns the delivery error if any.
+func (bh *BrokerHandler) report(message *kafka.Message) error {
+	bh.mu.Lock()
+	defer bh.mu.Unlock()
+	if err := message.TopicPartition.Error; err != nil {
+		bh.failed++
+		bh.logger.Printf("ERROR:Kafka|Event not delivered to [%s] [%s]", *message.TopicPartition.Topic, err)
+		return err
+	}
+	bh.delivered++
+	bh.logger.Printf("INFO:Kafka|Event delivered to [%s] partition [%d] offset [%s]",
+		*message.TopicPartition.Topic, message.TopicPartition.Partition, message.TopicPartition.Offset)
+	return nil
+}
+
+// Kafka message of the payload. CloudEvents are keyed by their subject so the events of a user keep their order,
+// in binary mode their attributes are moved to ce_ headers. Other payloads are sent as they are.
+func (bh *BrokerHandler) message(topic string, payload []byte) *kafka.Message {
+	message := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Value:          payload,
+	}
+	var event map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &event); err != nil || event["specversion"] == nil {
+		return message
+	}
+	var subject string
+	if err := json.Unmarshal(event["subject"], &subject); err == nil && subject != "" {
+		message.Key = []byte(subject)
+	}
+	if bh.contentMode != BinaryMode {
+		message.Headers = []kafka.Header{{Key: "content-type", Value: []byte("application/cloudevents+json")}}
+		return message
+	}
+
+	message.Value = nil
+	if data := event["data"]; string(data) != "null" {
+		message.Value = data
+	}
+	for name, raw := range event {
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			// Extension attributes may be numbers or booleans, they are sent as written.
+			value = string(raw)
+		}
+		switch name {
+		case "data":
+		case "datacontenttype":
+			message.Headers = append(message.Headers, kafka.Header{Key: "content-type", Value: []byte(value)})
+		default:
+			message.Headers = append(message.Headers, kafka.Header{Key: "ce_" + name, Value: []byte(value)})
+		}
+	}
+	sort.Slice(message.Headers, func(i, j int) bool { return message.Headers[i].Key < message.Headers[j].Key })
+	return message
+}
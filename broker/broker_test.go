@@ -0,0 +1,171 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	natstest "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestHandler(t *testing.T, servers string) *BrokerHandler {
+	bh, err := NewBrokerHandler(log.New(io.Discard, "", 0), WithBootstrapServers(servers))
+	assert.Nil(t, err)
+	return bh
+}
+
+func newMockCluster(t *testing.T) *kafka.MockCluster {
+	cluster, err := kafka.NewMockCluster(1)
+	assert.Nil(t, err)
+	t.Cleanup(cluster.Close)
+	return cluster
+}
+
+func TestPublishSync(t *testing.T) {
+	cluster := newMockCluster(t)
+	bh := newTestHandler(t, cluster.BootstrapServers())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	assert.Nil(t, bh.PublishSync(ctx, "user", []byte("event")))
+	assert.Equal(t, Stats{Delivered: 1}, bh.Stats())
+	assert.Nil(t, bh.Close(time.Second))
+}
+
+func TestCloseFlushes(t *testing.T) {
+	cluster := newMockCluster(t)
+	bh := newTestHandler(t, cluster.BootstrapServers())
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, bh.Publish("user", []byte("event")))
+	}
+	assert.Nil(t, bh.Close(10*time.Second))
+	// Reports of flushed messages are counted by the delivery loop.
+	assert.Equal(t, Stats{Delivered: 3}, bh.Stats())
+}
+
+func TestPublishSyncUnreachable(t *testing.T) {
+	bh := newTestHandler(t, "127.0.0.1:1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, bh.PublishSync(ctx, "user", []byte("event")), context.DeadlineExceeded)
+	assert.NotNil(t, bh.Close(100*time.Millisecond))
+}
+
+func TestMemoryPublisher(t *testing.T) {
+	mp := NewMemoryPublisher(log.New(io.Discard, "", 0))
+	events, cancel := mp.Subscribe("user", 1)
+	other, _ := mp.Subscribe("other", 1)
+
+	assert.Nil(t, mp.Publish("user", []byte("first")))
+	// The buffer is full, the event is dropped instead of blocking.
+	assert.Nil(t, mp.Publish("user", []byte("second")))
+	assert.Equal(t, []byte("first"), <-events)
+	assert.Empty(t, other)
+
+	cancel()
+	_, open := <-events
+	assert.False(t, open)
+	assert.Nil(t, mp.Publish("user", []byte("third")))
+
+	assert.Nil(t, mp.Close(time.Second))
+	_, open = <-other
+	assert.False(t, open)
+}
+
+func TestFilePublisher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	for _, payload := range []string{`{"event_name":"user_created"}`, "not json"} {
+		// Reopening appends to the file.
+		fp, err := NewFilePublisher(path, log.New(io.Discard, "", 0))
+		assert.Nil(t, err)
+		assert.Nil(t, fp.Publish("user", []byte(payload)))
+		assert.Nil(t, fp.Close(time.Second))
+	}
+
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	assert.Len(t, lines, 2)
+	var record struct {
+		Topic   string          `json:"topic"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &record))
+	assert.Equal(t, "user", record.Topic)
+	assert.JSONEq(t, `{"event_name":"user_created"}`, string(record.Payload))
+	assert.Nil(t, json.Unmarshal([]byte(lines[1]), &record))
+	assert.Equal(t, `"not json"`, string(record.Payload))
+}
+
+// Runs an embedded NATS server on a random port and returns its url.
+func runNATSServer(t *testing.T) string {
+	opts := natstest.DefaultTestOptions
+	opts.Port = -1
+	server := natstest.RunServer(&opts)
+	t.Cleanup(server.Shutdown)
+	return server.ClientURL()
+}
+
+func TestNATSPublisher(t *testing.T) {
+	url := runNATSServer(t)
+	subscriber, err := nats.Connect(url)
+	assert.Nil(t, err)
+	defer subscriber.Close()
+	subscription, err := subscriber.SubscribeSync("user")
+	assert.Nil(t, err)
+	assert.Nil(t, subscriber.Flush())
+
+	np, err := NewNATSPublisher(url, log.New(io.Discard, "", 0))
+	assert.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, np.PublishSync(ctx, "user", []byte("first")))
+	assert.Nil(t, np.Publish("user", []byte("second")))
+	assert.Nil(t, np.Close(5*time.Second))
+
+	for _, want := range []string{"first", "second"} {
+		msg, err := subscription.NextMsg(5 * time.Second)
+		assert.Nil(t, err)
+		assert.Equal(t, want, string(msg.Data))
+	}
+}
+
+func TestMessageContentMode(t *testing.T) {
+	event := []byte(`{"specversion":"1.0","id":"event-1","source":"/user-management-service","type":"user_created",` +
+		`"subject":"user-1","time":"2023-03-22T09:18:25Z","datacontenttype":"application/json","data":{"id":"user-1"}}`)
+
+	structured := (&BrokerHandler{contentMode: StructuredMode}).message("user", event)
+	assert.Equal(t, event, structured.Value)
+	assert.Equal(t, []byte("user-1"), structured.Key)
+	assert.Equal(t, []kafka.Header{{Key: "content-type", Value: []byte("application/cloudevents+json")}}, structured.Headers)
+
+	binary := (&BrokerHandler{contentMode: BinaryMode}).message("user", event)
+	assert.JSONEq(t, `{"id":"user-1"}`, string(binary.Value))
+	assert.Equal(t, []byte("user-1"), binary.Key)
+	assert.Equal(t, []kafka.Header{
+		{Key: "ce_id", Value: []byte("event-1")},
+		{Key: "ce_source", Value: []byte("/user-management-service")},
+		{Key: "ce_specversion", Value: []byte("1.0")},
+		{Key: "ce_subject", Value: []byte("user-1")},
+		{Key: "ce_time", Value: []byte("2023-03-22T09:18:25Z")},
+		{Key: "ce_type", Value: []byte("user_created")},
+		{Key: "content-type", Value: []byte("application/json")},
+	}, binary.Headers)
+
+	// Payloads that are not CloudEvents are sent as they are.
+	plain := (&BrokerHandler{contentMode: BinaryMode}).message("user", []byte("plain"))
+	assert.Equal(t, []byte("plain"), plain.Value)
+	assert.Nil(t, plain.Key)
+	assert.Empty(t, plain.Headers)
+}
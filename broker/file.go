@@ -0,0 +1,71 @@
+package broker
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Line written for every event.
+type fileRecord struct {
+	Time    time.Time       `json:"time"`
+	Topic   string          `json:"topic"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Appends every event as a JSON line to a file, for local debugging.
+type FilePublisher struct {
+	logger *log.Logger
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// Opens the file for appending, creating it if needed.
+func NewFilePublisher(path string, logger *log.Logger) (*FilePublisher, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		logger.Printf("ERROR:File|Could not open event file [%s]", err)
+		return nil, err
+	}
+	logger.Printf("INFO:File|Writing events to [%s]", path)
+	return &FilePublisher{logger: logger, file: file}, nil
+}
+
+// Appends the event. Payloads that are not JSON are written as strings.
+func (fp *FilePublisher) Publish(topic string, payload []byte) error {
+	record := fileRecord{Time: time.Now(), Topic: topic, Payload: payload}
+	if !json.Valid(payload) {
+		quoted, err := json.Marshal(string(payload))
+		if err != nil {
+			return err
+		}
+		record.Payload = quoted
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		fp.logger.Printf("ERROR:File|Could not marshal event [%s]", err)
+		return err
+	}
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	// One write per line, so lines of concurrent publishers do not interleave.
+	if _, err := fp.file.Write(append(line, '\n')); err != nil {
+		fp.logger.Printf("ERROR:File|Could not write event [%s]", err)
+		return err
+	}
+	return nil
+}
+
+// Syncs and closes the file. Writes are not buffered, so the timeout is not needed.
+func (fp *FilePublisher) Close(timeout time.Duration) error {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if err := fp.file.Sync(); err != nil {
+		fp.file.Close()
+		return err
+	}
+	return fp.file.Close()
+}
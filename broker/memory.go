@@ -0,0 +1,78 @@
+package broker
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Publishes events to subscribers in the same process. Nothing is kept, events without subscribers are dropped.
+type MemoryPublisher struct {
+	logger *log.Logger
+
+	mu          sync.Mutex
+	subscribers map[string]map[chan []byte]struct{}
+	closed      bool
+}
+
+func NewMemoryPublisher(logger *log.Logger) *MemoryPublisher {
+	logger.Printf("INFO:Memory|Publishing events in process")
+	return &MemoryPublisher{
+		logger:      logger,
+		subscribers: make(map[string]map[chan []byte]struct{}),
+	}
+}
+
+// Sends the payload to every subscriber of the topic. A subscriber with a full buffer misses the event.
+func (mp *MemoryPublisher) Publish(topic string, payload []byte) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	for events := range mp.subscribers[topic] {
+		select {
+		case events <- payload:
+		default:
+			mp.logger.Printf("WARNING:Memory|Subscriber of [%s] is full, event dropped", topic)
+		}
+	}
+	return nil
+}
+
+// Subscribes to the topic with a buffer of the given size. Call cancel to unsubscribe, it closes the channel.
+func (mp *MemoryPublisher) Subscribe(topic string, buffer int) (events <-chan []byte, cancel func()) {
+	ch := make(chan []byte, buffer)
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if mp.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if mp.subscribers[topic] == nil {
+		mp.subscribers[topic] = make(map[chan []byte]struct{})
+	}
+	mp.subscribers[topic][ch] = struct{}{}
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			mp.mu.Lock()
+			defer mp.mu.Unlock()
+			if _, ok := mp.subscribers[topic][ch]; ok {
+				delete(mp.subscribers[topic], ch)
+				close(ch)
+			}
+		})
+	}
+}
+
+// Closes the channels of all subscribers. Events are delivered on publish, so there is nothing to flush.
+func (mp *MemoryPublisher) Close(timeout time.Duration) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	for _, subscribers := range mp.subscribers {
+		for ch := range subscribers {
+			close(ch)
+		}
+	}
+	mp.subscribers = make(map[string]map[chan []byte]struct{})
+	mp.closed = true
+	return nil
+}
@@ -0,0 +1,70 @@
+package broker
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Publishes events to NATS, the topic is used as subject.
+type NATSPublisher struct {
+	conn   *nats.Conn
+	logger *log.Logger
+}
+
+// Connects to the NATS server, reconnecting in the background when the connection is lost.
+func NewNATSPublisher(url string, logger *log.Logger) (*NATSPublisher, error) {
+	logger.Printf("INFO:NATS|Connecting to [%s]", url)
+	conn, err := nats.Connect(url,
+		nats.Name("user-management-service"),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			logger.Printf("WARNING:NATS|Disconnected [%v]", err)
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			logger.Printf("INFO:NATS|Reconnected to [%s]", conn.ConnectedUrl())
+		}),
+	)
+	if err != nil {
+		logger.Printf("ERROR:NATS|Could not connect [%s]", err)
+		return nil, err
+	}
+	logger.Printf("INFO:NATS|Connected to [%s]", conn.ConnectedUrl())
+	return &NATSPublisher{conn: conn, logger: logger}, nil
+}
+
+// Queues the event. While reconnecting events are buffered by the client.
+func (np *NATSPublisher) Publish(topic string, payload []byte) error {
+	if err := np.conn.Publish(topic, payload); err != nil {
+		np.logger.Printf("ERROR:NATS|Could not publish event [%s]", err)
+		return err
+	}
+	return nil
+}
+
+// Publishes the event and waits until the server received it or the context is done.
+func (np *NATSPublisher) PublishSync(ctx context.Context, topic string, payload []byte) error {
+	if err := np.Publish(topic, payload); err != nil {
+		return err
+	}
+	if err := np.conn.FlushWithContext(ctx); err != nil {
+		np.logger.Printf("ERROR:NATS|Event not confirmed [%s]", err)
+		return err
+	}
+	return nil
+}
+
+// Waits up to timeout for buffered events to reach the server and closes the connection.
+func (np *NATSPublisher) Close(timeout time.Duration) error {
+	np.logger.Printf("INFO:NATS|Flushing..")
+	err := np.conn.FlushTimeout(timeout)
+	np.conn.Close()
+	if err != nil {
+		np.logger.Printf("ERROR:NATS|Could not flush before close [%s]", err)
+		return err
+	}
+	np.logger.Printf("INFO:NATS|Closed.")
+	return nil
+}
@@ -2,19 +2,78 @@ package main
 
 import (
 	"context"
+	"expvar"
+	"flag"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/berkantay/user-management-service/broker"
 	"github.com/berkantay/user-management-service/database"
 	"github.com/berkantay/user-management-service/grpc"
+	"github.com/berkantay/user-management-service/memory"
+	"github.com/berkantay/user-management-service/model"
+	"github.com/berkantay/user-management-service/outbox"
+	"github.com/berkantay/user-management-service/sqlstore"
 	"github.com/berkantay/user-management-service/user"
+	"github.com/nats-io/nats.go"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 )
 
 // Version indicates the current version of the application.
 var Version = "development"
 
+// Default file of the file publisher.
+const defaultEventFile = "user-events.jsonl"
+
+// Time given to queued events to reach the broker on shutdown.
+const publisherCloseTimeout = 10 * time.Second
+
+// Storage backend the service runs on.
+type storage interface {
+	user.UserRepository
+	HealthCheck(ctx context.Context) error
+	GracefullShutdown(ctx context.Context) error
+}
+
+// Event publisher the service runs with.
+type publisher interface {
+	grpc.EventPublisher
+	Close(timeout time.Duration) error
+}
+
+// Server answering requests until the context is done.
+type runner interface {
+	Run(ctx context.Context) error
+	// Waits for events the server is still sending.
+	Drain()
+}
+
+// Storage keeping events in a transactional outbox.
+type outboxStorage interface {
+	user.Outbox
+	outbox.Store
+}
+
 func main() {
+	// "migrate" subcommand brings the storage schema up to date and exits.
+	args := os.Args[1:]
+	migrateOnly := len(args) > 0 && args[0] == "migrate"
+	if migrateOnly {
+		args = args[1:]
+	}
+	storageKind := flag.String("storage", "mongo", "storage backend to use: mongo, sql or memory")
+	publisherKind := flag.String("publisher", "kafka", "event publisher to use: kafka, nats, file or memory")
+	useOutbox := flag.Bool("outbox", false, "store events in a transactional outbox, only mongo supports it and needs a replica set")
+	flag.CommandLine.Parse(args)
+
 	file, err := os.OpenFile("user-management-service.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		log.Fatal(err)
@@ -23,10 +82,14 @@ func main() {
 
 	logger := log.New(file, "User Management Server Log | ", log.LstdFlags)
 	logger.Printf("User Management Service [%s]", Version)
-	database, err := database.NewStorage(
-		database.WithHost(os.Getenv("MONGO_URL")),
-		database.WithLogger(logger),
-	)
+	if migrateOnly {
+		if err := migrate(*storageKind, logger); err != nil {
+			logger.Println(err)
+			log.Fatal(err)
+		}
+		return
+	}
+	database, err := newStorage(*storageKind, logger)
 	if err != nil {
 		logger.Println(err)
 		os.Exit(-1)
@@ -38,18 +101,186 @@ func main() {
 		os.Exit(-1)
 	}
 
-	defer database.GracefullShutdown(context.Background())
+	publisher, err := newPublisher(*publisherKind, logger)
 
-	application := user.NewService(database, logger)
+	if err != nil {
+		logger.Println(err)
+		os.Exit(-1)
+	}
+	if kafka, ok := publisher.(*broker.BrokerHandler); ok {
+		expvar.Publish("kafka", expvar.Func(func() any { return kafka.Stats() }))
+	}
 
-	publisher, err := broker.NewBrokerHandler(logger)
+	var serviceOpts []user.ServiceOption
+	var serverOpts []grpc.ServerOption
+	var workers []func(ctx context.Context)
+	if *useOutbox {
+		store, ok := database.(outboxStorage)
+		if !ok {
+			logger.Printf("ERROR:Storage [%s] does not support the outbox", *storageKind)
+			os.Exit(-1)
+		}
+		interval, err := durationEnv("OUTBOX_INTERVAL", time.Second)
+		if err != nil {
+			logger.Println(err)
+			os.Exit(-1)
+		}
+		logger.Printf("INFO:Events are stored in the outbox")
+		relay := outbox.NewRelay(store, publisher, outbox.WithLogger(logger), outbox.WithInterval(interval))
+		expvar.Publish("outbox", expvar.Func(func() any { return relay.Stats() }))
+		workers = append(workers, relay.Run)
+		serviceOpts = append(serviceOpts, user.WithOutbox(store))
+		serverOpts = append(serverOpts, grpc.WithOutbox())
+	}
+	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
+		// Metrics are served by expvar on /debug/vars.
+		go func() {
+			logger.Printf("INFO:Serving metrics on [%s]", addr)
+			if err := http.ListenAndServe(addr, nil); err != nil {
+				logger.Printf("ERROR:Could not serve metrics [%s]", err)
+			}
+		}()
+	}
+
+	application := user.NewService(database, logger, serviceOpts...)
 
+	retention, err := durationEnv("DELETED_USER_RETENTION", 30*24*time.Hour)
+	if err != nil {
+		logger.Println(err)
+		os.Exit(-1)
+	}
+	purgeInterval, err := durationEnv("PURGE_INTERVAL", time.Hour)
 	if err != nil {
 		logger.Println(err)
 		os.Exit(-1)
 	}
 
-	server := grpc.NewServer(application, publisher, logger)
+	if key := os.Getenv("PAGE_TOKEN_KEY"); key != "" {
+		serverOpts = append(serverOpts, grpc.WithPageTokenKey([]byte(key)))
+	}
+
+	server := grpc.NewServer(application, publisher, logger, serverOpts...)
+	workers = append(workers, func(ctx context.Context) {
+		application.RunPurger(ctx, retention, purgeInterval, func(user *model.User) {
+			server.Notify(model.EventUserPurged, user)
+		})
+	})
+
+	// Interrupt and SIGTERM, sent by docker stop, shut the service down.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := serve(ctx, server, workers, publisher, database, logger); err != nil {
+		logger.Println(err)
+		os.Exit(-1)
+	}
+}
+
+// Runs the background workers and serves until the context is done or the server fails. Then waits for the workers
+// to stop and for the events they reported, and closes the publisher, giving queued events time to reach the broker,
+// and the storage.
+func serve(ctx context.Context, server runner, workers []func(ctx context.Context), publisher publisher, database storage, logger *log.Logger) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var running sync.WaitGroup
+	for _, worker := range workers {
+		running.Add(1)
+		go func(worker func(ctx context.Context)) {
+			defer running.Done()
+			worker(ctx)
+		}(worker)
+	}
+
+	err := server.Run(ctx)
+	logger.Printf("INFO:Shutting down..")
+	cancel()
+	running.Wait()
+	server.Drain()
+	if closeErr := publisher.Close(publisherCloseTimeout); closeErr != nil {
+		logger.Printf("ERROR:Could not close publisher [%s]", closeErr)
+	}
+	if closeErr := database.GracefullShutdown(context.Background()); closeErr != nil {
+		logger.Printf("ERROR:Could not close storage [%s]", closeErr)
+	}
+	logger.Printf("INFO:Shut down.")
+	return err
+}
 
-	server.Run()
+// Duration from environment variable, e.g. "720h". Falls back to def when not set.
+func durationEnv(name string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s [%s]", name, value)
+	}
+	return d, nil
+}
+
+// Apply schema migrations of the storage backend. Storages migrate while they are created.
+func migrate(kind string, logger *log.Logger) error {
+	database, err := newStorage(kind, logger)
+	if err != nil {
+		return err
+	}
+	logger.Printf("INFO:Schema of [%s] storage is up to date", kind)
+	return database.GracefullShutdown(context.Background())
+}
+
+// Create storage backend by its name.
+func newStorage(kind string, logger *log.Logger) (storage, error) {
+	logger.Printf("INFO:Using [%s] storage", kind)
+	switch kind {
+	case "mongo":
+		return database.NewStorage(
+			database.WithHost(os.Getenv("MONGO_URL")),
+			database.WithLogger(logger),
+		)
+	case "sql":
+		opts := []sqlstore.StorageOption{sqlstore.WithLogger(logger)}
+		if driver := os.Getenv("SQL_DRIVER"); driver != "" {
+			opts = append(opts, sqlstore.WithDriver(driver, os.Getenv("SQL_DSN")))
+		}
+		return sqlstore.NewStorage(context.Background(), opts...)
+	case "memory":
+		return memory.NewStorage(memory.WithLogger(logger)), nil
+	}
+	return nil, fmt.Errorf("unknown storage [%s]", kind)
+}
+
+// Create event publisher by its name.
+func newPublisher(kind string, logger *log.Logger) (publisher, error) {
+	logger.Printf("INFO:Using [%s] publisher", kind)
+	switch kind {
+	case "kafka":
+		bh, err := broker.NewBrokerHandler(logger)
+		if err != nil {
+			return nil, err
+		}
+		return bh, nil
+	case "nats":
+		url := os.Getenv("NATS_URL")
+		if url == "" {
+			url = nats.DefaultURL
+		}
+		np, err := broker.NewNATSPublisher(url, logger)
+		if err != nil {
+			return nil, err
+		}
+		return np, nil
+	case "file":
+		path := os.Getenv("EVENT_FILE")
+		if path == "" {
+			path = defaultEventFile
+		}
+		fp, err := broker.NewFilePublisher(path, logger)
+		if err != nil {
+			return nil, err
+		}
+		return fp, nil
+	case "memory":
+		return broker.NewMemoryPublisher(logger), nil
+	}
+	return nil, fmt.Errorf("unknown publisher [%s]", kind)
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/berkantay/user-management-service/grpc"
+	"github.com/berkantay/user-management-service/memory"
+	"github.com/berkantay/user-management-service/model"
+	"github.com/berkantay/user-management-service/user"
+	"github.com/stretchr/testify/assert"
+)
+
+// Serves until the context is done.
+type blockingServer struct{}
+
+func (blockingServer) Run(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (blockingServer) Drain() {}
+
+// Records the timeout it was closed with.
+type closingPublisher struct {
+	closed chan time.Duration
+}
+
+func (p *closingPublisher) Publish(topic string, payload []byte) error {
+	return nil
+}
+
+func (p *closingPublisher) Close(timeout time.Duration) error {
+	p.closed <- timeout
+	return nil
+}
+
+func TestServeClosesPublisherOnShutdown(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	publisher := &closingPublisher{closed: make(chan time.Duration, 1)}
+	var stopped atomic.Bool
+	worker := func(ctx context.Context) {
+		<-ctx.Done()
+		// Still publishing for a while after the shutdown.
+		time.Sleep(10 * time.Millisecond)
+		stopped.Store(true)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, blockingServer{}, []func(ctx context.Context){worker}, publisher, memory.NewStorage(memory.WithLogger(logger)), logger)
+	}()
+	assert.Empty(t, publisher.closed)
+
+	cancel()
+	select {
+	case err := <-served:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("serve did not return on shutdown")
+	}
+	assert.Equal(t, publisherCloseTimeout, <-publisher.closed)
+	assert.True(t, stopped.Load(), "publisher closed before the workers stopped")
+}
+
+// Fails to listen.
+type failingServer struct{}
+
+func (failingServer) Run(ctx context.Context) error {
+	return errors.New("address already in use")
+}
+
+func (failingServer) Drain() {}
+
+func TestServeStopsWorkersWhenServerFails(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	publisher := &closingPublisher{closed: make(chan time.Duration, 1)}
+	worker := func(ctx context.Context) { <-ctx.Done() }
+
+	err := serve(context.Background(), failingServer{}, []func(ctx context.Context){worker}, publisher, memory.NewStorage(memory.WithLogger(logger)), logger)
+	assert.NotNil(t, err)
+	assert.Len(t, publisher.closed, 1)
+}
+
+// Server serving on a local listener instead of port 8080.
+type localServer struct {
+	*grpc.Server
+	listener net.Listener
+}
+
+func (s localServer) Run(ctx context.Context) error {
+	return s.Serve(ctx, s.listener)
+}
+
+// Publishes slowly and counts the events published before it was closed.
+type slowPublisher struct {
+	mu        sync.Mutex
+	published int
+	closed    bool
+	late      int // Events published after close.
+}
+
+func (p *slowPublisher) Publish(topic string, payload []byte) error {
+	time.Sleep(20 * time.Millisecond)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		p.late++
+		return nil
+	}
+	p.published++
+	return nil
+}
+
+func (p *slowPublisher) Close(timeout time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	return nil
+}
+
+func TestServeWaitsForEventsOfPurgeDuringShutdown(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	storage := memory.NewStorage(memory.WithLogger(logger))
+	publisher := &slowPublisher{}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server := grpc.NewServer(user.NewService(storage, logger), publisher, logger)
+	// A purge finishing after the server stopped serving.
+	purger := func(ctx context.Context) {
+		<-ctx.Done()
+		time.Sleep(10 * time.Millisecond)
+		server.Notify(model.EventUserPurged, &model.User{ID: "purged-id"})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = serve(ctx, localServer{Server: server, listener: listener}, []func(ctx context.Context){purger}, publisher, storage, logger)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, publisher.published)
+	assert.Equal(t, 0, publisher.late)
+}
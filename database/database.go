@@ -2,7 +2,9 @@ package database
 
 import (
 	"context"
+	"errors"
 	"log"
+	"regexp"
 	"time"
 
 	"github.com/berkantay/user-management-service/model"
@@ -14,11 +16,24 @@ import (
 	"golang.org/x/text/language"
 )
 
+// Documents fetched from the server per round trip while streaming.
+const streamBatchSize = 500
+
+// Collections of the outbox and of the relay lease, in the database of the users.
+const (
+	outboxCollection = "outbox"
+	leaseCollection  = "outbox_lease"
+)
+
 type Storage struct {
 	host       string
+	database   string
+	name       string
 	context    context.Context
 	client     *mongo.Client
 	collection *mongo.Collection
+	outbox     *mongo.Collection
+	leases     *mongo.Collection
 	logger     *log.Logger
 }
 
@@ -32,6 +47,14 @@ func WithHost(uri string) StorageOption {
 	}
 }
 
+// Database and collection the users are kept in.
+func WithCollection(database, collection string) StorageOption {
+	return func(s *Storage) {
+		s.database = database
+		s.name = collection
+	}
+}
+
 // Database connection context.
 func WithContext(ctx context.Context) StorageOption {
 	return func(s *Storage) {
@@ -48,8 +71,10 @@ func WithLogger(logger *log.Logger) StorageOption {
 // Create new connection to the database instance.
 func NewStorage(opts ...StorageOption) (*Storage, error) {
 	s := &Storage{
-		host:    "mongodb://127.0.0.1:27017",
-		context: context.Background(),
+		host:     "mongodb://127.0.0.1:27017",
+		database: "user",
+		name:     "information",
+		context:  context.Background(),
 	}
 
 	for _, opt := range opts {
@@ -66,8 +91,13 @@ func NewStorage(opts ...StorageOption) (*Storage, error) {
 	}
 	s.client = client
 	s.logger.Printf("INFO:MongoDB|Creating collection..")
-	s.collection = s.createCollection("user", "information")
+	s.collection = s.createCollection(s.database, s.name)
+	s.outbox = s.createCollection(s.database, outboxCollection)
+	s.leases = s.createCollection(s.database, leaseCollection)
 	s.logger.Printf("INFO:MongoDB|Created collection..")
+	if err := s.Migrate(s.context); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -89,77 +119,318 @@ func (s *Storage) HealthCheck(ctx context.Context) error {
 
 // Create user in database with given type.
 func (s *Storage) CreateUser(ctx context.Context, user *model.User) (*string, error) {
-	//TODO: user id could be checked whether if exists or not. If exists generate another uuid to keep uniqueness.
 	s.logger.Printf("INFO:MongoDB|Creating user.")
-	res, err := s.collection.InsertOne(ctx, user)
+	document := *user
+	document.NormalizedEmail = model.NormalizeEmail(user.Email)
+	document.SearchTerms = model.SearchTerms(user)
+	document.Version = 1
+	res, err := s.collection.InsertOne(ctx, document)
 	if err != nil {
 		s.logger.Printf("ERROR:MongoDB|Could not create user. [%s]", err)
-		return nil, err
+		return nil, toDomainError(err, user.ID)
 	}
 	insertionId := res.InsertedID.(string)
 	s.logger.Printf("INFO:MongoDB|Creation successful.[%s]", insertionId)
 	return &insertionId, nil
 }
 
-// Update user in database with given type. Updates only one item.
-func (s *Storage) UpdateUser(ctx context.Context, user *model.User) (*model.User, error) {
+// Create users in database with a single unordered insert. A failing user does not stop the others.
+// Returns one error per user, nil for created users, or an error when the batch failed as a whole.
+func (s *Storage) CreateUsers(ctx context.Context, users []*model.User) ([]error, error) {
+	s.logger.Printf("INFO:MongoDB|Creating [%d] users.", len(users))
+	documents := make([]interface{}, len(users))
+	for i, user := range users {
+		document := *user
+		document.NormalizedEmail = model.NormalizeEmail(user.Email)
+		document.SearchTerms = model.SearchTerms(user)
+		document.Version = 1
+		documents[i] = document
+	}
+	errs := make([]error, len(users))
+	_, err := s.collection.InsertMany(ctx, documents, options.InsertMany().SetOrdered(false))
+	if err != nil {
+		var bulkErr mongo.BulkWriteException
+		if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+			s.logger.Printf("ERROR:MongoDB|Could not create users. [%s]", err)
+			return nil, toDomainError(err, "")
+		}
+		for _, writeErr := range bulkErr.WriteErrors {
+			s.logger.Printf("ERROR:MongoDB|Could not create user. [%s]", writeErr)
+			errs[writeErr.Index] = toDomainError(writeErr, users[writeErr.Index].ID)
+		}
+	}
+	s.logger.Printf("INFO:MongoDB|Batch creation done.")
+	return errs, nil
+}
+
+// Get users with any of the ids, including soft deleted users. Unknown ids are left out.
+func (s *Storage) GetUsers(ctx context.Context, ids []string) ([]model.User, error) {
+	s.logger.Printf("INFO:MongoDB|Getting [%d] users.", len(ids))
+	cur, err := s.collection.Find(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}})
+	if err != nil {
+		s.logger.Printf("ERROR:MongoDB|Could not get users. [%s]", err)
+		return nil, toDomainError(err, "")
+	}
+	var users []model.User
+	if err := cur.All(ctx, &users); err != nil {
+		s.logger.Printf("ERROR:MongoDB|Could not decode users. [%s]", err)
+		return nil, toDomainError(err, "")
+	}
+	return users, nil
+}
+
+// Get user with corresponding id, including soft deleted users.
+func (s *Storage) GetUser(ctx context.Context, id string) (*model.User, error) {
+	s.logger.Printf("INFO:MongoDB|Getting user with id:[%s]", id)
+	user := model.User{}
+	if err := s.collection.FindOne(ctx, schemeIDFilter(id)).Decode(&user); err != nil {
+		s.logger.Printf("ERROR:MongoDB|Could not get [%s] error is: [%s]", id, err)
+		return nil, toDomainError(err, id)
+	}
+	return &user, nil
+}
+
+// Update the given fields of the user in database and return the stored user. Updates only one item.
+// A non-zero user version must match the stored one.
+func (s *Storage) UpdateUser(ctx context.Context, user *model.User, fields []string) (*model.User, error) {
 	s.logger.Printf("INFO:MongoDB|Updating user")
-	filterID := schemeIDFilter(user.ID)
+	fields, err := model.UpdateMask(fields)
+	if err != nil {
+		s.logger.Printf("ERROR:MongoDB|Update error is  [%s]", err)
+		return nil, err
+	}
+	for {
+		update, err := s.updateUser(ctx, user, fields)
+		if user.Version == 0 && errors.Is(err, model.ErrConflict) {
+			// The user changed after its searchable fields were read, read them again.
+			s.logger.Printf("WARNING:MongoDB|User [%s] changed while updating, retrying", user.ID)
+			continue
+		}
+		return update, err
+	}
+}
+
+// Update the given fields of the user once. The search terms are folded from the stored user, which
+// must not change in between, so an update without version reports a conflict when it raced another write.
+func (s *Storage) updateUser(ctx context.Context, user *model.User, fields []string) (*model.User, error) {
+	set := toUserBson(user, fields)
+	version := user.Version
+	if model.TouchesSearch(fields) {
+		// Search terms fold all searchable fields, so the ones left out of the mask are read first.
+		// The update only applies if the user did not change in between.
+		current := model.User{}
+		if err := s.collection.FindOne(ctx, versionFilter(user.ID, 0)).Decode(&current); err != nil {
+			s.logger.Printf("ERROR:MongoDB|Update error is  [%s]", err)
+			return nil, toDomainError(err, user.ID)
+		}
+		if version == 0 {
+			version = current.Version
+		}
+		current.Apply(user, fields)
+		*set = append(*set, bson.E{Key: "search", Value: current.SearchTerms})
+	}
+	filterID := versionFilter(user.ID, version)
 	s.logger.Printf("INFO:MongoDB|Filtering on = [%s]", filterID)
 	updateDocument := bson.M{
-		"$set": toUserBson(user),
+		"$set": set,
+		"$inc": bson.M{"version": 1},
 	}
-	result := s.collection.FindOneAndUpdate(ctx, filterID, updateDocument)
+	result := s.collection.FindOneAndUpdate(ctx, filterID, updateDocument, options.FindOneAndUpdate().SetReturnDocument(options.After))
 	if result.Err() != nil {
 		s.logger.Printf("ERROR:MongoDB|Update error is  [%s]", result.Err())
-		return nil, result.Err()
+		if version != 0 && errors.Is(result.Err(), mongo.ErrNoDocuments) {
+			return nil, s.missingOrChanged(ctx, user.ID)
+		}
+		return nil, toDomainError(result.Err(), user.ID)
 	}
 	update := model.User{}
-	result.Decode(&update)
+	if err := result.Decode(&update); err != nil {
+		s.logger.Printf("ERROR:MongoDB|Could not decode updated user [%s]", err)
+		return nil, err
+	}
 	s.logger.Printf("INFO:MongoDB|Update successful user. [%s]", update.ID)
-	return user, nil
+	return &update, nil
 }
 
-// Delete user in database with corresponding id.
-func (s *Storage) DeleteUser(ctx context.Context, id string) (*string, error) {
+// Soft delete user in database with corresponding id and return it. A non-zero version must match the stored one.
+func (s *Storage) DeleteUser(ctx context.Context, id string, version int64) (*model.User, error) {
 	s.logger.Printf("INFO:MongoDB|Deleting user with id:[%s]", id)
-	filterId := schemeIDFilter(id)
-	res := s.collection.FindOneAndDelete(ctx, filterId)
+	filterId := versionFilter(id, version)
+	now := time.Now()
+	res := s.collection.FindOneAndUpdate(ctx, filterId, bson.M{
+		"$set": bson.M{"deleted_at": now, "updated_at": now},
+		"$inc": bson.M{"version": 1},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After))
 	if res.Err() != nil {
 		s.logger.Printf("ERROR:MongoDB|Could not delete [%s] error is: [%s]", id, res.Err())
-		return nil, res.Err()
+		if version != 0 && errors.Is(res.Err(), mongo.ErrNoDocuments) {
+			return nil, s.missingOrChanged(ctx, id)
+		}
+		return nil, toDomainError(res.Err(), id)
+	}
+	deleted := model.User{}
+	if err := res.Decode(&deleted); err != nil {
+		s.logger.Printf("ERROR:MongoDB|Could not decode deleted user [%s]", err)
+		return nil, err
 	}
 	s.logger.Printf("INFO:MongoDB|Delete successful.")
-	return &id, nil
+	return &deleted, nil
+}
+
+// Restore soft deleted user and return it. A non-zero version must match the stored one.
+func (s *Storage) RestoreUser(ctx context.Context, id string, version int64) (*model.User, error) {
+	s.logger.Printf("INFO:MongoDB|Restoring user with id:[%s]", id)
+	filter := bson.D{{Key: "_id", Value: id}, {Key: "deleted_at", Value: bson.D{{Key: "$ne", Value: nil}}}}
+	if version != 0 {
+		filter = append(filter, bson.E{Key: "version", Value: version})
+	}
+	res := s.collection.FindOneAndUpdate(ctx, filter, bson.M{
+		"$unset": bson.M{"deleted_at": ""},
+		"$set":   bson.M{"updated_at": time.Now()},
+		"$inc":   bson.M{"version": 1},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After))
+	if errors.Is(res.Err(), mongo.ErrNoDocuments) {
+		current := model.User{}
+		err := s.collection.FindOne(ctx, schemeIDFilter(id)).Decode(&current)
+		switch {
+		case err != nil:
+			err = toDomainError(err, id)
+		case current.DeletedAt == nil:
+			err = model.NewFailedPreconditionError("user", id, "User is not deleted.")
+		default:
+			err = model.NewVersionConflictError("user", id)
+		}
+		s.logger.Printf("ERROR:MongoDB|Could not restore [%s] error is: [%s]", id, err)
+		return nil, err
+	}
+	if res.Err() != nil {
+		s.logger.Printf("ERROR:MongoDB|Could not restore [%s] error is: [%s]", id, res.Err())
+		return nil, toDomainError(res.Err(), id)
+	}
+	restored := model.User{}
+	if err := res.Decode(&restored); err != nil {
+		s.logger.Printf("ERROR:MongoDB|Could not decode restored user [%s]", err)
+		return nil, err
+	}
+	s.logger.Printf("INFO:MongoDB|Restore successful.")
+	return &restored, nil
+}
+
+// Permanently remove soft deleted user with corresponding id and return it.
+func (s *Storage) PurgeUser(ctx context.Context, id string) (*model.User, error) {
+	s.logger.Printf("INFO:MongoDB|Purging user with id:[%s]", id)
+	filter := bson.D{{Key: "_id", Value: id}, {Key: "deleted_at", Value: bson.D{{Key: "$ne", Value: nil}}}}
+	res := s.collection.FindOneAndDelete(ctx, filter)
+	if errors.Is(res.Err(), mongo.ErrNoDocuments) {
+		err := error(model.NewNotFoundError("user", id))
+		if count, countErr := s.collection.CountDocuments(ctx, schemeIDFilter(id)); countErr == nil && count > 0 {
+			err = model.NewFailedPreconditionError("user", id, "User must be deleted before it is purged.")
+		}
+		s.logger.Printf("ERROR:MongoDB|Could not purge [%s] error is: [%s]", id, err)
+		return nil, err
+	}
+	if res.Err() != nil {
+		s.logger.Printf("ERROR:MongoDB|Could not purge [%s] error is: [%s]", id, res.Err())
+		return nil, toDomainError(res.Err(), id)
+	}
+	purged := model.User{}
+	if err := res.Decode(&purged); err != nil {
+		s.logger.Printf("ERROR:MongoDB|Could not decode purged user [%s]", err)
+		return nil, err
+	}
+	s.logger.Printf("INFO:MongoDB|Purge successful.")
+	return &purged, nil
 }
 
-// Query users with a filter.
-func (s *Storage) QueryUsers(ctx context.Context, filter *model.UserQuery) ([]model.User, error) {
+// Users deleted before the given time, the earliest deleted first, at most limit.
+func (s *Storage) DeletedUsers(ctx context.Context, before time.Time, limit int64) ([]model.User, error) {
+	s.logger.Printf("INFO:MongoDB|Getting users deleted before [%s]", before)
+	opts := options.Find().
+		SetSort(bson.D{{Key: "deleted_at", Value: 1}, {Key: "_id", Value: 1}}).
+		SetLimit(limit)
+	cur, err := s.collection.Find(ctx, bson.D{{Key: "deleted_at", Value: bson.D{{Key: "$lt", Value: before}}}}, opts)
+	if err != nil {
+		s.logger.Printf("ERROR:MongoDB|Could not get deleted users. [%s]", err)
+		return nil, toDomainError(err, "")
+	}
+	var users []model.User
+	if err := cur.All(ctx, &users); err != nil {
+		s.logger.Printf("ERROR:MongoDB|Could not decode users. [%s]", err)
+		return nil, toDomainError(err, "")
+	}
+	return users, nil
+}
+
+// Query users with a filter. Returns the requested page and its pagination metadata.
+func (s *Storage) QueryUsers(ctx context.Context, filter *model.UserQuery) ([]model.User, *model.UserPage, error) {
 	s.logger.Printf("INFO:MongoDB|Querying user with given filter")
 	var results []bson.M
 
 	limit := int64(*filter.Size)
 	skip := int64(*filter.Page)*limit - limit
+	if filter.After != nil {
+		skip = 0
+	}
 
-	pipeline := createPipeline(filterBuilder(filter), limit, skip)
+	order := filter.Order()
+	pipeline := createPipeline(filterBuilder(filter), keysetFilter(filter.After, order), sortBuilder(order), limit, skip)
 	cur, err := s.collection.Aggregate(ctx, pipeline)
 	if err != nil {
 		s.logger.Printf("ERROR:MongoDB|Aggregation error [%s]", err)
-		return nil, err
+		return nil, nil, toDomainError(err, "")
 	}
-	if err = cur.All(context.TODO(), &results); err != nil {
+	if err = cur.All(ctx, &results); err != nil {
 		s.logger.Printf("ERROR:MongoDB|Cursor error [%s]", err)
-		return nil, err
+		return nil, nil, toDomainError(err, "")
 	}
 
 	res, err := fromBsonToUser(results)
 
 	if err != nil {
 		s.logger.Printf("ERROR:MongoDB|Could not convert BSON to User model. Error is: [%s]", err)
-		return nil, err
+		return nil, nil, err
 	}
+	page := model.NewUserPage(*filter.Page, *filter.Size, fromBsonToTotal(results))
+	res, page.NextCursor = model.TrimPage(res, limit, order)
 	s.logger.Printf("INFO:MongoDB|Query result")
-	return res, nil
+	return res, page, nil
+}
+
+// Calls fn for every user matching the filter in query order, reading the cursor one batch at a time.
+// Paging fields of the filter are ignored. Stops at the first error of fn or when the context is done.
+func (s *Storage) StreamUsers(ctx context.Context, filter *model.UserQuery, fn func(*model.User) error) error {
+	s.logger.Printf("INFO:MongoDB|Streaming users with given filter")
+	opts := options.Find().SetSort(*sortBuilder(filter.Order())).SetBatchSize(streamBatchSize)
+	cur, err := s.collection.Find(ctx, filterBuilder(filter), opts)
+	if err != nil {
+		s.logger.Printf("ERROR:MongoDB|Find error [%s]", err)
+		return toDomainError(err, "")
+	}
+	defer cur.Close(context.Background())
+
+	var streamed int64
+	for cur.Next(ctx) {
+		user := model.User{}
+		if err := cur.Decode(&user); err != nil {
+			s.logger.Printf("ERROR:MongoDB|Could not decode user [%s]", err)
+			return err
+		}
+		if err := fn(&user); err != nil {
+			s.logger.Printf("WARNING:MongoDB|Stream stopped after [%d] users [%s]", streamed, err)
+			return err
+		}
+		streamed++
+	}
+	if err := ctx.Err(); err != nil {
+		s.logger.Printf("WARNING:MongoDB|Stream stopped after [%d] users [%s]", streamed, err)
+		return err
+	}
+	if err := cur.Err(); err != nil {
+		s.logger.Printf("ERROR:MongoDB|Cursor error [%s]", err)
+		return toDomainError(err, "")
+	}
+	s.logger.Printf("INFO:MongoDB|Streamed [%d] users", streamed)
+	return nil
 }
 
 // Disconnect from database.
@@ -174,30 +445,83 @@ func (s *Storage) GracefullShutdown(ctx context.Context) error {
 	return nil
 }
 
-// Creates query pipeline for the aggregation.
-func createPipeline(filter *bson.D, limit, skip int64) []bson.M {
+// Creates query pipeline for the aggregation. Data is sorted and continues after the keyset filter if given.
+// One document more than the limit is fetched to detect a following page.
+func createPipeline(filter *bson.D, after *bson.D, sort *bson.D, limit, skip int64) []bson.M {
+
+	data := []bson.M{}
+	if after != nil {
+		data = append(data, bson.M{"$match": *after})
+	}
+	data = append(data,
+		bson.M{"$sort": *sort},
+		bson.M{"$skip": skip},
+		bson.M{"$limit": limit + 1},
+	)
 
 	pipeline := []bson.M{
 		{"$match": *filter},
 		{"$facet": bson.M{
 			"metadata": []bson.M{
 				{"$count": "total"},
-				{"$limit": limit},
-				{"$skip": skip},
-			},
-			"data": []bson.M{
-				{"$limit": limit},
 			},
+			"data": data,
 		}},
 	}
 	return pipeline
 }
 
+// Builds the $sort stage document for the order.
+func sortBuilder(order []model.SortOrder) *bson.D {
+	sort := bson.D{}
+	for _, o := range order {
+		direction := 1
+		if o.Descending {
+			direction = -1
+		}
+		sort = append(sort, bson.E{Key: fieldKey(o.Field), Value: direction})
+	}
+	return &sort
+}
+
+// Builds the filter matching users after the cursor in the given order. Returns nil without cursor.
+// For order (a, b) it matches a > x OR (a = x AND b > y), comparisons flip for descending fields.
+func keysetFilter(cursor *model.Cursor, order []model.SortOrder) *bson.D {
+	if cursor == nil {
+		return nil
+	}
+	or := bson.A{}
+	for i, o := range order {
+		branch := bson.D{}
+		for j := 0; j < i; j++ {
+			branch = append(branch, bson.E{Key: fieldKey(order[j].Field), Value: cursor.Values[j]})
+		}
+		operator := "$gt"
+		if o.Descending {
+			operator = "$lt"
+		}
+		branch = append(branch, bson.E{Key: fieldKey(o.Field), Value: bson.D{{Key: operator, Value: cursor.Values[i]}}})
+		or = append(or, branch)
+	}
+	return &bson.D{{Key: "$or", Value: or}}
+}
+
+// Document key of the field.
+func fieldKey(field string) string {
+	if field == "id" {
+		return "_id"
+	}
+	return field
+}
+
 // Builds the custom filter.
 func filterBuilder(filter *model.UserQuery) *bson.D {
 
 	f := bson.D{}
 
+	if filter.ID != nil {
+		f = append(f, bson.E{Key: "_id", Value: *filter.ID})
+	}
 	if filter.FirstName != nil {
 		titleCased := cases.Title(language.English, cases.Compact).String(*filter.FirstName)
 		f = append(f, bson.E{Key: "first_name", Value: titleCased})
@@ -209,31 +533,113 @@ func filterBuilder(filter *model.UserQuery) *bson.D {
 	if filter.NickName != nil {
 		f = append(f, bson.E{Key: "nickname", Value: *filter.NickName})
 	}
+	if filter.Email != nil {
+		f = append(f, bson.E{Key: "email_normalized", Value: model.NormalizeEmail(*filter.Email)})
+	}
 	if filter.Country != nil {
 		f = append(f, bson.E{Key: "country", Value: *filter.Country})
 	}
+	if filter.Search != nil {
+		// Matches if any element of the folded search terms contains the folded text.
+		f = append(f, bson.E{Key: "search", Value: primitive.Regex{Pattern: regexp.QuoteMeta(model.FoldText(*filter.Search))}})
+	}
+	if !filter.IncludeDeleted {
+		// Null also matches documents without the field.
+		f = append(f, bson.E{Key: "deleted_at", Value: nil})
+	}
 
 	return &f
 }
 
+// Translates driver errors into domain errors. Unknown errors are returned as is.
+func toDomainError(err error, id string) error {
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments):
+		return model.NewNotFoundError("user", id)
+	case mongo.IsDuplicateKeyError(err):
+		return model.NewAlreadyExistsError("user", duplicateField(err), err)
+	case mongo.IsNetworkError(err), mongo.IsTimeout(err), errors.Is(err, mongo.ErrClientDisconnected):
+		return model.NewUnavailableError(err)
+	}
+	return err
+}
+
+// Explains why a conditional write matched no document: the user is gone or was changed in between.
+func (s *Storage) missingOrChanged(ctx context.Context, id string) error {
+	count, err := s.collection.CountDocuments(ctx, versionFilter(id, 0))
+	if err != nil {
+		return toDomainError(err, id)
+	}
+	if count == 0 {
+		return model.NewNotFoundError("user", id)
+	}
+	return model.NewVersionConflictError("user", id)
+}
+
+// Filter on _id of an active user, and on version unless it is 0.
+func versionFilter(id string, version int64) *bson.D {
+	filter := schemeIDFilter(id)
+	*filter = append(*filter, bson.E{Key: "deleted_at", Value: nil})
+	if version != 0 {
+		*filter = append(*filter, bson.E{Key: "version", Value: version})
+	}
+	return filter
+}
+
 // Extract _id from filter.
 func schemeIDFilter(filter any) *bson.D {
 
 	return &bson.D{{Key: "_id", Value: filter}}
 }
 
-// Converts user struct to BSON Document pointer.
-func toUserBson(user *model.User) *bson.D {
+// Converts the given fields of the user to a BSON Document pointer. Updated at is always set.
+func toUserBson(user *model.User, fields []string) *bson.D {
+
+	d := bson.D{}
+	for _, field := range fields {
+		switch field {
+		case "first_name":
+			d = append(d, bson.E{Key: "first_name", Value: user.FirstName})
+		case "last_name":
+			d = append(d, bson.E{Key: "last_name", Value: user.LastName})
+		case "nickname":
+			d = append(d, bson.E{Key: "nickname", Value: user.NickName})
+		case "password":
+			d = append(d, bson.E{Key: "password", Value: user.Password})
+		case "email":
+			d = append(d,
+				bson.E{Key: "email", Value: user.Email},
+				bson.E{Key: "email_normalized", Value: model.NormalizeEmail(user.Email)},
+			)
+		case "country":
+			d = append(d, bson.E{Key: "country", Value: user.Country})
+		}
+	}
+	d = append(d, bson.E{Key: "updated_at", Value: time.Now()})
+	return &d
+}
+
+// Extracts total number of matching documents from the facet metadata.
+func fromBsonToTotal(queriedUser []primitive.M) int64 {
+	for _, q := range queriedUser {
+		metadata, ok := q["metadata"].(primitive.A)
+		if !ok || len(metadata) == 0 {
+			continue
+		}
+		return toInt64(metadata[0].(primitive.M)["total"])
+	}
+	return 0
+}
 
-	return &bson.D{
-		bson.E{Key: "first_name", Value: user.FirstName},
-		bson.E{Key: "last_name", Value: user.LastName},
-		bson.E{Key: "nickname", Value: user.NickName},
-		bson.E{Key: "password", Value: user.Password},
-		bson.E{Key: "email", Value: user.Email},
-		bson.E{Key: "country", Value: user.Country},
-		bson.E{Key: "updated_at", Value: time.Now()},
+// Integer value of a decoded number, 0 if it is not one.
+func toInt64(value any) int64 {
+	switch value := value.(type) {
+	case int32:
+		return int64(value)
+	case int64:
+		return value
 	}
+	return 0
 }
 
 // Converts BSON Document to user slice.
@@ -244,6 +650,11 @@ func fromBsonToUser(queriedUser []primitive.M) ([]model.User, error) {
 	for _, q := range queriedUser {
 		for _, d := range q["data"].(primitive.A) {
 
+			var deletedAt *time.Time
+			if t, ok := d.(primitive.M)["deleted_at"].(primitive.DateTime); ok {
+				deleted := t.Time()
+				deletedAt = &deleted
+			}
 			result = append(result, model.User{
 				ID:        d.(primitive.M)["_id"].(string),
 				FirstName: d.(primitive.M)["first_name"].(string),
@@ -254,6 +665,8 @@ func fromBsonToUser(queriedUser []primitive.M) ([]model.User, error) {
 				Country:   d.(primitive.M)["country"].(string),
 				CreatedAt: d.(primitive.M)["created_at"].(primitive.DateTime).Time(),
 				UpdatedAt: d.(primitive.M)["updated_at"].(primitive.DateTime).Time(),
+				Version:   toInt64(d.(primitive.M)["version"]),
+				DeletedAt: deletedAt,
 			})
 
 		}
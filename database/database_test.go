@@ -0,0 +1,144 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/berkantay/user-management-service/model"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func int64Ptr(i int64) *int64 {
+	return &i
+}
+
+func TestFilterBuilderSingleField(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter model.UserQuery
+		want   bson.D
+	}{
+		{"empty", model.UserQuery{}, bson.D{}},
+		{"id", model.UserQuery{ID: stringPtr("123")}, bson.D{{Key: "_id", Value: "123"}}},
+		{"first name", model.UserQuery{FirstName: stringPtr("john")}, bson.D{{Key: "first_name", Value: "John"}}},
+		{"last name", model.UserQuery{LastName: stringPtr("DOE")}, bson.D{{Key: "last_name", Value: "Doe"}}},
+		{"nickname", model.UserQuery{NickName: stringPtr("JohnD")}, bson.D{{Key: "nickname", Value: "JohnD"}}},
+		{"email", model.UserQuery{Email: stringPtr("John.Doe@Example.com")}, bson.D{{Key: "email_normalized", Value: "john.doe@example.com"}}},
+		{"email trimmed", model.UserQuery{Email: stringPtr(" john@example.com ")}, bson.D{{Key: "email_normalized", Value: "john@example.com"}}},
+		{"country", model.UserQuery{Country: stringPtr("UK")}, bson.D{{Key: "country", Value: "UK"}}},
+		{"search", model.UserQuery{Search: stringPtr("Güneş")}, bson.D{{Key: "search", Value: primitive.Regex{Pattern: "gunes"}}}},
+		{"search escaped", model.UserQuery{Search: stringPtr("a.b*")}, bson.D{{Key: "search", Value: primitive.Regex{Pattern: `a\.b\*`}}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			want := append(test.want, bson.E{Key: "deleted_at", Value: nil})
+			assert.Equal(t, &want, filterBuilder(&test.filter))
+		})
+	}
+}
+
+func TestFilterBuilderAllFields(t *testing.T) {
+	filter := &model.UserQuery{
+		ID:        stringPtr("123"),
+		FirstName: stringPtr("john"),
+		LastName:  stringPtr("doe"),
+		NickName:  stringPtr("jd"),
+		Email:     stringPtr("JD@example.com"),
+		Country:   stringPtr("TR"),
+		Search:    stringPtr("Jo"),
+		Page:      int64Ptr(2),
+		Size:      int64Ptr(5),
+		OrderBy:   []model.SortOrder{{Field: "email"}},
+		After:     &model.Cursor{Values: []any{"jd@example.com", "100"}},
+	}
+
+	assert.Equal(t, &bson.D{
+		{Key: "_id", Value: "123"},
+		{Key: "first_name", Value: "John"},
+		{Key: "last_name", Value: "Doe"},
+		{Key: "nickname", Value: "jd"},
+		{Key: "email_normalized", Value: "jd@example.com"},
+		{Key: "country", Value: "TR"},
+		{Key: "search", Value: primitive.Regex{Pattern: "jo"}},
+		{Key: "deleted_at", Value: nil},
+	}, filterBuilder(filter))
+}
+
+func TestFilterBuilderIgnoresPaging(t *testing.T) {
+	filter := &model.UserQuery{
+		Page:    int64Ptr(3),
+		Size:    int64Ptr(20),
+		OrderBy: []model.SortOrder{{Field: "created_at", Descending: true}},
+		After:   &model.Cursor{Values: []any{time.Now(), "1"}},
+	}
+
+	assert.Equal(t, &bson.D{{Key: "deleted_at", Value: nil}}, filterBuilder(filter))
+}
+
+func TestFilterBuilderIncludeDeleted(t *testing.T) {
+	assert.Equal(t, &bson.D{}, filterBuilder(&model.UserQuery{IncludeDeleted: true}))
+}
+
+func TestSortBuilder(t *testing.T) {
+	order := (&model.UserQuery{OrderBy: []model.SortOrder{{Field: "last_name"}, {Field: "updated_at", Descending: true}}}).Order()
+
+	assert.Equal(t, &bson.D{
+		{Key: "last_name", Value: 1},
+		{Key: "updated_at", Value: -1},
+		{Key: "_id", Value: 1},
+	}, sortBuilder(order))
+}
+
+func TestKeysetFilter(t *testing.T) {
+	order := (&model.UserQuery{OrderBy: []model.SortOrder{{Field: "last_name", Descending: true}}}).Order()
+	cursor := &model.Cursor{Values: []any{"Doe", "123"}}
+
+	assert.Nil(t, keysetFilter(nil, order))
+	assert.Equal(t, &bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "last_name", Value: bson.D{{Key: "$lt", Value: "Doe"}}}},
+		bson.D{
+			{Key: "last_name", Value: "Doe"},
+			{Key: "_id", Value: bson.D{{Key: "$gt", Value: "123"}}},
+		},
+	}}}, keysetFilter(cursor, order))
+}
+
+func TestDuplicateField(t *testing.T) {
+	tests := map[string]string{
+		`E11000 duplicate key error collection: user.information index: email_unique dup key: { email_normalized: "a@b.c" }`: "email",
+		`E11000 duplicate key error collection: user.information index: nickname_unique dup key: { nickname: "jd" }`:         "nickname",
+		`E11000 duplicate key error collection: user.information index: _id_ dup key: { _id: "1" }`:                          "id",
+	}
+
+	for msg, field := range tests {
+		assert.Equal(t, field, duplicateField(errors.New(msg)))
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	names := map[string]bool{}
+	for _, index := range indexes() {
+		name := *index.Options.Name
+		assert.False(t, names[name], "duplicate index name %s", name)
+		names[name] = true
+	}
+	assert.True(t, *indexes()[0].Options.Unique)
+	assert.True(t, names[emailIndex])
+	assert.True(t, names[nicknameIndex])
+}
+
+func TestOutboxIndexes(t *testing.T) {
+	indexes := outboxIndexes()
+	assert.Len(t, indexes, 2)
+	// Pending events are found and read in creation order from the index.
+	assert.Equal(t, bson.D{{Key: "sent_at", Value: 1}, {Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}, indexes[0].Keys)
+	assert.Equal(t, int32(sentEventRetention.Seconds()), *indexes[1].Options.ExpireAfterSeconds)
+}
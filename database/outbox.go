@@ -0,0 +1,163 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/berkantay/user-management-service/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Published events are removed from the outbox after this long.
+const sentEventRetention = 7 * 24 * time.Hour
+
+// Indexes of the outbox collection. Pending events are read in creation order, sent ones expire.
+func outboxIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "sent_at", Value: 1}, {Key: "created_at", Value: 1}, {Key: "_id", Value: 1}},
+			Options: options.Index().SetName("pending"),
+		},
+		{
+			Keys:    bson.D{{Key: "sent_at", Value: 1}},
+			Options: options.Index().SetName("sent_at_ttl").SetExpireAfterSeconds(int32(sentEventRetention.Seconds())),
+		},
+	}
+}
+
+// Id of the document holding the relay lease.
+const relayLeaseID = "relay"
+
+// Filter on events not published yet and not parked. Null also matches documents without the field.
+func pendingFilter() bson.D {
+	return bson.D{{Key: "sent_at", Value: nil}, {Key: "parked_at", Value: nil}}
+}
+
+// Runs fn in a transaction, retrying it on transient errors. Transactions need a replica set.
+func (s *Storage) InTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	session, err := s.client.StartSession()
+	if err != nil {
+		s.logger.Printf("ERROR:MongoDB|Could not start session [%s]", err)
+		return toDomainError(err, "")
+	}
+	defer session.EndSession(context.Background())
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	var domainErr *model.Error
+	if err != nil && !errors.As(err, &domainErr) {
+		s.logger.Printf("ERROR:MongoDB|Transaction failed [%s]", err)
+		return toDomainError(err, "")
+	}
+	return err
+}
+
+// Stores the event in the outbox, as part of the transaction of the context if any.
+func (s *Storage) AddEvent(ctx context.Context, event *model.OutboxEvent) error {
+	if _, err := s.outbox.InsertOne(ctx, event); err != nil {
+		s.logger.Printf("ERROR:MongoDB|Could not add event [%s]", err)
+		return toDomainError(err, "")
+	}
+	return nil
+}
+
+// Oldest events not published yet, at most limit.
+func (s *Storage) PendingEvents(ctx context.Context, limit int) ([]model.OutboxEvent, error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}).
+		SetLimit(int64(limit))
+	cur, err := s.outbox.Find(ctx, pendingFilter(), opts)
+	if err != nil {
+		s.logger.Printf("ERROR:MongoDB|Could not get pending events [%s]", err)
+		return nil, toDomainError(err, "")
+	}
+	var events []model.OutboxEvent
+	if err := cur.All(ctx, &events); err != nil {
+		s.logger.Printf("ERROR:MongoDB|Could not decode pending events [%s]", err)
+		return nil, toDomainError(err, "")
+	}
+	return events, nil
+}
+
+// Marks the event as published.
+func (s *Storage) MarkEventSent(ctx context.Context, id string, sentAt time.Time) error {
+	_, err := s.outbox.UpdateByID(ctx, id, bson.D{{Key: "$set", Value: bson.D{{Key: "sent_at", Value: sentAt}}}})
+	if err != nil {
+		s.logger.Printf("ERROR:MongoDB|Could not mark event [%s] as sent [%s]", id, err)
+		return toDomainError(err, id)
+	}
+	return nil
+}
+
+// Records a failed publish attempt of the event.
+func (s *Storage) MarkEventFailed(ctx context.Context, id string, reason string) error {
+	_, err := s.outbox.UpdateByID(ctx, id, bson.D{
+		{Key: "$inc", Value: bson.D{{Key: "attempts", Value: 1}}},
+		{Key: "$set", Value: bson.D{{Key: "last_error", Value: reason}}},
+	})
+	if err != nil {
+		s.logger.Printf("ERROR:MongoDB|Could not mark event [%s] as failed [%s]", id, err)
+		return toDomainError(err, id)
+	}
+	return nil
+}
+
+// Moves the event aside, parked events are kept but no longer pending.
+func (s *Storage) ParkEvent(ctx context.Context, id string, parkedAt time.Time) error {
+	_, err := s.outbox.UpdateByID(ctx, id, bson.D{{Key: "$set", Value: bson.D{{Key: "parked_at", Value: parkedAt}}}})
+	if err != nil {
+		s.logger.Printf("ERROR:MongoDB|Could not park event [%s] [%s]", id, err)
+		return toDomainError(err, id)
+	}
+	return nil
+}
+
+// Takes the relay lease for owner until the given time if it is free, expired or already held by owner.
+// Returns false while another owner holds it. Expiry is checked against the clock of the caller.
+func (s *Storage) AcquireRelayLease(ctx context.Context, owner string, until time.Time) (bool, error) {
+	filter := bson.D{
+		{Key: "_id", Value: relayLeaseID},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "owner", Value: owner}},
+			bson.D{{Key: "expires_at", Value: bson.D{{Key: "$lt", Value: time.Now()}}}},
+		}},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "owner", Value: owner}, {Key: "expires_at", Value: until}}}}
+	_, err := s.leases.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		// The lease is held, the upsert tried to insert a second one.
+		return false, nil
+	}
+	if err != nil {
+		s.logger.Printf("ERROR:MongoDB|Could not take relay lease [%s]", err)
+		return false, toDomainError(err, "")
+	}
+	return true, nil
+}
+
+// Number of events not published yet and creation time of the oldest one, zero when there is none.
+func (s *Storage) OutboxLag(ctx context.Context) (int64, time.Time, error) {
+	pending, err := s.outbox.CountDocuments(ctx, pendingFilter())
+	if err != nil {
+		s.logger.Printf("ERROR:MongoDB|Could not count pending events [%s]", err)
+		return 0, time.Time{}, toDomainError(err, "")
+	}
+	if pending == 0 {
+		return 0, time.Time{}, nil
+	}
+	oldest := model.OutboxEvent{}
+	opts := options.FindOne().SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}})
+	err = s.outbox.FindOne(ctx, pendingFilter(), opts).Decode(&oldest)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// Published since it was counted.
+		return 0, time.Time{}, nil
+	}
+	if err != nil {
+		s.logger.Printf("ERROR:MongoDB|Could not get oldest pending event [%s]", err)
+		return 0, time.Time{}, toDomainError(err, "")
+	}
+	return pending, oldest.CreatedAt, nil
+}
@@ -0,0 +1,178 @@
+package database
+
+import (
+	"context"
+	"strings"
+
+	"github.com/berkantay/user-management-service/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Names of the unique indexes. Duplicate key errors name the violated index, see duplicateField.
+const (
+	emailIndex    = "email_unique"
+	nicknameIndex = "nickname_unique"
+)
+
+// Indexes of the user collection. Nickname is optional so empty nicknames are left out of its unique index.
+// Query indexes end with _id so keyset pages sorted by the field and the id tiebreak are served from the index.
+func indexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "email_normalized", Value: 1}},
+			Options: options.Index().SetName(emailIndex).SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "nickname", Value: 1}},
+			Options: options.Index().SetName(nicknameIndex).SetUnique(true).
+				SetPartialFilterExpression(bson.D{{Key: "nickname", Value: bson.D{{Key: "$gt", Value: ""}}}}),
+		},
+		{
+			Keys:    bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}},
+			Options: options.Index().SetName("created_at"),
+		},
+		{
+			Keys:    bson.D{{Key: "country", Value: 1}, {Key: "created_at", Value: 1}, {Key: "_id", Value: 1}},
+			Options: options.Index().SetName("country_created_at"),
+		},
+		{
+			Keys:    bson.D{{Key: "last_name", Value: 1}, {Key: "first_name", Value: 1}, {Key: "_id", Value: 1}},
+			Options: options.Index().SetName("name"),
+		},
+		{
+			Keys:    bson.D{{Key: "search", Value: 1}},
+			Options: options.Index().SetName("search"),
+		},
+		{
+			Keys:    bson.D{{Key: "deleted_at", Value: 1}},
+			Options: options.Index().SetName("deleted_at").SetSparse(true),
+		},
+	}
+}
+
+// JSON schema every user document must satisfy.
+func validator() bson.D {
+	str := bson.D{{Key: "bsonType", Value: "string"}}
+	date := bson.D{{Key: "bsonType", Value: "date"}}
+	return bson.D{{Key: "$jsonSchema", Value: bson.D{
+		{Key: "bsonType", Value: "object"},
+		{Key: "required", Value: bson.A{"_id", "first_name", "last_name", "email", "email_normalized", "password", "created_at", "updated_at", "version"}},
+		{Key: "properties", Value: bson.D{
+			{Key: "_id", Value: str},
+			{Key: "first_name", Value: str},
+			{Key: "last_name", Value: str},
+			{Key: "nickname", Value: str},
+			{Key: "password", Value: str},
+			{Key: "email", Value: str},
+			{Key: "email_normalized", Value: str},
+			{Key: "country", Value: str},
+			{Key: "search", Value: bson.D{
+				{Key: "bsonType", Value: "array"},
+				{Key: "items", Value: str},
+			}},
+			{Key: "created_at", Value: date},
+			{Key: "updated_at", Value: date},
+			{Key: "version", Value: bson.D{{Key: "bsonType", Value: bson.A{"int", "long"}}}},
+			{Key: "deleted_at", Value: date},
+		}},
+	}}}
+}
+
+// Brings the collection to the current schema: validator, derived fields and indexes.
+// Every step is idempotent so it runs on each start and from the migrate command.
+func (s *Storage) Migrate(ctx context.Context) error {
+	s.logger.Printf("INFO:MongoDB|Applying validator..")
+	if err := s.applyValidator(ctx); err != nil {
+		s.logger.Printf("ERROR:MongoDB|Could not apply validator [%s]", err)
+		return toDomainError(err, "")
+	}
+	s.logger.Printf("INFO:MongoDB|Backfilling derived fields..")
+	if err := s.backfill(ctx); err != nil {
+		s.logger.Printf("ERROR:MongoDB|Could not backfill [%s]", err)
+		return toDomainError(err, "")
+	}
+	s.logger.Printf("INFO:MongoDB|Creating indexes..")
+	// Creating an index that already exists with same options is a no-op.
+	if _, err := s.collection.Indexes().CreateMany(ctx, indexes()); err != nil {
+		s.logger.Printf("ERROR:MongoDB|Could not create indexes [%s]", err)
+		return toDomainError(err, "")
+	}
+	// Creates the outbox collection too, collections can not always be created inside a transaction.
+	if _, err := s.outbox.Indexes().CreateMany(ctx, outboxIndexes()); err != nil {
+		s.logger.Printf("ERROR:MongoDB|Could not create outbox indexes [%s]", err)
+		return toDomainError(err, "")
+	}
+	s.logger.Printf("INFO:MongoDB|Schema is up to date..")
+	return nil
+}
+
+// Create the collection with the validator, or replace the validator of an existing collection.
+// Moderate validation leaves existing invalid documents updatable.
+func (s *Storage) applyValidator(ctx context.Context) error {
+	db := s.collection.Database()
+	name := s.collection.Name()
+	names, err := db.ListCollectionNames(ctx, bson.D{{Key: "name", Value: name}})
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return db.CreateCollection(ctx, name, options.CreateCollection().
+			SetValidator(validator()).
+			SetValidationLevel("moderate"))
+	}
+	return db.RunCommand(ctx, bson.D{
+		{Key: "collMod", Value: name},
+		{Key: "validator", Value: validator()},
+		{Key: "validationLevel", Value: "moderate"},
+	}).Err()
+}
+
+// Fill email_normalized, search and version on documents written before they existed.
+// The unique email index can not be built while those documents lack the field.
+func (s *Storage) backfill(ctx context.Context) error {
+	_, err := s.collection.UpdateMany(ctx,
+		bson.D{{Key: "version", Value: bson.D{{Key: "$exists", Value: false}}}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "version", Value: int64(1)}}}},
+	)
+	if err != nil {
+		return err
+	}
+
+	cur, err := s.collection.Find(ctx, bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "email_normalized", Value: bson.D{{Key: "$exists", Value: false}}}},
+		bson.D{{Key: "search", Value: bson.D{{Key: "$exists", Value: false}}}},
+	}}})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		user := model.User{}
+		if err := cur.Decode(&user); err != nil {
+			return err
+		}
+		_, err := s.collection.UpdateByID(ctx, user.ID, bson.D{{Key: "$set", Value: bson.D{
+			{Key: "email_normalized", Value: model.NormalizeEmail(user.Email)},
+			{Key: "search", Value: model.SearchTerms(&user)},
+		}}})
+		if err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+// Field whose unique index is violated by the duplicate key error.
+func duplicateField(err error) string {
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, emailIndex):
+		return "email"
+	case strings.Contains(msg, nicknameIndex):
+		return "nickname"
+	}
+	return "id"
+}
@@ -0,0 +1,110 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+
+	pb "github.com/berkantay/user-management-service/grpc/proto"
+	"github.com/berkantay/user-management-service/model"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/runtime/protoiface"
+)
+
+// Canonical names of the gRPC codes, used in pb.Status for backward compatibility.
+var codeNames = map[codes.Code]string{
+	codes.OK:                 "OK",
+	codes.Canceled:           "CANCELLED",
+	codes.Unknown:            "UNKNOWN",
+	codes.InvalidArgument:    "INVALID_ARGUMENT",
+	codes.DeadlineExceeded:   "DEADLINE_EXCEEDED",
+	codes.NotFound:           "NOT_FOUND",
+	codes.AlreadyExists:      "ALREADY_EXISTS",
+	codes.PermissionDenied:   "PERMISSION_DENIED",
+	codes.ResourceExhausted:  "RESOURCE_EXHAUSTED",
+	codes.FailedPrecondition: "FAILED_PRECONDITION",
+	codes.Aborted:            "ABORTED",
+	codes.OutOfRange:         "OUT_OF_RANGE",
+	codes.Unimplemented:      "UNIMPLEMENTED",
+	codes.Internal:           "INTERNAL",
+	codes.Unavailable:        "UNAVAILABLE",
+	codes.DataLoss:           "DATA_LOSS",
+	codes.Unauthenticated:    "UNAUTHENTICATED",
+}
+
+// Returns the gRPC code matching the domain error kind.
+func toCode(err error) codes.Code {
+	switch {
+	case errors.Is(err, model.ErrNotFound):
+		return codes.NotFound
+	case errors.Is(err, model.ErrAlreadyExists):
+		return codes.AlreadyExists
+	case errors.Is(err, model.ErrInvalidArgument):
+		return codes.InvalidArgument
+	case errors.Is(err, model.ErrConflict):
+		return codes.Aborted
+	case errors.Is(err, model.ErrFailedPrecondition):
+		return codes.FailedPrecondition
+	case errors.Is(err, model.ErrPermissionDenied):
+		return codes.PermissionDenied
+	case errors.Is(err, model.ErrUnavailable):
+		return codes.Unavailable
+	case errors.Is(err, context.Canceled):
+		return codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return codes.DeadlineExceeded
+	}
+	if st, ok := status.FromError(err); ok {
+		return st.Code()
+	}
+	return codes.Internal
+}
+
+// Converts error to a gRPC status error. Domain errors carry BadRequest and ResourceInfo details.
+func toStatusError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var domainErr *model.Error
+	if !errors.As(err, &domainErr) {
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return status.Error(toCode(err), err.Error())
+	}
+
+	st := status.New(toCode(domainErr), domainErr.Message)
+	details := make([]protoiface.MessageV1, 0)
+	if domainErr.Field != "" {
+		details = append(details, &errdetails.BadRequest{
+			FieldViolations: []*errdetails.BadRequest_FieldViolation{
+				{Field: domainErr.Field, Description: domainErr.Message},
+			},
+		})
+	}
+	if domainErr.Resource != "" {
+		details = append(details, &errdetails.ResourceInfo{
+			ResourceType: domainErr.Resource,
+			ResourceName: domainErr.ID,
+			Description:  domainErr.Message,
+		})
+	}
+	if withDetails, err := st.WithDetails(details...); err == nil {
+		st = withDetails
+	}
+	return st.Err()
+}
+
+// Builds response status for the error. Domain errors keep their own message, others use the given one.
+func toPbStatus(err error, message string) *pb.Status {
+	var domainErr *model.Error
+	if errors.As(err, &domainErr) && domainErr.Message != "" {
+		message = domainErr.Message
+	}
+	return &pb.Status{
+		Code:    codeNames[toCode(err)],
+		Message: message,
+	}
+}
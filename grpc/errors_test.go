@@ -0,0 +1,67 @@
+package grpc
+
+import (
+	"errors"
+	"testing"
+
+	pb "github.com/berkantay/user-management-service/grpc/proto"
+	"github.com/berkantay/user-management-service/model"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestToStatusErrorCodes(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code codes.Code
+	}{
+		{"not found", model.NewNotFoundError("user", "1"), codes.NotFound},
+		{"already exists", model.NewAlreadyExistsError("user", "email", nil), codes.AlreadyExists},
+		{"invalid argument", model.NewInvalidArgumentError("email", "Invalid email."), codes.InvalidArgument},
+		{"conflict", model.NewConflictError("user", "1", "version mismatch"), codes.Aborted},
+		{"failed precondition", model.NewFailedPreconditionError("user", "1", "User is not deleted."), codes.FailedPrecondition},
+		{"unavailable", model.NewUnavailableError(errors.New("connection refused")), codes.Unavailable},
+		{"unknown", errors.New("boom"), codes.Internal},
+		{"status", status.Error(codes.Canceled, "canceled"), codes.Canceled},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.code, status.Code(toStatusError(test.err)))
+		})
+	}
+}
+
+func TestToStatusErrorNil(t *testing.T) {
+	assert.Nil(t, toStatusError(nil))
+}
+
+func TestToStatusErrorDetails(t *testing.T) {
+	err := toStatusError(model.NewAlreadyExistsError("user", "email", nil))
+
+	st := status.Convert(err)
+	assert.Len(t, st.Details(), 2)
+
+	badRequest, ok := st.Details()[0].(*errdetails.BadRequest)
+	assert.True(t, ok)
+	assert.Equal(t, "email", badRequest.FieldViolations[0].Field)
+
+	resourceInfo, ok := st.Details()[1].(*errdetails.ResourceInfo)
+	assert.True(t, ok)
+	assert.Equal(t, "user", resourceInfo.ResourceType)
+}
+
+func TestToPbStatus(t *testing.T) {
+	assert.Equal(t, &pb.Status{
+		Code:    "NOT_FOUND",
+		Message: "user 1 not found",
+	}, toPbStatus(model.NewNotFoundError("user", "1"), "Could not delete user."))
+
+	assert.Equal(t, &pb.Status{
+		Code:    "INTERNAL",
+		Message: "Could not delete user.",
+	}, toPbStatus(errors.New("boom"), "Could not delete user."))
+}
@@ -3,31 +3,49 @@ package grpc
 import (
 	"context"
 	"encoding/json"
-	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/mail"
+	"strings"
+	"sync"
+	"time"
 
 	pb "github.com/berkantay/user-management-service/grpc/proto"
 	"github.com/berkantay/user-management-service/model"
+	"github.com/google/uuid"
 
 	"golang.org/x/text/cases"
 	"golang.org/x/text/language"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+const maxSearchLength = 100
+
 const (
-	userCreated = "user_created"
-	userDeleted = "user_deleted"
-	userUpdated = "user_updated"
+	importBatchSize   = 500       // Rows of an import stored with one repository call.
+	maxImportFailures = 1000      // Failed rows listed in an import summary.
+	dryRunMetadata    = "dry-run" // Metadata key asking an import to only check the rows.
 )
 
 type UserService interface {
 	Create(ctx context.Context, user *model.User) (*string, error)
-	Update(ctx context.Context, user *model.User) (*model.User, error)
-	Delete(ctx context.Context, userId string) (*string, error)
-	Query(ctx context.Context, query *model.UserQuery) ([]model.User, error)
+	BatchCreate(ctx context.Context, users []*model.User) ([]model.UserResult, error)
+	Get(ctx context.Context, userId string, includeDeleted bool) (*model.User, error)
+	BatchGet(ctx context.Context, ids []string, includeDeleted bool) ([]model.UserResult, error)
+	Import(ctx context.Context, users []model.ImportUser, dryRun bool) ([]model.UserResult, error)
+	Update(ctx context.Context, user *model.User, fields []string, version int64) (*model.User, error)
+	ChangePassword(ctx context.Context, userId, currentPassword, newPassword string) (*model.User, error)
+	Delete(ctx context.Context, userId string, version int64) (*model.User, error)
+	Restore(ctx context.Context, userId string, version int64) (*model.User, error)
+	Purge(ctx context.Context, userId string) (*model.User, error)
+	Query(ctx context.Context, query *model.UserQuery) ([]model.User, *model.UserPage, error)
+	Stream(ctx context.Context, query *model.UserQuery, fn func(*model.User) error) error
 }
 
 type EventPublisher interface {
@@ -37,38 +55,105 @@ type EventPublisher interface {
 type Server struct {
 	user UserService
 	pb.UnimplementedUserAPIServer
-	logger    *log.Logger
-	publisher EventPublisher
+	logger       *log.Logger
+	publisher    EventPublisher
+	pageTokenKey []byte
+	pageTokens   *pageTokenCodec
+	watchHistory int
+	hub          *eventHub
+	outbox       bool
+	publishing   sync.WaitGroup // Events being sent to the broker.
+}
+
+// Configure server by changing page token key.
+type ServerOption func(*Server)
+
+// Key used to sign page tokens. Servers behind the same load balancer must share the key.
+// A random key is generated when not set, tokens are then valid only for the server instance that issued them.
+func WithPageTokenKey(key []byte) ServerOption {
+	return func(s *Server) {
+		s.pageTokenKey = key
+	}
+}
+
+func NewServer(service UserService, publisher EventPublisher, logger *log.Logger, opts ...ServerOption) *Server {
+	s := &Server{
+		user:         service,
+		logger:       logger,
+		publisher:    publisher,
+		watchHistory: defaultWatchHistory,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.pageTokens = newPageTokenCodec(s.pageTokenKey)
+	s.hub = newEventHub(s.watchHistory)
+
+	return s
+}
+
+// Number of recent events kept so watchers can resume after a reconnect. Zero or less keeps no events,
+// watchers can then only resume if they missed nothing.
+func WithWatchHistory(size int) ServerOption {
+	return func(s *Server) {
+		if size < 0 {
+			size = 0
+		}
+		s.watchHistory = size
+	}
 }
 
-func NewServer(service UserService, publisher EventPublisher, logger *log.Logger) *Server {
-	return &Server{
-		user:      service,
-		logger:    logger,
-		publisher: publisher,
+// Broker events are stored in an outbox by the service and published by a relay, the server only sends them to watchers.
+func WithOutbox() ServerOption {
+	return func(s *Server) {
+		s.outbox = true
 	}
 }
 
-// Run the gRPC server.
-func (s *Server) Run() {
+// Run the gRPC server on port 8080 until the context is done.
+func (s *Server) Run(ctx context.Context) error {
 	s.logger.Printf("INFO:gRPC|Connecting tcp socket..")
 	listen, err := net.Listen("tcp", ":8080")
 	if err != nil {
 		s.logger.Printf("ERROR:gRPC|failed to listen on port 8080 | [%v]", err)
+		return err
 	}
+	return s.Serve(ctx, listen)
+}
 
-	userManagementService := s
-
+// Serve gRPC requests on the listener until the context is done. Running calls are then finished, watchers are
+// asked to reconnect and events still being sent to the broker are waited for.
+func (s *Server) Serve(ctx context.Context, listen net.Listener) error {
 	grpcServer := grpc.NewServer()
 	s.logger.Printf("INFO:gRPC|Registering to User API")
-	pb.RegisterUserAPIServer(grpcServer, userManagementService)
+	pb.RegisterUserAPIServer(grpcServer, s)
 	s.logger.Printf("INFO:gRPC|Registered to User API")
 
-	s.logger.Printf("INFO:gRPC|Binding TCP Socket")
-	grpcServer.Serve(listen)
-	s.logger.Printf("INFO:gRPC|Binded")
-	defer grpcServer.Stop()
+	s.logger.Printf("INFO:gRPC|Serving on [%s]", listen.Addr())
+	served := make(chan error, 1)
+	go func() {
+		served <- grpcServer.Serve(listen)
+	}()
+	select {
+	case err := <-served:
+		s.logger.Printf("ERROR:gRPC|Stopped serving [%s]", err)
+		return err
+	case <-ctx.Done():
+	}
+
+	s.logger.Printf("INFO:gRPC|Shutting down..")
+	s.hub.close()
+	grpcServer.GracefulStop()
+	s.Drain()
+	s.logger.Printf("INFO:gRPC|Stopped.")
+	return nil
+}
 
+// Waits for events still being sent to the broker. Changes reported with Notify after Serve returned,
+// e.g. by a purge finishing during shutdown, are waited for too, call it before closing the publisher.
+func (s *Server) Drain() {
+	s.publishing.Wait()
 }
 
 // Implements CreateUser function according to proto definition.
@@ -76,46 +161,29 @@ func (s *Server) Create(ctx context.Context, req *pb.CreateUserRequest) (*pb.Cre
 	s.logger.Printf("INFO:gRPC|Create called")
 	wrappedMessage := createUserRequestToUser(req)
 	s.logger.Printf("INFO:gRPC|Request converted to user model")
-	s.logger.Printf("INFO:gRPC|Checking if email is valid")
-	isValidEmail := checkIsValidMail(req.Email)
-	if !isValidEmail {
-		s.logger.Printf("WARNING:gRPC|Invalid email")
+	s.logger.Printf("INFO:gRPC|Checking if request is valid")
+	if err := checkCreateRequest(req, false); err != nil {
+		s.logger.Printf("WARNING:gRPC|Invalid request [%s]", err)
 		return &pb.CreateUserResponse{
-			Status: &pb.Status{
-				Code:    "INVALID_ARGUMENT",
-				Message: "Invalid email.",
-			},
-		}, errors.New("invalid email")
+			Status: toPbStatus(err, "Invalid request."),
+		}, toStatusError(err)
 	}
 	insertionId, err := s.user.Create(ctx, wrappedMessage)
 	if err != nil {
 		s.logger.Printf("ERROR:gRPC|Could not create user. [%s]", err)
 		return &pb.CreateUserResponse{
-			Status: &pb.Status{
-				Code:    "INTERNAL",
-				Message: "Could not create user.",
-			},
-		}, err
+			Status: toPbStatus(err, "Could not create user."),
+		}, toStatusError(err)
 	}
 
-	t := toEventMessage(userCreated, &pb.UserPayload{
-		Id: *insertionId,
-	})
-
-	go func() {
-		userIdByte, err := json.Marshal(t)
-		if err != nil {
-			s.logger.Printf("ERROR:gRPC|Could not marshal user create. [%s]", err)
-		}
-		s.publisher.Publish("user", userIdByte)
-	}()
+	s.publish(model.EventUserCreated, wrappedMessage)
 	s.logger.Printf("INFO:gRPC|User created.")
 	return &pb.CreateUserResponse{
 		Status: &pb.Status{
 			Code:    "OK",
 			Message: "User created.",
 		},
-		Payload: &pb.UserPayload{
+		Payload: &pb.User{
 			Id: *insertionId,
 		},
 	}, nil
@@ -124,28 +192,22 @@ func (s *Server) Create(ctx context.Context, req *pb.CreateUserRequest) (*pb.Cre
 // Implements DeleteUser function according to proto definition.
 func (s *Server) Delete(ctx context.Context, req *pb.DeleteUserRequest) (*pb.DeleteUserResponse, error) {
 	s.logger.Printf("INFO:gRPC|Delete user called")
-	id, err := s.user.Delete(ctx, req.Id)
-
+	version, err := toExpectedVersion(req.ExpectedVersion)
+	if err != nil {
+		s.logger.Printf("WARNING:gRPC|Invalid expected version [%s]", err)
+		return &pb.DeleteUserResponse{
+			Status: toPbStatus(err, "Invalid expected version."),
+		}, toStatusError(err)
+	}
+	user, err := s.user.Delete(ctx, req.Id, version)
 	if err != nil {
 		s.logger.Printf("ERROR:gRPC|Could not delete user. [%s]", err)
 		return &pb.DeleteUserResponse{
-			Status: &pb.Status{
-				Code:    "INTERNAL",
-				Message: "Could not delete user. User not found",
-			},
-		}, nil //TODO: Check if err should return or not?
+			Status: toPbStatus(err, "Could not delete user. User not found"),
+		}, toStatusError(err)
 	}
 
-	t := toEventMessage(userDeleted, &pb.UserPayload{
-		Id: *id,
-	})
-	go func() {
-		userIdByte, err := json.Marshal(t)
-		if err != nil {
-			s.logger.Printf("ERROR:gRPC|Could not marshal delete. [%s]", err)
-		}
-		s.publisher.Publish("user", userIdByte)
-	}()
+	s.publish(model.EventUserDeleted, user)
 	s.logger.Printf("INFO:gRPC|User deleted.")
 	return &pb.DeleteUserResponse{
 		Status: &pb.Status{
@@ -153,7 +215,60 @@ func (s *Server) Delete(ctx context.Context, req *pb.DeleteUserRequest) (*pb.Del
 			Message: "User deleted.",
 		},
 		UserIdResponse: &pb.UserIdResponse{
-			Id: *id,
+			Id: user.ID,
+		},
+	}, nil
+}
+
+// Implements RestoreUser function according to proto definition.
+func (s *Server) Restore(ctx context.Context, req *pb.RestoreUserRequest) (*pb.RestoreUserResponse, error) {
+	s.logger.Printf("INFO:gRPC|Restore user called")
+	version, err := toExpectedVersion(req.ExpectedVersion)
+	if err != nil {
+		s.logger.Printf("WARNING:gRPC|Invalid expected version [%s]", err)
+		return &pb.RestoreUserResponse{
+			Status: toPbStatus(err, "Invalid expected version."),
+		}, toStatusError(err)
+	}
+	user, err := s.user.Restore(ctx, req.Id, version)
+	if err != nil {
+		s.logger.Printf("ERROR:gRPC|Could not restore user. [%s]", err)
+		return &pb.RestoreUserResponse{
+			Status: toPbStatus(err, "Could not restore user."),
+		}, toStatusError(err)
+	}
+
+	s.publish(model.EventUserRestored, user)
+	s.logger.Printf("INFO:gRPC|User restored.")
+	return &pb.RestoreUserResponse{
+		Status: &pb.Status{
+			Code:    "OK",
+			Message: "User restored.",
+		},
+		Payload: toPbUser(user),
+	}, nil
+}
+
+// Implements PurgeUser function according to proto definition.
+func (s *Server) Purge(ctx context.Context, req *pb.PurgeUserRequest) (*pb.PurgeUserResponse, error) {
+	s.logger.Printf("INFO:gRPC|Purge user called")
+	user, err := s.user.Purge(ctx, req.Id)
+	if err != nil {
+		s.logger.Printf("ERROR:gRPC|Could not purge user. [%s]", err)
+		return &pb.PurgeUserResponse{
+			Status: toPbStatus(err, "Could not purge user."),
+		}, toStatusError(err)
+	}
+
+	s.publish(model.EventUserPurged, user)
+	s.logger.Printf("INFO:gRPC|User purged.")
+	return &pb.PurgeUserResponse{
+		Status: &pb.Status{
+			Code:    "OK",
+			Message: "User purged.",
+		},
+		UserIdResponse: &pb.UserIdResponse{
+			Id: user.ID,
 		},
 	}, nil
 }
@@ -161,82 +276,343 @@ func (s *Server) Delete(ctx context.Context, req *pb.DeleteUserRequest) (*pb.Del
 // Implements UpdateUser function according to proto definition.
 func (s *Server) Update(ctx context.Context, req *pb.UpdateUserRequest) (*pb.UpdateUserResponse, error) {
 	s.logger.Printf("INFO:gRPC|Updat called")
-	update, err := s.user.Update(ctx, updateUserRequestToUser(req))
+	fields, err := toUpdateFields(req.UpdateMask)
+	if err != nil {
+		s.logger.Printf("WARNING:gRPC|Invalid update mask [%s]", err)
+		return &pb.UpdateUserResponse{
+			Status: toPbStatus(err, "Invalid update mask."),
+		}, toStatusError(err)
+	}
+	version, err := toExpectedVersion(req.ExpectedVersion)
+	if err != nil {
+		s.logger.Printf("WARNING:gRPC|Invalid expected version [%s]", err)
+		return &pb.UpdateUserResponse{
+			Status: toPbStatus(err, "Invalid expected version."),
+		}, toStatusError(err)
+	}
 	s.logger.Printf("INFO:gRPC|Checking if email is valid")
-	isValidEmail := checkIsValidMail(req.Email)
+	isValidEmail := !updatesField(fields, "email") || checkIsValidMail(req.Email)
 	if !isValidEmail {
 		s.logger.Printf("WARNING:gRPC|Invalid email")
+		err := model.NewInvalidArgumentError("email", "Invalid email.")
 		return &pb.UpdateUserResponse{
-			Status: &pb.Status{
-				Code:    "INVALID_ARGUMENT",
-				Message: "Invalid email.",
-			},
-		}, errors.New("invalid email")
+			Status: toPbStatus(err, "Invalid email."),
+		}, toStatusError(err)
 	}
-
+	// Watchers of a country also see users moving out of it, so the country is read before it changes.
+	// The update reports the error of a missing user.
+	var previousCountry string
+	if updatesField(fields, "country") {
+		if current, err := s.user.Get(ctx, req.Id, false); err == nil {
+			previousCountry = current.Country
+		}
+	}
+	update, err := s.user.Update(ctx, updateUserRequestToUser(req), fields, version)
 	if err != nil {
 		s.logger.Printf("ERROR:gRPC|Could not update user. [%s]", err)
 		return &pb.UpdateUserResponse{
-			Status: &pb.Status{
-				Code:    "INTERNAL",
-				Message: "Could not update user.",
-			},
-		}, err
-	}
-
-	t := toEventMessage(userUpdated, &pb.UserPayload{
-		Id:        update.ID,
-		FirstName: update.FirstName,
-		LastName:  update.LastName,
-		NickName:  update.NickName,
-		Password:  update.Password,
-		Email:     update.Email,
-		Country:   update.Country,
-	})
+			Status: toPbStatus(err, "Could not update user."),
+		}, toStatusError(err)
+	}
 
-	go func() {
-		userIdByte, err := json.Marshal(t)
-		if err != nil {
-			s.logger.Printf("ERROR:gRPC|Could not marshal user update. [%s]", err)
-		}
-		s.publisher.Publish("user", userIdByte)
-	}()
+	s.publishMove(model.EventUserUpdated, update, previousCountry)
 	s.logger.Println("INFO:gRPC|User updated")
 	return &pb.UpdateUserResponse{
 		Status: &pb.Status{
 			Code:    "OK",
 			Message: "User updated.",
-		}, Payload: toUserUpdatePayload(update),
+		}, Payload: toPbUser(update),
+	}, nil
+
+}
+
+// Implements ChangePassword function according to proto definition. Neither response nor event carries a password.
+func (s *Server) ChangePassword(ctx context.Context, req *pb.ChangePasswordRequest) (*pb.ChangePasswordResponse, error) {
+	s.logger.Printf("INFO:gRPC|ChangePassword called")
+	user, err := s.user.ChangePassword(ctx, req.Id, req.CurrentPassword, req.NewPassword)
+	if err != nil {
+		s.logger.Printf("ERROR:gRPC|Could not change password. [%s]", err)
+		return &pb.ChangePasswordResponse{
+			Status: toPbStatus(err, "Could not change password."),
+		}, toStatusError(err)
+	}
+
+	s.publish(model.EventPasswordChanged, user)
+	s.logger.Printf("INFO:gRPC|Password changed.")
+	return &pb.ChangePasswordResponse{
+		Status: &pb.Status{
+			Code:    "OK",
+			Message: "Password changed.",
+		},
+		UserIdResponse: &pb.UserIdResponse{
+			Id: req.Id,
+		},
+	}, nil
+}
+
+// Implements BatchCreate function according to proto definition.
+// Every user gets its own result, the call only fails when the batch as a whole can not be processed.
+func (s *Server) BatchCreate(ctx context.Context, req *pb.BatchCreateUsersRequest) (*pb.BatchCreateUsersResponse, error) {
+	s.logger.Printf("INFO:gRPC|BatchCreate called with [%d] users", len(req.Users))
+	if err := model.CheckBatchSize(len(req.Users)); err != nil {
+		s.logger.Printf("WARNING:gRPC|Invalid batch [%s]", err)
+		return &pb.BatchCreateUsersResponse{
+			Status: toPbStatus(err, "Invalid batch."),
+		}, toStatusError(err)
+	}
+	results := make([]*pb.BatchUserResult, len(req.Users))
+	var users []*model.User
+	var positions []int
+	for i, r := range req.Users {
+		if err := checkCreateRequest(r, false); err != nil {
+			results[i] = &pb.BatchUserResult{Status: toPbStatus(err, "Invalid request.")}
+			continue
+		}
+		users = append(users, createUserRequestToUser(r))
+		positions = append(positions, i)
+	}
+
+	created := 0
+	if len(users) > 0 {
+		userResults, err := s.user.BatchCreate(ctx, users)
+		if err != nil {
+			s.logger.Printf("ERROR:gRPC|Could not create users. [%s]", err)
+			return &pb.BatchCreateUsersResponse{
+				Status: toPbStatus(err, "Could not create users."),
+			}, toStatusError(err)
+		}
+		for j, result := range userResults {
+			if result.Err != nil {
+				results[positions[j]] = &pb.BatchUserResult{Status: toPbStatus(result.Err, "Could not create user.")}
+				continue
+			}
+			created++
+			s.publish(model.EventUserCreated, result.User)
+			results[positions[j]] = &pb.BatchUserResult{
+				Status:  &pb.Status{Code: "OK", Message: "User created."},
+				Payload: &pb.User{Id: result.User.ID},
+			}
+		}
+	}
+
+	s.logger.Printf("INFO:gRPC|Created [%d] of [%d] users.", created, len(req.Users))
+	return &pb.BatchCreateUsersResponse{
+		Status: &pb.Status{
+			Code:    "OK",
+			Message: fmt.Sprintf("Created %d of %d users.", created, len(req.Users)),
+		},
+		Results: results,
+	}, nil
+}
+
+// Implements Import function according to proto definition.
+// Rows are checked as they arrive and stored in batches, a failing row does not stop the import.
+func (s *Server) Import(stream pb.UserAPI_ImportServer) error {
+	dryRun := isDryRun(stream.Context())
+	s.logger.Printf("INFO:gRPC|Import called, dry run [%t]", dryRun)
+	summary := &pb.ImportSummary{DryRun: dryRun}
+	fail := func(row int64, err error) {
+		summary.Failed++
+		if len(summary.Failures) < maxImportFailures {
+			summary.Failures = append(summary.Failures, &pb.ImportFailure{Row: row, Status: toPbStatus(err, "Could not import user.")})
+		}
+	}
+
+	var batch []model.ImportUser
+	var rows []int64
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		results, err := s.user.Import(stream.Context(), batch, dryRun)
+		if err != nil {
+			return err
+		}
+		for i, result := range results {
+			if result.Err != nil {
+				fail(rows[i], result.Err)
+				continue
+			}
+			summary.Imported++
+			if !dryRun {
+				s.publish(model.EventUserCreated, result.User)
+			}
+		}
+		batch, rows = nil, nil
+		return nil
+	}
+
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			s.logger.Printf("ERROR:gRPC|Import stream failed. [%s]", err)
+			return err
+		}
+		row := summary.Received
+		summary.Received++
+		if err := checkCreateRequest(req, true); err != nil {
+			fail(row, err)
+			continue
+		}
+		user := createUserRequestToUser(req)
+		if req.PasswordHash != "" {
+			user.Password = req.PasswordHash
+		}
+		batch = append(batch, model.ImportUser{User: user, PasswordHashed: req.PasswordHash != ""})
+		rows = append(rows, row)
+		if len(batch) == importBatchSize {
+			if err := flush(); err != nil {
+				s.logger.Printf("ERROR:gRPC|Could not import users. [%s]", err)
+				return toStatusError(err)
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		s.logger.Printf("ERROR:gRPC|Could not import users. [%s]", err)
+		return toStatusError(err)
+	}
+
+	s.logger.Printf("INFO:gRPC|Imported [%d] of [%d] users.", summary.Imported, summary.Received)
+	summary.Status = &pb.Status{
+		Code:    "OK",
+		Message: fmt.Sprintf("Imported %d of %d users.", summary.Imported, summary.Received),
+	}
+	return stream.SendAndClose(summary)
+}
+
+// Implements BatchGet function according to proto definition.
+// Every id gets its own result, missing users are reported as NOT_FOUND results.
+func (s *Server) BatchGet(ctx context.Context, req *pb.BatchGetUsersRequest) (*pb.BatchGetUsersResponse, error) {
+	s.logger.Printf("INFO:gRPC|BatchGet called with [%d] ids", len(req.Ids))
+	userResults, err := s.user.BatchGet(ctx, req.Ids, req.IncludeDeleted)
+	if err != nil {
+		s.logger.Printf("ERROR:gRPC|Could not get users. [%s]", err)
+		return &pb.BatchGetUsersResponse{
+			Status: toPbStatus(err, "Could not get users."),
+		}, toStatusError(err)
+	}
+	found := 0
+	results := make([]*pb.BatchUserResult, len(userResults))
+	for i, result := range userResults {
+		if result.Err != nil {
+			results[i] = &pb.BatchUserResult{Status: toPbStatus(result.Err, "Could not get user.")}
+			continue
+		}
+		found++
+		results[i] = &pb.BatchUserResult{
+			Status:  &pb.Status{Code: "OK", Message: "User found."},
+			Payload: toPbUser(result.User),
+		}
+	}
+	s.logger.Printf("INFO:gRPC|Found [%d] of [%d] users.", found, len(req.Ids))
+	return &pb.BatchGetUsersResponse{
+		Status: &pb.Status{
+			Code:    "OK",
+			Message: fmt.Sprintf("Found %d of %d users.", found, len(req.Ids)),
+		},
+		Results: results,
 	}, nil
+}
 
+// Implements GetUser function according to proto definition.
+func (s *Server) Get(ctx context.Context, req *pb.GetUserRequest) (*pb.GetUserResponse, error) {
+	s.logger.Printf("INFO:gRPC|Get called.")
+	user, err := s.user.Get(ctx, req.Id, req.IncludeDeleted)
+	if err != nil {
+		s.logger.Printf("ERROR:gRPC|Could not get user. [%s]", err)
+		return &pb.GetUserResponse{
+			Status: toPbStatus(err, "Could not get user."),
+		}, toStatusError(err)
+	}
+	s.logger.Printf("INFO:gRPC|User found.")
+	return &pb.GetUserResponse{
+		Status: &pb.Status{
+			Code:    "OK",
+			Message: "User found.",
+		},
+		Payload: toPbUser(user),
+	}, nil
 }
 
 // Implements QueryUsers function according to proto definition.
 func (s *Server) Query(ctx context.Context, req *pb.QueryUsersRequest) (*pb.QueryUsersResponse, error) {
 	s.logger.Printf("INFO:gRPC|Query called.")
-	user, err := s.user.Query(ctx, toUserQuery(req))
-
+	query, err := toUserQuery(req)
 	if err != nil {
-		s.logger.Printf("ERROR:gRPC|Query error. [%s]", err)
+		s.logger.Printf("WARNING:gRPC|Invalid query. [%s]", err)
 		return &pb.QueryUsersResponse{
-			Status: &pb.Status{
-				Code:    "INTERNAL",
-				Message: "Could not query user",
-			},
-		}, err
+			Status: toPbStatus(err, "Invalid query."),
+		}, toStatusError(err)
+	}
+	if req.GetPageToken() != "" {
+		cursor, err := s.pageTokens.decode(req.GetPageToken(), query)
+		if err != nil {
+			s.logger.Printf("WARNING:gRPC|Invalid page token. [%s]", err)
+			return &pb.QueryUsersResponse{
+				Status: toPbStatus(err, "Invalid page token."),
+			}, toStatusError(err)
+		}
+		query.After = cursor
 	}
+	user, page, err := s.user.Query(ctx, query)
 
-	if user == nil {
-		s.logger.Printf("WARNING:gRPC|Could not found user.")
+	if err != nil {
+		s.logger.Printf("ERROR:gRPC|Query error. [%s]", err)
 		return &pb.QueryUsersResponse{
-			Status: &pb.Status{
-				Code:    "NOT_FOUND",
-				Message: "Could not found any user.",
-			},
-		}, err
+			Status: toPbStatus(err, "Could not query user"),
+		}, toStatusError(err)
+	}
+	// No match is an empty page, not an error.
+	resp := toPbQueryResponse(user, page)
+	if query.After != nil {
+		// Page numbers are meaningless when paging with tokens.
+		resp.Meta.NextPage = nil
+	}
+	if page.NextCursor != nil {
+		resp.NextPageToken, err = s.pageTokens.encode(page.NextCursor, query)
+		if err != nil {
+			s.logger.Printf("ERROR:gRPC|Could not encode page token. [%s]", err)
+			return &pb.QueryUsersResponse{
+				Status: toPbStatus(err, "Could not query user"),
+			}, toStatusError(err)
+		}
 	}
 	s.logger.Printf("INFO:gRPC|Query done.")
-	return toPbQueryResponse(user, req), nil
+	return resp, nil
+}
+
+// Implements StreamUsers function according to proto definition.
+// Users are sent as they are read. Send blocks while the client is not reading, which holds back reading from storage.
+// The stream ends early when the client cancels or its deadline passes.
+func (s *Server) StreamUsers(req *pb.QueryUsersRequest, stream pb.UserAPI_StreamUsersServer) error {
+	s.logger.Printf("INFO:gRPC|StreamUsers called.")
+	query, err := toUserQuery(req)
+	if err != nil {
+		s.logger.Printf("WARNING:gRPC|Invalid query. [%s]", err)
+		return toStatusError(err)
+	}
+	ctx := stream.Context()
+	var sent int64
+	err = s.user.Stream(ctx, query, func(user *model.User) error {
+		if err := stream.Send(toPbUser(user)); err != nil {
+			return err
+		}
+		sent++
+		return nil
+	})
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		s.logger.Printf("WARNING:gRPC|StreamUsers stopped after [%d] users. [%s]", sent, ctxErr)
+		return toStatusError(ctxErr)
+	}
+	if err != nil {
+		s.logger.Printf("ERROR:gRPC|StreamUsers error after [%d] users. [%s]", sent, err)
+		return toStatusError(err)
+	}
+	s.logger.Printf("INFO:gRPC|Streamed [%d] users.", sent)
+	return nil
 }
 
 // Check if the service is alive or not.
@@ -249,6 +625,66 @@ func (s *Server) HealthCheck(ctx context.Context, req *pb.HealthcheckRequest) (*
 	}, nil
 }
 
+// Reports a change made outside of the RPCs, e.g. by the purger, the way RPCs report theirs.
+func (s *Server) Notify(eventName string, user *model.User) {
+	s.publish(eventName, user)
+}
+
+// Publishes the event of the changed user to watchers and, in the background, to the broker.
+// With an outbox the service stores broker events itself, they are only sent to watchers here.
+func (s *Server) publish(eventName string, user *model.User) {
+	s.publishMove(eventName, user, "")
+}
+
+// Publishes the event like publish, for a change that may have moved the user out of the previous country.
+func (s *Server) publishMove(eventName string, user *model.User, previousCountry string) {
+	s.hub.publish(eventName, toPbUserEventPayload(user), previousCountry)
+	if s.outbox {
+		return
+	}
+	// Taken now, the goroutine may run much later.
+	occurredAt := time.Now()
+	s.publishing.Add(1)
+	go func() {
+		defer s.publishing.Done()
+		event, err := json.Marshal(model.NewUserEvent(uuid.NewString(), eventName, user, occurredAt))
+		if err != nil {
+			s.logger.Printf("ERROR:gRPC|Could not marshal %s. [%s]", eventName, err)
+			return
+		}
+		if err := s.publisher.Publish(model.UserTopic, event); err != nil {
+			s.logger.Printf("ERROR:gRPC|Could not publish %s. [%s]", eventName, err)
+		}
+	}()
+}
+
+// Checks the fields of a create request. Password hashes are only accepted when allowHash is set.
+func checkCreateRequest(req *pb.CreateUserRequest, allowHash bool) error {
+	if !checkIsValidMail(req.Email) {
+		return model.NewInvalidArgumentError("email", "Invalid email.")
+	}
+	if req.PasswordHash == "" {
+		return nil
+	}
+	if !allowHash {
+		return model.NewInvalidArgumentError("password_hash", "Password hash is only accepted by Import.")
+	}
+	if req.Password != "" {
+		return model.NewInvalidArgumentError("password_hash", "Set either password or password hash.")
+	}
+	return nil
+}
+
+// Reports whether the client asked for a dry run with the dry-run metadata.
+func isDryRun(ctx context.Context) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return false
+	}
+	values := md.Get(dryRunMetadata)
+	return len(values) > 0 && strings.EqualFold(values[0], "true")
+}
+
 // Convert protobuf CREATE request structure to User model.
 func createUserRequestToUser(req *pb.CreateUserRequest) *model.User { //TODO:move this wrapping layer from server logic
 	return &model.User{
@@ -268,14 +704,60 @@ func updateUserRequestToUser(req *pb.UpdateUserRequest) *model.User { //TODO:mov
 		FirstName: cases.Title(language.English, cases.Compact).String(req.FirstName),
 		LastName:  cases.Title(language.English, cases.Compact).String(req.LastName),
 		NickName:  req.NickName,
-		Password:  req.Password,
 		Email:     req.Email,
 		Country:   req.Country,
 	}
 }
 
-// Convert protobuf QUERY request structure to User model.
-func toUserQuery(req *pb.QueryUsersRequest) *model.UserQuery {
+// User fields of the update mask paths, which are named after UpdateUserRequest fields.
+// The password is not one of them, it only changes with ChangePassword.
+var updateMaskFields = map[string]string{
+	"first_name": "first_name",
+	"last_name":  "last_name",
+	"nick_name":  "nickname",
+	"email":      "email",
+	"country":    "country",
+}
+
+// Convert update mask to user fields. Empty mask updates every field and is returned as nil.
+func toUpdateFields(mask *fieldmaskpb.FieldMask) ([]string, error) {
+	var fields []string
+	for _, path := range mask.GetPaths() {
+		field, ok := updateMaskFields[path]
+		if !ok {
+			return nil, model.NewInvalidArgumentError("update_mask", fmt.Sprintf("Can not update [%s].", path))
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// Convert optional expected version. Versions start at 1, absent means any version.
+func toExpectedVersion(version *int64) (int64, error) {
+	if version == nil {
+		return 0, nil
+	}
+	if *version < 1 {
+		return 0, model.NewInvalidArgumentError("expected_version", "Expected version must be positive.")
+	}
+	return *version, nil
+}
+
+// Reports whether the update changes the field. Empty fields update everything.
+func updatesField(fields []string, field string) bool {
+	if len(fields) == 0 {
+		return true
+	}
+	for _, f := range fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Convert protobuf QUERY request structure to User model. Paging and ordering fields are validated.
+func toUserQuery(req *pb.QueryUsersRequest) (*model.UserQuery, error) {
 	defaultPage := int64(1)
 	defaultSize := int64(10)
 
@@ -287,31 +769,78 @@ func toUserQuery(req *pb.QueryUsersRequest) *model.UserQuery {
 		req.Size = &defaultSize
 	}
 
+	if *req.Page < 1 {
+		return nil, model.NewInvalidArgumentError("page", "Page must be at least 1.")
+	}
+	if *req.Size < 1 {
+		return nil, model.NewInvalidArgumentError("size", "Size must be at least 1.")
+	}
+
+	orderBy, err := toSortOrders(req.OrderBy)
+	if err != nil {
+		return nil, err
+	}
+
+	var search *string
+	if req.Search != nil {
+		text := strings.TrimSpace(*req.Search)
+		if len(text) > maxSearchLength {
+			return nil, model.NewInvalidArgumentError("search", fmt.Sprintf("Search must be at most %d characters.", maxSearchLength))
+		}
+		if text != "" {
+			search = &text
+		}
+	}
+
 	return &model.UserQuery{
-		ID:        req.Id,
-		FirstName: req.FirstName,
-		LastName:  req.LastName,
-		NickName:  req.NickName,
-		Email:     req.Email,
-		Country:   req.Country,
-		Page:      req.Page,
-		Size:      req.Size,
+		ID:             req.Id,
+		FirstName:      req.FirstName,
+		LastName:       req.LastName,
+		NickName:       req.NickName,
+		Email:          req.Email,
+		Country:        req.Country,
+		Page:           req.Page,
+		Size:           req.Size,
+		Search:         search,
+		OrderBy:        orderBy,
+		IncludeDeleted: req.GetIncludeDeleted(),
+	}, nil
+}
+
+// Convert protobuf ordering to sort orders. Only fields in model.SortFields are allowed, each at most once.
+func toSortOrders(orderBy []*pb.OrderBy) ([]model.SortOrder, error) {
+	orders := make([]model.SortOrder, 0, len(orderBy))
+	seen := make(map[string]bool)
+	for _, o := range orderBy {
+		if !isSortField(o.Field) {
+			return nil, model.NewInvalidArgumentError("order_by", fmt.Sprintf("Can not order by [%s].", o.Field))
+		}
+		if seen[o.Field] {
+			return nil, model.NewInvalidArgumentError("order_by", fmt.Sprintf("Duplicate order by [%s].", o.Field))
+		}
+		seen[o.Field] = true
+		orders = append(orders, model.SortOrder{Field: o.Field, Descending: o.Descending})
 	}
+	if len(orders) == 0 {
+		return nil, nil
+	}
+	return orders, nil
 }
 
-// Convert User model to protobuf QueryUsersResponse.
-func toPbQueryResponse(users []model.User, req *pb.QueryUsersRequest) *pb.QueryUsersResponse {
-	payload := make([]*pb.UserPayload, 0)
-	for _, u := range users {
-		payload = append(payload, &pb.UserPayload{
-			Id:        u.ID,
-			FirstName: u.FirstName,
-			LastName:  u.LastName,
-			NickName:  u.NickName,
-			Password:  u.Password,
-			Email:     u.Email,
-			Country:   u.Country,
-		})
+func isSortField(field string) bool {
+	for _, f := range model.SortFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Convert User model and pagination metadata to protobuf QueryUsersResponse.
+func toPbQueryResponse(users []model.User, page *model.UserPage) *pb.QueryUsersResponse {
+	payload := make([]*pb.User, 0)
+	for i := range users {
+		payload = append(payload, toPbUser(&users[i]))
 	}
 
 	return &pb.QueryUsersResponse{
@@ -321,31 +850,66 @@ func toPbQueryResponse(users []model.User, req *pb.QueryUsersRequest) *pb.QueryU
 		},
 		Payload: payload,
 		Meta: &pb.Meta{
-			Page: *req.Page,
-			Size: *req.Size,
+			Page:       page.Page,
+			Size:       page.Size,
+			NextPage:   page.NextPage,
+			TotalCount: page.TotalCount,
+			TotalPages: page.TotalPages,
 		},
 	}
 }
 
-func toUserUpdatePayload(update *model.User) *pb.UserPayload {
-	return &pb.UserPayload{
-		Id:        update.ID,
-		FirstName: update.FirstName,
-		LastName:  update.LastName,
-		NickName:  update.NickName,
-		Email:     update.Email,
-		Country:   update.Country,
+// Read model of the user for responses, without its password.
+func toPbUser(user *model.User) *pb.User {
+	return &pb.User{
+		Id:        user.ID,
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		NickName:  user.NickName,
+		Email:     user.Email,
+		Country:   user.Country,
+		Version:   user.Version,
+		CreatedAt: toTimestamp(user.CreatedAt),
+		UpdatedAt: toTimestamp(user.UpdatedAt),
+		DeletedAt: toDeletedTimestamp(user.DeletedAt),
+		Status:    user.Status(),
 	}
 }
 
-func checkIsValidMail(email string) bool {
-	_, err := mail.ParseAddress(email)
-	return err == nil
+// User as it is after the change for watch events, without its password.
+func toPbUserEventPayload(user *model.User) *pb.UserEventPayload {
+	return &pb.UserEventPayload{
+		Id:        user.ID,
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		NickName:  user.NickName,
+		Email:     user.Email,
+		Country:   user.Country,
+		Version:   user.Version,
+		CreatedAt: toTimestamp(user.CreatedAt),
+		UpdatedAt: toTimestamp(user.UpdatedAt),
+		DeletedAt: toDeletedTimestamp(user.DeletedAt),
+		Status:    user.Status(),
+	}
+}
+
+// Convert time to protobuf timestamp. Zero time is left unset.
+func toTimestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
 }
 
-func toEventMessage(eventName string, payload any) *model.UserEvent {
-	return &model.UserEvent{
-		EventName: eventName,
-		Payload:   payload,
+// Convert deletion time to protobuf timestamp, unset for active users.
+func toDeletedTimestamp(t *time.Time) *timestamppb.Timestamp {
+	if t == nil {
+		return nil
 	}
+	return toTimestamp(*t)
+}
+
+func checkIsValidMail(email string) bool {
+	_, err := mail.ParseAddress(email)
+	return err == nil
 }
@@ -2,18 +2,32 @@ package grpc
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	pb "github.com/berkantay/user-management-service/grpc/proto"
 	"github.com/berkantay/user-management-service/model"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
 )
 
 const bufSize = 1024 * 1024
@@ -23,11 +37,14 @@ type UserServiceMock struct{}
 var lis *bufconn.Listener
 
 func (s UserServiceMock) Create(ctx context.Context, user *model.User) (*string, error) {
+	if user.Email == "taken@example.com" {
+		return nil, model.NewAlreadyExistsError("user", "email", nil)
+	}
 	// Return a mock user ID.
 	return stringPtr("123"), nil
 }
 
-func (s UserServiceMock) Update(ctx context.Context, user *model.User) (*model.User, error) {
+func (s UserServiceMock) Update(ctx context.Context, user *model.User, fields []string, version int64) (*model.User, error) {
 	// Return the input user as is.
 	if user.ID == "test-id" {
 		return user, nil
@@ -39,14 +56,85 @@ func (s UserServiceMock) Update(ctx context.Context, user *model.User) (*model.U
 	return user, errors.New("mock mismatch id")
 }
 
-func (s UserServiceMock) Delete(ctx context.Context, userId string) (*string, error) {
+func (s UserServiceMock) ChangePassword(ctx context.Context, userId, currentPassword, newPassword string) (*model.User, error) {
+	if currentPassword != "current" {
+		return nil, model.NewPermissionDeniedError("user", userId, "Current password does not match.")
+	}
+	return &model.User{ID: userId, Password: "$2a$14$hash.of.new.password", Version: 2}, nil
+}
+
+func (s UserServiceMock) Delete(ctx context.Context, userId string, version int64) (*model.User, error) {
+	if version > 1 {
+		return nil, model.NewVersionConflictError("user", userId)
+	}
 	// Return the input user ID as is.
 	if userId == "test-id" {
-		return stringPtr("test-id"), nil
+		deletedAt := time.Now()
+		return &model.User{ID: userId, Country: "TR", DeletedAt: &deletedAt, Version: 2}, nil
 	}
 	return nil, errors.New("mock mismatch id")
 }
 
+func (s UserServiceMock) Restore(ctx context.Context, userId string, version int64) (*model.User, error) {
+	if userId != "test-id" {
+		return nil, model.NewNotFoundError("user", userId)
+	}
+	return &model.User{ID: userId, Version: 3}, nil
+}
+
+func (s UserServiceMock) Purge(ctx context.Context, userId string) (*model.User, error) {
+	if userId != "test-id" {
+		return nil, model.NewFailedPreconditionError("user", userId, "User must be deleted before it is purged.")
+	}
+	return &model.User{ID: userId}, nil
+}
+
+func (s UserServiceMock) Get(ctx context.Context, userId string, includeDeleted bool) (*model.User, error) {
+	if userId != "test-id" {
+		return nil, model.NewNotFoundError("user", userId)
+	}
+	return &model.User{ID: userId, FirstName: "John", Email: "john@example.com", Password: "PASSWD123", Version: 2}, nil
+}
+
+func (s UserServiceMock) BatchCreate(ctx context.Context, users []*model.User) ([]model.UserResult, error) {
+	results := make([]model.UserResult, len(users))
+	for i, user := range users {
+		if user.Email == "taken@example.com" {
+			results[i].Err = model.NewAlreadyExistsError("user", "email", nil)
+			continue
+		}
+		user.ID = fmt.Sprintf("id-%d", i)
+		results[i].User = user
+	}
+	return results, nil
+}
+
+func (s UserServiceMock) BatchGet(ctx context.Context, ids []string, includeDeleted bool) ([]model.UserResult, error) {
+	results := make([]model.UserResult, len(ids))
+	for i, id := range ids {
+		results[i].User, results[i].Err = s.Get(ctx, id, includeDeleted)
+	}
+	return results, nil
+}
+
+func (s UserServiceMock) Import(ctx context.Context, users []model.ImportUser, dryRun bool) ([]model.UserResult, error) {
+	results := make([]model.UserResult, len(users))
+	for i, user := range users {
+		switch {
+		case user.User.Email == "taken@example.com":
+			results[i].Err = model.NewAlreadyExistsError("user", "email", nil)
+		case user.PasswordHashed && !strings.HasPrefix(user.User.Password, "$2"):
+			results[i].Err = model.NewInvalidArgumentError("password_hash", "Password hash is not a bcrypt hash.")
+		default:
+			if !dryRun {
+				user.User.ID = "id-" + user.User.Email
+			}
+			results[i].User = user.User
+		}
+	}
+	return results, nil
+}
+
 type EventPublisherMock struct{}
 
 func (e EventPublisherMock) Publish(topic string, payload []byte) error {
@@ -54,7 +142,7 @@ func (e EventPublisherMock) Publish(topic string, payload []byte) error {
 	return nil
 }
 
-func (s UserServiceMock) Query(ctx context.Context, query *model.UserQuery) ([]model.User, error) {
+func (s UserServiceMock) Query(ctx context.Context, query *model.UserQuery) ([]model.User, *model.UserPage, error) {
 	// Return a mock list of users.
 	return []model.User{
 		{
@@ -75,7 +163,17 @@ func (s UserServiceMock) Query(ctx context.Context, query *model.UserQuery) ([]m
 			Email:     "mock@gmail.com",
 			Country:   "UK",
 		},
-	}, nil
+	}, model.NewUserPage(*query.Page, *query.Size, 2), nil
+}
+
+func (s UserServiceMock) Stream(ctx context.Context, query *model.UserQuery, fn func(*model.User) error) error {
+	users, _, _ := s.Query(ctx, query)
+	for i := range users {
+		if err := fn(&users[i]); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func stringPtr(s string) *string {
@@ -96,6 +194,24 @@ func bufDialer(context.Context, string) (net.Conn, error) {
 	return lis.Dial()
 }
 
+// Serves srv over an in-memory connection for the duration of the test.
+func newTestClient(t *testing.T, srv *Server) pb.UserAPIClient {
+	listener := bufconn.Listen(bufSize)
+	s := grpc.NewServer()
+	pb.RegisterUserAPIServer(s, srv)
+	go s.Serve(listener)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return listener.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial bufnet: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewUserAPIClient(conn)
+}
+
 func TestHealthCheck(t *testing.T) {
 	ctx := context.Background()
 	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithContextDialer(bufDialer), grpc.WithTransportCredentials(insecure.NewCredentials()))
@@ -151,6 +267,7 @@ func TestCreateUserInvalidMail(t *testing.T) {
 		Country:   "zimbambwe",
 	})
 
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
 	assert.Equal(t, resp, &pb.CreateUserResponse{
 		Status: &pb.Status{
 			Code:    "INVALID_ARGUMENT",
@@ -199,7 +316,7 @@ func TestDeleteUserInvalidID(t *testing.T) {
 		Id: "123",
 	})
 
-	assert.Nil(t, err)
+	assert.Equal(t, codes.Internal, status.Code(err))
 
 	assert.Equal(t, resp, &pb.DeleteUserResponse{
 		Status: &pb.Status{
@@ -264,6 +381,556 @@ func TestUpdateUserInvalidID(t *testing.T) {
 	})
 }
 
+func TestUpdateUserMask(t *testing.T) {
+	logger := log.New(nil, "User Management Server Log | ", log.LstdFlags)
+	logger.SetOutput(ioutil.Discard)
+	s := NewServer(&UserServiceMock{}, &EventPublisherMock{}, logger)
+
+	// Email is only validated when it is updated.
+	resp, err := s.Update(context.Background(), &pb.UpdateUserRequest{
+		Id:         "test-id",
+		Country:    "US",
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"country"}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "OK", resp.Status.Code)
+
+	resp, err = s.Update(context.Background(), &pb.UpdateUserRequest{
+		Id:         "test-id",
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"created_at"}},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, "INVALID_ARGUMENT", resp.Status.Code)
+}
+
+func TestChangePassword(t *testing.T) {
+	logger := log.New(nil, "User Management Server Log | ", log.LstdFlags)
+	logger.SetOutput(ioutil.Discard)
+	s := NewServer(&UserServiceMock{}, &EventPublisherMock{}, logger)
+
+	resp, err := s.ChangePassword(context.Background(), &pb.ChangePasswordRequest{Id: "test-id", CurrentPassword: "current", NewPassword: "new"})
+	assert.Nil(t, err)
+	assert.Equal(t, "OK", resp.Status.Code)
+	assert.Equal(t, "test-id", resp.UserIdResponse.Id)
+
+	resp, err = s.ChangePassword(context.Background(), &pb.ChangePasswordRequest{Id: "test-id", CurrentPassword: "wrong", NewPassword: "new"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Equal(t, "PERMISSION_DENIED", resp.Status.Code)
+}
+
+func TestExpectedVersion(t *testing.T) {
+	logger := log.New(nil, "User Management Server Log | ", log.LstdFlags)
+	logger.SetOutput(ioutil.Discard)
+	s := NewServer(&UserServiceMock{}, &EventPublisherMock{}, logger)
+
+	one, two, zero := int64(1), int64(2), int64(0)
+	_, err := s.Delete(context.Background(), &pb.DeleteUserRequest{Id: "test-id", ExpectedVersion: &one})
+	assert.Nil(t, err)
+
+	resp, err := s.Delete(context.Background(), &pb.DeleteUserRequest{Id: "test-id", ExpectedVersion: &two})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	assert.Equal(t, "ABORTED", resp.Status.Code)
+
+	_, err = s.Delete(context.Background(), &pb.DeleteUserRequest{Id: "test-id", ExpectedVersion: &zero})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = s.Update(context.Background(), &pb.UpdateUserRequest{Id: "test-id", Email: "john@example.com", ExpectedVersion: &zero})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestToPbUser(t *testing.T) {
+	created := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	payload := toPbUser(&model.User{ID: "1", Version: 3, CreatedAt: created, UpdatedAt: created.Add(time.Hour)})
+
+	assert.Equal(t, int64(3), payload.Version)
+	assert.Equal(t, created, payload.CreatedAt.AsTime())
+	assert.Equal(t, created.Add(time.Hour), payload.UpdatedAt.AsTime())
+	assert.Nil(t, toPbUser(&model.User{ID: "1"}).CreatedAt)
+}
+
+func TestRestoreAndPurge(t *testing.T) {
+	logger := log.New(nil, "User Management Server Log | ", log.LstdFlags)
+	logger.SetOutput(ioutil.Discard)
+	s := NewServer(&UserServiceMock{}, &EventPublisherMock{}, logger)
+
+	restore, err := s.Restore(context.Background(), &pb.RestoreUserRequest{Id: "test-id"})
+	assert.Nil(t, err)
+	assert.Equal(t, "active", restore.Payload.Status)
+	assert.Equal(t, int64(3), restore.Payload.Version)
+
+	_, err = s.Restore(context.Background(), &pb.RestoreUserRequest{Id: "other"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	purge, err := s.Purge(context.Background(), &pb.PurgeUserRequest{Id: "test-id"})
+	assert.Nil(t, err)
+	assert.Equal(t, "test-id", purge.UserIdResponse.Id)
+
+	_, err = s.Purge(context.Background(), &pb.PurgeUserRequest{Id: "active"})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestToUpdateFields(t *testing.T) {
+	fields, err := toUpdateFields(&fieldmaskpb.FieldMask{Paths: []string{"nick_name", "email"}})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"nickname", "email"}, fields)
+
+	fields, err = toUpdateFields(nil)
+	assert.Nil(t, err)
+	assert.Nil(t, fields)
+
+	_, err = toUpdateFields(&fieldmaskpb.FieldMask{Paths: []string{"nickname"}})
+	assert.True(t, errors.Is(err, model.ErrInvalidArgument))
+
+	_, err = toUpdateFields(&fieldmaskpb.FieldMask{Paths: []string{"password"}})
+	assert.True(t, errors.Is(err, model.ErrInvalidArgument))
+	badRequest, ok := status.Convert(toStatusError(err)).Details()[0].(*errdetails.BadRequest)
+	assert.True(t, ok)
+	assert.Equal(t, "update_mask", badRequest.FieldViolations[0].Field)
+}
+
+func TestGetUser(t *testing.T) {
+	s := NewServer(UserServiceMock{}, EventPublisherMock{}, log.New(ioutil.Discard, "", 0))
+	ctx := context.Background()
+
+	resp, err := s.Get(ctx, &pb.GetUserRequest{Id: "test-id"})
+	assert.Nil(t, err)
+	assert.Equal(t, "OK", resp.Status.Code)
+	assert.Equal(t, "test-id", resp.Payload.Id)
+	assert.Equal(t, int64(2), resp.Payload.Version)
+
+	resp, err = s.Get(ctx, &pb.GetUserRequest{Id: "missing"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	assert.Nil(t, resp.Payload)
+}
+
+func TestBatchCreate(t *testing.T) {
+	publisher := &recordingPublisher{events: make(chan []byte, 3)}
+	s := NewServer(UserServiceMock{}, publisher, log.New(ioutil.Discard, "", 0))
+	ctx := context.Background()
+
+	resp, err := s.BatchCreate(ctx, &pb.BatchCreateUsersRequest{Users: []*pb.CreateUserRequest{
+		{FirstName: "john", Email: "john@example.com", Password: "secret"},
+		{FirstName: "jane", Email: "not-an-email", Password: "secret"},
+		{FirstName: "joe", Email: "taken@example.com", Password: "secret"},
+		{FirstName: "jack", Email: "jack@example.com", Password: "secret"},
+	}})
+	assert.Nil(t, err)
+	assert.Equal(t, "Created 2 of 4 users.", resp.Status.Message)
+	assert.Len(t, resp.Results, 4)
+	assert.Equal(t, "OK", resp.Results[0].Status.Code)
+	assert.Equal(t, "id-0", resp.Results[0].Payload.Id)
+	assert.Equal(t, "INVALID_ARGUMENT", resp.Results[1].Status.Code)
+	assert.Nil(t, resp.Results[1].Payload)
+	assert.Equal(t, "ALREADY_EXISTS", resp.Results[2].Status.Code)
+	assert.Equal(t, "OK", resp.Results[3].Status.Code)
+	assert.Equal(t, "id-2", resp.Results[3].Payload.Id)
+
+	assert.ElementsMatch(t, []string{"id-0", "id-2"}, publishedIds(t, publisher, model.EventUserCreated, 2))
+
+	_, err = s.BatchCreate(ctx, &pb.BatchCreateUsersRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = s.BatchCreate(ctx, &pb.BatchCreateUsersRequest{Users: make([]*pb.CreateUserRequest, model.MaxBatchSize+1)})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestImport(t *testing.T) {
+	publisher := &recordingPublisher{events: make(chan []byte, 10)}
+	client := newTestClient(t, NewServer(UserServiceMock{}, publisher, log.New(ioutil.Discard, "", 0)))
+	rows := []*pb.CreateUserRequest{
+		{FirstName: "john", Email: "john@example.com", Password: "secret"},
+		{FirstName: "jane", Email: "not-an-email", Password: "secret"},
+		{FirstName: "joe", Email: "taken@example.com", Password: "secret"},
+		{FirstName: "jack", Email: "jack@example.com", PasswordHash: "$2a$10$legacy.hash"},
+		{FirstName: "jill", Email: "jill@example.com", PasswordHash: "plain"},
+		{FirstName: "jim", Email: "jim@example.com", Password: "secret", PasswordHash: "$2a$10$legacy.hash"},
+	}
+	send := func(ctx context.Context) *pb.ImportSummary {
+		stream, err := client.Import(ctx)
+		assert.Nil(t, err)
+		for _, row := range rows {
+			assert.Nil(t, stream.Send(row))
+		}
+		summary, err := stream.CloseAndRecv()
+		assert.Nil(t, err)
+		return summary
+	}
+
+	summary := send(context.Background())
+	assert.Equal(t, "OK", summary.Status.Code)
+	assert.False(t, summary.DryRun)
+	assert.Equal(t, int64(6), summary.Received)
+	assert.Equal(t, int64(2), summary.Imported)
+	assert.Equal(t, int64(4), summary.Failed)
+	failed := map[int64]string{}
+	for _, failure := range summary.Failures {
+		failed[failure.Row] = failure.Status.Code
+	}
+	assert.Equal(t, map[int64]string{1: "INVALID_ARGUMENT", 2: "ALREADY_EXISTS", 4: "INVALID_ARGUMENT", 5: "INVALID_ARGUMENT"}, failed)
+	assert.ElementsMatch(t, []string{"id-john@example.com", "id-jack@example.com"}, publishedIds(t, publisher, model.EventUserCreated, 2))
+
+	summary = send(metadata.AppendToOutgoingContext(context.Background(), dryRunMetadata, "true"))
+	assert.True(t, summary.DryRun)
+	assert.Equal(t, int64(2), summary.Imported)
+	assert.Equal(t, int64(4), summary.Failed)
+	select {
+	case <-publisher.events:
+		t.Fatal("dry run published an event")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestImportBatches(t *testing.T) {
+	service := &importRecordingService{}
+	client := newTestClient(t, NewServer(service, EventPublisherMock{}, log.New(ioutil.Discard, "", 0)))
+
+	stream, err := client.Import(context.Background())
+	assert.Nil(t, err)
+	for i := 0; i < importBatchSize+1; i++ {
+		assert.Nil(t, stream.Send(&pb.CreateUserRequest{Email: fmt.Sprintf("user%d@example.com", i), Password: "secret"}))
+	}
+	summary, err := stream.CloseAndRecv()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(importBatchSize+1), summary.Imported)
+	assert.Equal(t, []int{importBatchSize, 1}, service.batches)
+}
+
+// Records the size of every imported batch.
+type importRecordingService struct {
+	UserServiceMock
+	batches []int
+}
+
+func (s *importRecordingService) Import(ctx context.Context, users []model.ImportUser, dryRun bool) ([]model.UserResult, error) {
+	s.batches = append(s.batches, len(users))
+	return s.UserServiceMock.Import(ctx, users, dryRun)
+}
+
+func TestCheckCreateRequest(t *testing.T) {
+	req := &pb.CreateUserRequest{Email: "john@example.com", PasswordHash: "$2a$10$legacy.hash"}
+	assert.True(t, errors.Is(checkCreateRequest(req, false), model.ErrInvalidArgument))
+	assert.Nil(t, checkCreateRequest(req, true))
+
+	resp, err := NewServer(UserServiceMock{}, EventPublisherMock{}, log.New(ioutil.Discard, "", 0)).Create(context.Background(), req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, "INVALID_ARGUMENT", resp.Status.Code)
+}
+
+func TestStreamUsers(t *testing.T) {
+	client := newTestClient(t, NewServer(UserServiceMock{}, EventPublisherMock{}, log.New(ioutil.Discard, "", 0)))
+
+	stream, err := client.StreamUsers(context.Background(), &pb.QueryUsersRequest{})
+	assert.Nil(t, err)
+	var ids []string
+	for {
+		user, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		assert.NotContains(t, prototext.Format(user), "PASSWD123")
+		ids = append(ids, user.Id)
+	}
+	assert.Equal(t, []string{"123", "4321"}, ids)
+
+	stream, err = client.StreamUsers(context.Background(), &pb.QueryUsersRequest{Page: new(int64)})
+	assert.Nil(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestStreamUsersDeadline(t *testing.T) {
+	service := &endlessUserService{}
+	client := newTestClient(t, NewServer(service, EventPublisherMock{}, log.New(ioutil.Discard, "", 0)))
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	stream, err := client.StreamUsers(ctx, &pb.QueryUsersRequest{})
+	assert.Nil(t, err)
+	// The service streams forever, only the deadline ends the call.
+	_, err = stream.Recv()
+	assert.Nil(t, err)
+	for err == nil {
+		_, err = stream.Recv()
+	}
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	assert.Eventually(t, func() bool { return service.stopped.Load() }, time.Second, 10*time.Millisecond)
+}
+
+// Streams users until fn fails.
+type endlessUserService struct {
+	UserServiceMock
+	stopped atomic.Bool
+}
+
+func (s *endlessUserService) Stream(ctx context.Context, query *model.UserQuery, fn func(*model.User) error) error {
+	defer s.stopped.Store(true)
+	for i := 0; ; i++ {
+		if err := fn(&model.User{ID: fmt.Sprint(i), FirstName: strings.Repeat("x", 1024)}); err != nil {
+			return err
+		}
+	}
+}
+
+// Waits until the hub has count watchers, so events published afterwards reach them.
+func waitForWatchers(t *testing.T, hub *eventHub, count int) {
+	assert.Eventually(t, func() bool {
+		hub.mu.Lock()
+		defer hub.mu.Unlock()
+		return len(hub.watchers) == count
+	}, time.Second, time.Millisecond)
+}
+
+func TestWatch(t *testing.T) {
+	srv := NewServer(UserServiceMock{}, EventPublisherMock{}, log.New(ioutil.Discard, "", 0))
+	client := newTestClient(t, srv)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.Watch(ctx, &pb.WatchRequest{Country: "TR"})
+	assert.Nil(t, err)
+	waitForWatchers(t, srv.hub, 1)
+
+	srv.hub.publish(model.EventUserUpdated, &pb.UserEventPayload{Id: "1", Country: "UK"}, "")
+	_, err = srv.Delete(ctx, &pb.DeleteUserRequest{Id: "test-id"})
+	assert.Nil(t, err)
+
+	event, err := stream.Recv()
+	assert.Nil(t, err)
+	assert.Equal(t, model.EventUserDeleted, event.Type)
+	assert.Equal(t, "test-id", event.Payload.Id)
+	assert.Equal(t, "deleted", event.Payload.Status)
+	assert.NotEmpty(t, event.ResumeToken)
+	assert.NotNil(t, event.OccurredAt)
+
+	cancel()
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Canceled, status.Code(err))
+	waitForWatchers(t, srv.hub, 0)
+}
+
+// Service of a user living in Turkey.
+type turkishUserService struct {
+	UserServiceMock
+}
+
+func (s turkishUserService) Get(ctx context.Context, userId string, includeDeleted bool) (*model.User, error) {
+	return &model.User{ID: userId, Country: "TR", Version: 1}, nil
+}
+
+func TestWatchCountryMatchesPreviousCountry(t *testing.T) {
+	srv := NewServer(turkishUserService{}, EventPublisherMock{}, log.New(ioutil.Discard, "", 0))
+	client := newTestClient(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	left, err := client.Watch(ctx, &pb.WatchRequest{Country: "TR"})
+	assert.Nil(t, err)
+	joined, err := client.Watch(ctx, &pb.WatchRequest{Country: "UK"})
+	assert.Nil(t, err)
+	waitForWatchers(t, srv.hub, 2)
+
+	_, err = srv.Update(ctx, &pb.UpdateUserRequest{Id: "test-id", Country: "UK", UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"country"}}})
+	assert.Nil(t, err)
+
+	// Both the country the user left and the one it moved to see the move.
+	for _, stream := range []pb.UserAPI_WatchClient{left, joined} {
+		event, err := stream.Recv()
+		assert.Nil(t, err)
+		assert.Equal(t, model.EventUserUpdated, event.Type)
+		assert.Equal(t, "UK", event.Payload.Country)
+	}
+}
+
+func TestWatchWithOutbox(t *testing.T) {
+	publisher := &recordingPublisher{events: make(chan []byte, 1)}
+	srv := NewServer(UserServiceMock{}, publisher, log.New(ioutil.Discard, "", 0), WithOutbox())
+	client := newTestClient(t, srv)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.Watch(ctx, &pb.WatchRequest{})
+	assert.Nil(t, err)
+	waitForWatchers(t, srv.hub, 1)
+	_, err = srv.Delete(ctx, &pb.DeleteUserRequest{Id: "test-id"})
+	assert.Nil(t, err)
+
+	event, err := stream.Recv()
+	assert.Nil(t, err)
+	assert.Equal(t, "test-id", event.Payload.Id)
+	// The service stores the broker event in the outbox.
+	select {
+	case <-publisher.events:
+		t.Fatal("server published to the broker")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// Publishes once released.
+type blockingPublisher struct {
+	release   chan struct{}
+	published atomic.Int64
+}
+
+func (p *blockingPublisher) Publish(topic string, payload []byte) error {
+	<-p.release
+	p.published.Add(1)
+	return nil
+}
+
+func TestServeStopsGracefully(t *testing.T) {
+	publisher := &blockingPublisher{release: make(chan struct{})}
+	srv := NewServer(UserServiceMock{}, publisher, log.New(ioutil.Discard, "", 0))
+	listener := bufconn.Listen(bufSize)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(ctx, listener)
+	}()
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return listener.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.Nil(t, err)
+	defer conn.Close()
+	client := pb.NewUserAPIClient(conn)
+	stream, err := client.Watch(context.Background(), &pb.WatchRequest{})
+	assert.Nil(t, err)
+	waitForWatchers(t, srv.hub, 1)
+	_, err = client.Delete(context.Background(), &pb.DeleteUserRequest{Id: "test-id"})
+	assert.Nil(t, err)
+	_, err = stream.Recv()
+	assert.Nil(t, err)
+
+	cancel()
+	// Watchers are ended so the server can stop.
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	select {
+	case <-served:
+		t.Fatal("server stopped before the event reached the broker")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(publisher.release)
+	select {
+	case err := <-served:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("server did not stop")
+	}
+	assert.Equal(t, int64(1), publisher.published.Load())
+}
+
+func TestNotify(t *testing.T) {
+	publisher := &recordingPublisher{events: make(chan []byte, 1)}
+	srv := NewServer(UserServiceMock{}, publisher, log.New(ioutil.Discard, "", 0))
+	client := newTestClient(t, srv)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.Watch(ctx, &pb.WatchRequest{})
+	assert.Nil(t, err)
+	waitForWatchers(t, srv.hub, 1)
+	srv.Notify(model.EventUserPurged, &model.User{ID: "purged-id"})
+
+	event, err := stream.Recv()
+	assert.Nil(t, err)
+	assert.Equal(t, model.EventUserPurged, event.Type)
+	assert.Equal(t, "purged-id", event.Payload.Id)
+	assert.Equal(t, []string{"purged-id"}, publishedIds(t, publisher, model.EventUserPurged, 1))
+}
+
+func TestWatchResume(t *testing.T) {
+	srv := NewServer(UserServiceMock{}, EventPublisherMock{}, log.New(ioutil.Discard, "", 0), WithWatchHistory(3))
+	client := newTestClient(t, srv)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.Watch(ctx, &pb.WatchRequest{UserId: "1"})
+	assert.Nil(t, err)
+	waitForWatchers(t, srv.hub, 1)
+	srv.hub.publish(model.EventUserCreated, &pb.UserEventPayload{Id: "1"}, "")
+	first, err := stream.Recv()
+	assert.Nil(t, err)
+	cancel()
+	waitForWatchers(t, srv.hub, 0)
+
+	// Missed while disconnected.
+	srv.hub.publish(model.EventUserUpdated, &pb.UserEventPayload{Id: "2"}, "")
+	srv.hub.publish(model.EventUserUpdated, &pb.UserEventPayload{Id: "1", FirstName: "John"}, "")
+	srv.hub.publish(model.EventUserDeleted, &pb.UserEventPayload{Id: "1"}, "")
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	stream, err = client.Watch(ctx, &pb.WatchRequest{UserId: "1", ResumeToken: first.ResumeToken})
+	assert.Nil(t, err)
+	var types []string
+	for i := 0; i < 2; i++ {
+		event, err := stream.Recv()
+		assert.Nil(t, err)
+		assert.Equal(t, "1", event.Payload.Id)
+		types = append(types, event.Type)
+	}
+	assert.Equal(t, []string{model.EventUserUpdated, model.EventUserDeleted}, types)
+
+	// The first event is no longer kept.
+	srv.hub.publish(model.EventUserUpdated, &pb.UserEventPayload{Id: "3"}, "")
+	stream, err = client.Watch(context.Background(), &pb.WatchRequest{ResumeToken: first.ResumeToken})
+	assert.Nil(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+
+	other := newEventHub(3)
+	other.publish(model.EventUserCreated, &pb.UserEventPayload{Id: "1"}, "")
+	stream, err = client.Watch(context.Background(), &pb.WatchRequest{ResumeToken: other.token(other.history[0])})
+	assert.Nil(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+
+	stream, err = client.Watch(context.Background(), &pb.WatchRequest{ResumeToken: "not-a-token"})
+	assert.Nil(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestWatchWithoutHistory(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		srv := NewServer(UserServiceMock{}, EventPublisherMock{}, log.New(ioutil.Discard, "", 0), WithWatchHistory(size))
+		srv.hub.publish(model.EventUserCreated, &pb.UserEventPayload{Id: "1"}, "")
+		srv.hub.publish(model.EventUserUpdated, &pb.UserEventPayload{Id: "1"}, "")
+		assert.Empty(t, srv.hub.history)
+	}
+}
+
+func TestEventHubDropsSlowWatcher(t *testing.T) {
+	hub := newEventHub(10)
+	slow, _, err := hub.subscribe("")
+	assert.Nil(t, err)
+
+	for i := 0; i <= watcherBuffer; i++ {
+		hub.publish(model.EventUserUpdated, &pb.UserEventPayload{Id: fmt.Sprint(i)}, "")
+	}
+	received := 0
+	for range slow.events {
+		received++
+	}
+	assert.Equal(t, watcherBuffer, received)
+	assert.Len(t, hub.history, 10)
+	assert.Equal(t, uint64(watcherBuffer-8), hub.history[0].seq)
+	hub.unsubscribe(slow)
+}
+
+func TestBatchGet(t *testing.T) {
+	s := NewServer(UserServiceMock{}, EventPublisherMock{}, log.New(ioutil.Discard, "", 0))
+
+	resp, err := s.BatchGet(context.Background(), &pb.BatchGetUsersRequest{Ids: []string{"test-id", "missing"}})
+	assert.Nil(t, err)
+	assert.Equal(t, "Found 1 of 2 users.", resp.Status.Message)
+	assert.Equal(t, "OK", resp.Results[0].Status.Code)
+	assert.Equal(t, "test-id", resp.Results[0].Payload.Id)
+	assert.Equal(t, "NOT_FOUND", resp.Results[1].Status.Code)
+	assert.Nil(t, resp.Results[1].Payload)
+}
+
 func TestCreateUserRequestToUser(t *testing.T) {
 	req := &pb.CreateUserRequest{
 		FirstName: "John",
@@ -311,8 +978,9 @@ func TestToUserQuery(t *testing.T) {
 		Size:      new(int64),
 	}
 
-	userQuery := toUserQuery(req)
+	userQuery, err := toUserQuery(req)
 
+	assert.Nil(t, err)
 	assert.Equal(t, expectedUserQuery.FirstName, userQuery.FirstName)
 	assert.Equal(t, expectedUserQuery.LastName, userQuery.LastName)
 	assert.Equal(t, expectedUserQuery.NickName, userQuery.NickName)
@@ -321,3 +989,259 @@ func TestToUserQuery(t *testing.T) {
 	assert.Equal(t, int64(1), *userQuery.Page)
 	assert.Equal(t, int64(10), *userQuery.Size)
 }
+
+func TestQueryUsersMeta(t *testing.T) {
+	mockUserService := &UserServiceMock{}
+	mockEventPublisher := &EventPublisherMock{}
+
+	logger := log.New(nil, "User Management Server Log | ", log.LstdFlags)
+	logger.SetOutput(ioutil.Discard)
+	s := NewServer(mockUserService, mockEventPublisher, logger)
+
+	size := int64(1)
+	resp, err := s.Query(context.Background(), &pb.QueryUsersRequest{Size: &size})
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), resp.Meta.Page)
+	assert.Equal(t, int64(2), resp.Meta.TotalCount)
+	assert.Equal(t, int64(2), resp.Meta.TotalPages)
+	assert.Equal(t, int64(2), resp.Meta.GetNextPage())
+}
+
+// Finds no user.
+type EmptyUserServiceMock struct {
+	UserServiceMock
+}
+
+func (s EmptyUserServiceMock) Query(ctx context.Context, query *model.UserQuery) ([]model.User, *model.UserPage, error) {
+	return nil, model.NewUserPage(*query.Page, *query.Size, 0), nil
+}
+
+func TestQueryUsersEmpty(t *testing.T) {
+	mockEventPublisher := &EventPublisherMock{}
+
+	logger := log.New(nil, "User Management Server Log | ", log.LstdFlags)
+	logger.SetOutput(ioutil.Discard)
+	s := NewServer(EmptyUserServiceMock{}, mockEventPublisher, logger)
+
+	resp, err := s.Query(context.Background(), &pb.QueryUsersRequest{Country: stringPtr("NL")})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "OK", resp.Status.Code)
+	assert.Empty(t, resp.Payload)
+	assert.Equal(t, int64(0), resp.Meta.TotalCount)
+	assert.Nil(t, resp.Meta.NextPage)
+	assert.Empty(t, resp.NextPageToken)
+}
+
+func TestQueryUsersInvalidPageToken(t *testing.T) {
+	mockUserService := &UserServiceMock{}
+	mockEventPublisher := &EventPublisherMock{}
+
+	logger := log.New(nil, "User Management Server Log | ", log.LstdFlags)
+	logger.SetOutput(ioutil.Discard)
+	s := NewServer(mockUserService, mockEventPublisher, logger)
+
+	resp, err := s.Query(context.Background(), &pb.QueryUsersRequest{PageToken: stringPtr("forged")})
+
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, "INVALID_ARGUMENT", resp.Status.Code)
+}
+
+func TestToUserQueryOrderBy(t *testing.T) {
+	userQuery, err := toUserQuery(&pb.QueryUsersRequest{
+		OrderBy: []*pb.OrderBy{
+			{Field: "last_name"},
+			{Field: "created_at", Descending: true},
+		},
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []model.SortOrder{
+		{Field: "last_name"},
+		{Field: "created_at", Descending: true},
+	}, userQuery.OrderBy)
+}
+
+func TestToUserQueryInvalid(t *testing.T) {
+	zero := int64(0)
+	tests := []struct {
+		name string
+		req  *pb.QueryUsersRequest
+	}{
+		{"unknown field", &pb.QueryUsersRequest{OrderBy: []*pb.OrderBy{{Field: "password"}}}},
+		{"duplicate field", &pb.QueryUsersRequest{OrderBy: []*pb.OrderBy{{Field: "email"}, {Field: "email", Descending: true}}}},
+		{"zero page", &pb.QueryUsersRequest{Page: &zero}},
+		{"zero size", &pb.QueryUsersRequest{Size: &zero}},
+		{"long search", &pb.QueryUsersRequest{Search: stringPtr(strings.Repeat("a", maxSearchLength+1))}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := toUserQuery(test.req)
+			assert.True(t, errors.Is(err, model.ErrInvalidArgument))
+		})
+	}
+}
+
+func TestToUserQuerySearch(t *testing.T) {
+	userQuery, err := toUserQuery(&pb.QueryUsersRequest{Search: stringPtr("  Güneş ")})
+	assert.Nil(t, err)
+	assert.Equal(t, stringPtr("Güneş"), userQuery.Search)
+
+	userQuery, err = toUserQuery(&pb.QueryUsersRequest{Search: stringPtr("   ")})
+	assert.Nil(t, err)
+	assert.Nil(t, userQuery.Search)
+}
+
+func TestCreateUserDuplicateEmail(t *testing.T) {
+	mockUserService := &UserServiceMock{}
+	mockEventPublisher := &EventPublisherMock{}
+
+	logger := log.New(nil, "User Management Server Log | ", log.LstdFlags)
+	logger.SetOutput(ioutil.Discard)
+	s := NewServer(mockUserService, mockEventPublisher, logger)
+
+	resp, err := s.Create(context.Background(), &pb.CreateUserRequest{
+		FirstName: "John",
+		Email:     "taken@example.com",
+	})
+
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+	assert.Equal(t, "ALREADY_EXISTS", resp.Status.Code)
+	badRequest, ok := status.Convert(err).Details()[0].(*errdetails.BadRequest)
+	assert.True(t, ok)
+	assert.Equal(t, "email", badRequest.FieldViolations[0].Field)
+}
+
+// Records published events.
+type recordingPublisher struct {
+	events chan []byte
+}
+
+func (p *recordingPublisher) Publish(topic string, payload []byte) error {
+	p.events <- payload
+	return nil
+}
+
+// Waits for count events with the given name and returns their user ids. Events may arrive in any order.
+func publishedIds(t *testing.T, publisher *recordingPublisher, eventName string, count int) []string {
+	var ids []string
+	for i := 0; i < count; i++ {
+		select {
+		case event := <-publisher.events:
+			var message model.UserEvent
+			assert.Nil(t, json.Unmarshal(event, &message))
+			assert.Equal(t, model.EventTypePrefix+eventName, message.Type)
+			assert.Equal(t, message.Subject, message.Data.ID)
+			ids = append(ids, message.Subject)
+		case <-time.After(time.Second):
+			t.Fatal("event was not published")
+		}
+	}
+	return ids
+}
+
+// Service returning users with their stored password hash, as repositories do.
+type storedHashUserService struct {
+	UserServiceMock
+}
+
+const storedHash = "$2a$14$stored.hash.of.the.password"
+
+func (s storedHashUserService) Update(ctx context.Context, user *model.User, fields []string, version int64) (*model.User, error) {
+	user.Password = storedHash
+	return user, nil
+}
+
+func (s storedHashUserService) Get(ctx context.Context, userId string, includeDeleted bool) (*model.User, error) {
+	return &model.User{ID: userId, FirstName: "John", Email: "john@example.com", Password: storedHash}, nil
+}
+
+func (s storedHashUserService) BatchGet(ctx context.Context, ids []string, includeDeleted bool) ([]model.UserResult, error) {
+	user, _ := s.Get(ctx, ids[0], includeDeleted)
+	return []model.UserResult{{User: user}}, nil
+}
+
+func (s storedHashUserService) Query(ctx context.Context, query *model.UserQuery) ([]model.User, *model.UserPage, error) {
+	return []model.User{{ID: "123", FirstName: "John", Email: "john@example.com", Password: storedHash}}, model.NewUserPage(1, 10, 1), nil
+}
+
+// Fails if a message returned by any RPC has a field for passwords.
+func assertNoPasswordField(t *testing.T, message protoreflect.MessageDescriptor, seen map[protoreflect.FullName]bool) {
+	if seen[message.FullName()] {
+		return
+	}
+	seen[message.FullName()] = true
+	fields := message.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		assert.NotContains(t, strings.ToLower(string(field.Name())), "password", "%s exposes a password", message.FullName())
+		if field.Message() != nil {
+			assertNoPasswordField(t, field.Message(), seen)
+		}
+	}
+}
+
+func TestResponsesAndEventsCarryNoPassword(t *testing.T) {
+	methods := pb.File_user_proto.Services().ByName("UserAPI").Methods()
+	seen := make(map[protoreflect.FullName]bool)
+	for i := 0; i < methods.Len(); i++ {
+		assertNoPasswordField(t, methods.Get(i).Output(), seen)
+	}
+
+	logger := log.New(nil, "User Management Server Log | ", log.LstdFlags)
+	logger.SetOutput(ioutil.Discard)
+	publisher := &recordingPublisher{events: make(chan []byte, 10)}
+	s := NewServer(storedHashUserService{}, publisher, logger)
+	ctx := context.Background()
+	secrets := []string{"plain-secret", storedHash}
+
+	var responses []proto.Message
+	var events int
+	create, err := s.Create(ctx, &pb.CreateUserRequest{FirstName: "John", Email: "john@example.com", Password: "plain-secret"})
+	assert.Nil(t, err)
+	responses, events = append(responses, create), events+1
+	update, err := s.Update(ctx, &pb.UpdateUserRequest{Id: "test-id", Email: "john@example.com", Password: "plain-secret"})
+	assert.Nil(t, err)
+	responses, events = append(responses, update), events+1
+	change, err := s.ChangePassword(ctx, &pb.ChangePasswordRequest{Id: "test-id", CurrentPassword: "current", NewPassword: "plain-secret"})
+	assert.Nil(t, err)
+	responses, events = append(responses, change), events+1
+	del, err := s.Delete(ctx, &pb.DeleteUserRequest{Id: "test-id"})
+	assert.Nil(t, err)
+	responses, events = append(responses, del), events+1
+	restore, err := s.Restore(ctx, &pb.RestoreUserRequest{Id: "test-id"})
+	assert.Nil(t, err)
+	responses, events = append(responses, restore), events+1
+	purge, err := s.Purge(ctx, &pb.PurgeUserRequest{Id: "test-id"})
+	assert.Nil(t, err)
+	responses, events = append(responses, purge), events+1
+	get, err := s.Get(ctx, &pb.GetUserRequest{Id: "test-id"})
+	assert.Nil(t, err)
+	responses = append(responses, get)
+	batchGet, err := s.BatchGet(ctx, &pb.BatchGetUsersRequest{Ids: []string{"test-id"}})
+	assert.Nil(t, err)
+	responses = append(responses, batchGet)
+	query, err := s.Query(ctx, &pb.QueryUsersRequest{})
+	assert.Nil(t, err)
+	responses = append(responses, query)
+
+	for _, resp := range responses {
+		text := prototext.Format(resp)
+		for _, secret := range secrets {
+			assert.NotContains(t, text, secret)
+		}
+	}
+	for i := 0; i < events; i++ {
+		select {
+		case event := <-publisher.events:
+			for _, secret := range secrets {
+				assert.NotContains(t, string(event), secret)
+			}
+			assert.NotContains(t, strings.ToLower(string(event)), "password\":")
+		case <-time.After(time.Second):
+			t.Fatal("event was not published")
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package grpc
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/berkantay/user-management-service/model"
+)
+
+// Page tokens carry the keyset cursor and a fingerprint of the filter and order they were issued for.
+// They are signed with HMAC-SHA256 so clients can not forge or alter them.
+type pageTokenCodec struct {
+	key []byte
+}
+
+type pageToken struct {
+	Values []string `json:"v"`
+	Filter string   `json:"f"`
+}
+
+// Create codec signing with the given key. A random key is generated if key is empty.
+func newPageTokenCodec(key []byte) *pageTokenCodec {
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(err)
+		}
+	}
+	return &pageTokenCodec{key: key}
+}
+
+// Encode cursor into a token bound to the query filter.
+func (c *pageTokenCodec) encode(cursor *model.Cursor, query *model.UserQuery) (string, error) {
+	values := make([]string, len(cursor.Values))
+	for i, v := range cursor.Values {
+		switch v := v.(type) {
+		case time.Time:
+			values[i] = v.UTC().Format(time.RFC3339Nano)
+		case string:
+			values[i] = v
+		}
+	}
+	payload, err := json.Marshal(pageToken{
+		Values: values,
+		Filter: filterFingerprint(query),
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(c.sign(payload)), nil
+}
+
+// Decode token into cursor. Fails if the token was altered or issued for another filter.
+func (c *pageTokenCodec) decode(token string, query *model.UserQuery) (*model.Cursor, error) {
+	invalid := model.NewInvalidArgumentError("page_token", "Invalid page token.")
+
+	encodedPayload, encodedSignature, found := strings.Cut(token, ".")
+	if !found {
+		return nil, invalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, invalid
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil || !hmac.Equal(signature, c.sign(payload)) {
+		return nil, invalid
+	}
+
+	decoded := pageToken{}
+	if err := json.Unmarshal(payload, &decoded); err != nil {
+		return nil, invalid
+	}
+	if decoded.Filter != filterFingerprint(query) {
+		return nil, model.NewInvalidArgumentError("page_token", "Page token does not match the query.")
+	}
+
+	order := query.Order()
+	if len(decoded.Values) != len(order) {
+		return nil, invalid
+	}
+	cursor := &model.Cursor{Values: make([]any, len(order))}
+	for i, o := range order {
+		cursor.Values[i] = decoded.Values[i]
+		if model.IsTimeField(o.Field) {
+			t, err := time.Parse(time.RFC3339Nano, decoded.Values[i])
+			if err != nil {
+				return nil, invalid
+			}
+			cursor.Values[i] = t
+		}
+	}
+	return cursor, nil
+}
+
+func (c *pageTokenCodec) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// Hash of the filtering and ordering fields of the query. Paging fields are left out.
+func filterFingerprint(query *model.UserQuery) string {
+	filter, _ := json.Marshal(model.UserQuery{
+		ID:             query.ID,
+		FirstName:      query.FirstName,
+		LastName:       query.LastName,
+		NickName:       query.NickName,
+		Email:          query.Email,
+		Country:        query.Country,
+		Search:         query.Search,
+		OrderBy:        query.OrderBy,
+		IncludeDeleted: query.IncludeDeleted,
+	})
+	sum := sha256.Sum256(filter)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
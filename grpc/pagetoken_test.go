@@ -0,0 +1,73 @@
+package grpc
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/berkantay/user-management-service/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPageTokenRoundTrip(t *testing.T) {
+	codec := newPageTokenCodec([]byte("secret"))
+	query := &model.UserQuery{Country: stringPtr("UK")}
+	cursor := &model.Cursor{Values: []any{time.Unix(0, 1679467105123456789).UTC(), "123"}}
+
+	token, err := codec.encode(cursor, query)
+	assert.Nil(t, err)
+
+	decoded, err := codec.decode(token, &model.UserQuery{Country: stringPtr("UK")})
+	assert.Nil(t, err)
+	assert.Equal(t, cursor, decoded)
+}
+
+func TestPageTokenRejectsOtherFilter(t *testing.T) {
+	codec := newPageTokenCodec([]byte("secret"))
+	cursor := &model.Cursor{Values: []any{time.Now(), "123"}}
+
+	token, err := codec.encode(cursor, &model.UserQuery{Country: stringPtr("UK")})
+	assert.Nil(t, err)
+
+	_, err = codec.decode(token, &model.UserQuery{Country: stringPtr("TR")})
+	assert.True(t, errors.Is(err, model.ErrInvalidArgument))
+}
+
+func TestPageTokenRejectsTampering(t *testing.T) {
+	codec := newPageTokenCodec([]byte("secret"))
+	query := &model.UserQuery{}
+	cursor := &model.Cursor{Values: []any{time.Now(), "123"}}
+
+	token, err := codec.encode(cursor, query)
+	assert.Nil(t, err)
+
+	tests := []string{
+		"",
+		"garbage",
+		"x" + token,
+		token + "x",
+	}
+	for _, test := range tests {
+		_, err := codec.decode(test, query)
+		assert.True(t, errors.Is(err, model.ErrInvalidArgument), test)
+	}
+
+	_, err = newPageTokenCodec([]byte("other")).decode(token, query)
+	assert.True(t, errors.Is(err, model.ErrInvalidArgument))
+}
+
+func TestPageTokenWithOrder(t *testing.T) {
+	codec := newPageTokenCodec([]byte("secret"))
+	query := &model.UserQuery{OrderBy: []model.SortOrder{{Field: "last_name"}, {Field: "updated_at", Descending: true}}}
+	cursor := &model.Cursor{Values: []any{"Doe", time.Unix(1679467105, 0).UTC(), "123"}}
+
+	token, err := codec.encode(cursor, query)
+	assert.Nil(t, err)
+
+	decoded, err := codec.decode(token, query)
+	assert.Nil(t, err)
+	assert.Equal(t, cursor, decoded)
+
+	_, err = codec.decode(token, &model.UserQuery{OrderBy: []model.SortOrder{{Field: "last_name", Descending: true}}})
+	assert.True(t, errors.Is(err, model.ErrInvalidArgument))
+}
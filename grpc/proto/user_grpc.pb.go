@@ -28,9 +28,28 @@ type UserAPIClient interface {
 	Delete(ctx context.Context, in *DeleteUserRequest, opts ...grpc.CallOption) (*DeleteUserResponse, error)
 	// Update user on database
 	Update(ctx context.Context, in *UpdateUserRequest, opts ...grpc.CallOption) (*UpdateUserResponse, error)
-	// Query user from database
+	// Restore a deleted user
+	Restore(ctx context.Context, in *RestoreUserRequest, opts ...grpc.CallOption) (*RestoreUserResponse, error)
+	// Permanently remove a deleted user
+	Purge(ctx context.Context, in *PurgeUserRequest, opts ...grpc.CallOption) (*PurgeUserResponse, error)
+	// Change password of the user after verifying the current one
+	ChangePassword(ctx context.Context, in *ChangePasswordRequest, opts ...grpc.CallOption) (*ChangePasswordResponse, error)
+	// Create many users at once, each with its own result
+	BatchCreate(ctx context.Context, in *BatchCreateUsersRequest, opts ...grpc.CallOption) (*BatchCreateUsersResponse, error)
+	// Import users streamed by the client, stored in batches as they arrive.
+	// Send metadata dry-run: true to only validate the rows.
+	Import(ctx context.Context, opts ...grpc.CallOption) (UserAPI_ImportClient, error)
+	// Get a single user by id
+	Get(ctx context.Context, in *GetUserRequest, opts ...grpc.CallOption) (*GetUserResponse, error)
+	// Get many users by id, each with its own result
+	BatchGet(ctx context.Context, in *BatchGetUsersRequest, opts ...grpc.CallOption) (*BatchGetUsersResponse, error)
+	//Query user from database
 	Query(ctx context.Context, in *QueryUsersRequest, opts ...grpc.CallOption) (*QueryUsersResponse, error)
-	// Health check of service
+	// Stream every user matching the query. Page, size and page token are ignored.
+	StreamUsers(ctx context.Context, in *QueryUsersRequest, opts ...grpc.CallOption) (UserAPI_StreamUsersClient, error)
+	// Stream changes of users as they happen. Send the last resume token to continue after a reconnect.
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (UserAPI_WatchClient, error)
+	//Health check of service
 	HealthCheck(ctx context.Context, in *HealthcheckRequest, opts ...grpc.CallOption) (*HealthcheckResponse, error)
 }
 
@@ -69,6 +88,94 @@ func (c *userAPIClient) Update(ctx context.Context, in *UpdateUserRequest, opts
 	return out, nil
 }
 
+func (c *userAPIClient) Restore(ctx context.Context, in *RestoreUserRequest, opts ...grpc.CallOption) (*RestoreUserResponse, error) {
+	out := new(RestoreUserResponse)
+	err := c.cc.Invoke(ctx, "/main.UserAPI/Restore", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *userAPIClient) Purge(ctx context.Context, in *PurgeUserRequest, opts ...grpc.CallOption) (*PurgeUserResponse, error) {
+	out := new(PurgeUserResponse)
+	err := c.cc.Invoke(ctx, "/main.UserAPI/Purge", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *userAPIClient) ChangePassword(ctx context.Context, in *ChangePasswordRequest, opts ...grpc.CallOption) (*ChangePasswordResponse, error) {
+	out := new(ChangePasswordResponse)
+	err := c.cc.Invoke(ctx, "/main.UserAPI/ChangePassword", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *userAPIClient) BatchCreate(ctx context.Context, in *BatchCreateUsersRequest, opts ...grpc.CallOption) (*BatchCreateUsersResponse, error) {
+	out := new(BatchCreateUsersResponse)
+	err := c.cc.Invoke(ctx, "/main.UserAPI/BatchCreate", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *userAPIClient) Import(ctx context.Context, opts ...grpc.CallOption) (UserAPI_ImportClient, error) {
+	stream, err := c.cc.NewStream(ctx, &UserAPI_ServiceDesc.Streams[0], "/main.UserAPI/Import", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &userAPIImportClient{stream}
+	return x, nil
+}
+
+type UserAPI_ImportClient interface {
+	Send(*CreateUserRequest) error
+	CloseAndRecv() (*ImportSummary, error)
+	grpc.ClientStream
+}
+
+type userAPIImportClient struct {
+	grpc.ClientStream
+}
+
+func (x *userAPIImportClient) Send(m *CreateUserRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *userAPIImportClient) CloseAndRecv() (*ImportSummary, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(ImportSummary)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *userAPIClient) Get(ctx context.Context, in *GetUserRequest, opts ...grpc.CallOption) (*GetUserResponse, error) {
+	out := new(GetUserResponse)
+	err := c.cc.Invoke(ctx, "/main.UserAPI/Get", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *userAPIClient) BatchGet(ctx context.Context, in *BatchGetUsersRequest, opts ...grpc.CallOption) (*BatchGetUsersResponse, error) {
+	out := new(BatchGetUsersResponse)
+	err := c.cc.Invoke(ctx, "/main.UserAPI/BatchGet", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *userAPIClient) Query(ctx context.Context, in *QueryUsersRequest, opts ...grpc.CallOption) (*QueryUsersResponse, error) {
 	out := new(QueryUsersResponse)
 	err := c.cc.Invoke(ctx, "/main.UserAPI/Query", in, out, opts...)
@@ -78,6 +185,70 @@ func (c *userAPIClient) Query(ctx context.Context, in *QueryUsersRequest, opts .
 	return out, nil
 }
 
+func (c *userAPIClient) StreamUsers(ctx context.Context, in *QueryUsersRequest, opts ...grpc.CallOption) (UserAPI_StreamUsersClient, error) {
+	stream, err := c.cc.NewStream(ctx, &UserAPI_ServiceDesc.Streams[1], "/main.UserAPI/StreamUsers", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &userAPIStreamUsersClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type UserAPI_StreamUsersClient interface {
+	Recv() (*User, error)
+	grpc.ClientStream
+}
+
+type userAPIStreamUsersClient struct {
+	grpc.ClientStream
+}
+
+func (x *userAPIStreamUsersClient) Recv() (*User, error) {
+	m := new(User)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *userAPIClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (UserAPI_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &UserAPI_ServiceDesc.Streams[2], "/main.UserAPI/Watch", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &userAPIWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type UserAPI_WatchClient interface {
+	Recv() (*UserChangeEvent, error)
+	grpc.ClientStream
+}
+
+type userAPIWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *userAPIWatchClient) Recv() (*UserChangeEvent, error) {
+	m := new(UserChangeEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 func (c *userAPIClient) HealthCheck(ctx context.Context, in *HealthcheckRequest, opts ...grpc.CallOption) (*HealthcheckResponse, error) {
 	out := new(HealthcheckResponse)
 	err := c.cc.Invoke(ctx, "/main.UserAPI/HealthCheck", in, out, opts...)
@@ -97,9 +268,28 @@ type UserAPIServer interface {
 	Delete(context.Context, *DeleteUserRequest) (*DeleteUserResponse, error)
 	// Update user on database
 	Update(context.Context, *UpdateUserRequest) (*UpdateUserResponse, error)
-	// Query user from database
+	// Restore a deleted user
+	Restore(context.Context, *RestoreUserRequest) (*RestoreUserResponse, error)
+	// Permanently remove a deleted user
+	Purge(context.Context, *PurgeUserRequest) (*PurgeUserResponse, error)
+	// Change password of the user after verifying the current one
+	ChangePassword(context.Context, *ChangePasswordRequest) (*ChangePasswordResponse, error)
+	// Create many users at once, each with its own result
+	BatchCreate(context.Context, *BatchCreateUsersRequest) (*BatchCreateUsersResponse, error)
+	// Import users streamed by the client, stored in batches as they arrive.
+	// Send metadata dry-run: true to only validate the rows.
+	Import(UserAPI_ImportServer) error
+	// Get a single user by id
+	Get(context.Context, *GetUserRequest) (*GetUserResponse, error)
+	// Get many users by id, each with its own result
+	BatchGet(context.Context, *BatchGetUsersRequest) (*BatchGetUsersResponse, error)
+	//Query user from database
 	Query(context.Context, *QueryUsersRequest) (*QueryUsersResponse, error)
-	// Health check of service
+	// Stream every user matching the query. Page, size and page token are ignored.
+	StreamUsers(*QueryUsersRequest, UserAPI_StreamUsersServer) error
+	// Stream changes of users as they happen. Send the last resume token to continue after a reconnect.
+	Watch(*WatchRequest, UserAPI_WatchServer) error
+	//Health check of service
 	HealthCheck(context.Context, *HealthcheckRequest) (*HealthcheckResponse, error)
 	mustEmbedUnimplementedUserAPIServer()
 }
@@ -117,9 +307,36 @@ func (UnimplementedUserAPIServer) Delete(context.Context, *DeleteUserRequest) (*
 func (UnimplementedUserAPIServer) Update(context.Context, *UpdateUserRequest) (*UpdateUserResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Update not implemented")
 }
+func (UnimplementedUserAPIServer) Restore(context.Context, *RestoreUserRequest) (*RestoreUserResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Restore not implemented")
+}
+func (UnimplementedUserAPIServer) Purge(context.Context, *PurgeUserRequest) (*PurgeUserResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Purge not implemented")
+}
+func (UnimplementedUserAPIServer) ChangePassword(context.Context, *ChangePasswordRequest) (*ChangePasswordResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ChangePassword not implemented")
+}
+func (UnimplementedUserAPIServer) BatchCreate(context.Context, *BatchCreateUsersRequest) (*BatchCreateUsersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchCreate not implemented")
+}
+func (UnimplementedUserAPIServer) Import(UserAPI_ImportServer) error {
+	return status.Errorf(codes.Unimplemented, "method Import not implemented")
+}
+func (UnimplementedUserAPIServer) Get(context.Context, *GetUserRequest) (*GetUserResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedUserAPIServer) BatchGet(context.Context, *BatchGetUsersRequest) (*BatchGetUsersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchGet not implemented")
+}
 func (UnimplementedUserAPIServer) Query(context.Context, *QueryUsersRequest) (*QueryUsersResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Query not implemented")
 }
+func (UnimplementedUserAPIServer) StreamUsers(*QueryUsersRequest, UserAPI_StreamUsersServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamUsers not implemented")
+}
+func (UnimplementedUserAPIServer) Watch(*WatchRequest, UserAPI_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
 func (UnimplementedUserAPIServer) HealthCheck(context.Context, *HealthcheckRequest) (*HealthcheckResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method HealthCheck not implemented")
 }
@@ -190,6 +407,140 @@ func _UserAPI_Update_Handler(srv interface{}, ctx context.Context, dec func(inte
 	return interceptor(ctx, in, info, handler)
 }
 
+func _UserAPI_Restore_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RestoreUserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserAPIServer).Restore(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/main.UserAPI/Restore",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserAPIServer).Restore(ctx, req.(*RestoreUserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UserAPI_Purge_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PurgeUserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserAPIServer).Purge(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/main.UserAPI/Purge",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserAPIServer).Purge(ctx, req.(*PurgeUserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UserAPI_ChangePassword_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ChangePasswordRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserAPIServer).ChangePassword(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/main.UserAPI/ChangePassword",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserAPIServer).ChangePassword(ctx, req.(*ChangePasswordRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UserAPI_BatchCreate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchCreateUsersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserAPIServer).BatchCreate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/main.UserAPI/BatchCreate",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserAPIServer).BatchCreate(ctx, req.(*BatchCreateUsersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UserAPI_Import_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(UserAPIServer).Import(&userAPIImportServer{stream})
+}
+
+type UserAPI_ImportServer interface {
+	SendAndClose(*ImportSummary) error
+	Recv() (*CreateUserRequest, error)
+	grpc.ServerStream
+}
+
+type userAPIImportServer struct {
+	grpc.ServerStream
+}
+
+func (x *userAPIImportServer) SendAndClose(m *ImportSummary) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *userAPIImportServer) Recv() (*CreateUserRequest, error) {
+	m := new(CreateUserRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _UserAPI_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetUserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserAPIServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/main.UserAPI/Get",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserAPIServer).Get(ctx, req.(*GetUserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UserAPI_BatchGet_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchGetUsersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserAPIServer).BatchGet(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/main.UserAPI/BatchGet",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserAPIServer).BatchGet(ctx, req.(*BatchGetUsersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _UserAPI_Query_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(QueryUsersRequest)
 	if err := dec(in); err != nil {
@@ -208,6 +559,48 @@ func _UserAPI_Query_Handler(srv interface{}, ctx context.Context, dec func(inter
 	return interceptor(ctx, in, info, handler)
 }
 
+func _UserAPI_StreamUsers_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(QueryUsersRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(UserAPIServer).StreamUsers(m, &userAPIStreamUsersServer{stream})
+}
+
+type UserAPI_StreamUsersServer interface {
+	Send(*User) error
+	grpc.ServerStream
+}
+
+type userAPIStreamUsersServer struct {
+	grpc.ServerStream
+}
+
+func (x *userAPIStreamUsersServer) Send(m *User) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _UserAPI_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(UserAPIServer).Watch(m, &userAPIWatchServer{stream})
+}
+
+type UserAPI_WatchServer interface {
+	Send(*UserChangeEvent) error
+	grpc.ServerStream
+}
+
+type userAPIWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *userAPIWatchServer) Send(m *UserChangeEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 func _UserAPI_HealthCheck_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(HealthcheckRequest)
 	if err := dec(in); err != nil {
@@ -245,6 +638,30 @@ var UserAPI_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Update",
 			Handler:    _UserAPI_Update_Handler,
 		},
+		{
+			MethodName: "Restore",
+			Handler:    _UserAPI_Restore_Handler,
+		},
+		{
+			MethodName: "Purge",
+			Handler:    _UserAPI_Purge_Handler,
+		},
+		{
+			MethodName: "ChangePassword",
+			Handler:    _UserAPI_ChangePassword_Handler,
+		},
+		{
+			MethodName: "BatchCreate",
+			Handler:    _UserAPI_BatchCreate_Handler,
+		},
+		{
+			MethodName: "Get",
+			Handler:    _UserAPI_Get_Handler,
+		},
+		{
+			MethodName: "BatchGet",
+			Handler:    _UserAPI_BatchGet_Handler,
+		},
 		{
 			MethodName: "Query",
 			Handler:    _UserAPI_Query_Handler,
@@ -254,6 +671,22 @@ var UserAPI_ServiceDesc = grpc.ServiceDesc{
 			Handler:    _UserAPI_HealthCheck_Handler,
 		},
 	},
-	Streams:  []grpc.StreamDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Import",
+			Handler:       _UserAPI_Import_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "StreamUsers",
+			Handler:       _UserAPI_StreamUsers_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Watch",
+			Handler:       _UserAPI_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
 	Metadata: "user.proto",
 }
@@ -0,0 +1,227 @@
+package grpc
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/berkantay/user-management-service/grpc/proto"
+	"github.com/berkantay/user-management-service/model"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	defaultWatchHistory = 1024 // Events kept for watchers resuming after a reconnect.
+	watcherBuffer       = 256  // Events a watcher may fall behind before it is dropped.
+)
+
+// Event hub fans out user change events to watchers and keeps the latest ones for resuming.
+// Events are numbered in publish order. Publishing never blocks, watchers that fall behind are dropped.
+type eventHub struct {
+	mu       sync.Mutex
+	epoch    string // Identifies the hub in resume tokens, tokens of another hub are rejected.
+	next     uint64 // Sequence of the next event.
+	history  []*hubEvent
+	size     int
+	watchers map[*watcher]struct{}
+	done     chan struct{} // Closed when the server shuts down.
+}
+
+type hubEvent struct {
+	seq             uint64
+	eventName       string
+	payload         *pb.UserEventPayload
+	previousCountry string // Country the user had before the change, empty when unknown or unchanged.
+	occurredAt      time.Time
+}
+
+// Subscription of a single Watch call. Events is closed when the watcher fell behind.
+type watcher struct {
+	events chan *hubEvent
+}
+
+// Create hub keeping the latest size events.
+func newEventHub(size int) *eventHub {
+	epoch := make([]byte, 8)
+	if _, err := rand.Read(epoch); err != nil {
+		panic(err)
+	}
+	return &eventHub{
+		epoch:    hex.EncodeToString(epoch),
+		next:     1,
+		size:     size,
+		watchers: make(map[*watcher]struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Ends every Watch call, watchers reconnect to another server or after the restart.
+func (h *eventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	select {
+	case <-h.done:
+	default:
+		close(h.done)
+	}
+}
+
+// Record the event and pass it to every watcher. The previous country is the one the user moved from, if any.
+func (h *eventHub) publish(eventName string, payload *pb.UserEventPayload, previousCountry string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	event := &hubEvent{seq: h.next, eventName: eventName, payload: payload, previousCountry: previousCountry, occurredAt: time.Now()}
+	h.next++
+	if h.size > 0 {
+		if len(h.history) == h.size {
+			h.history = h.history[1:]
+		}
+		h.history = append(h.history, event)
+	}
+
+	for w := range h.watchers {
+		select {
+		case w.events <- event:
+		default:
+			delete(h.watchers, w)
+			close(w.events)
+		}
+	}
+}
+
+// Register a watcher. With a resume token the events after it are returned, they are not sent to the watcher.
+func (h *eventHub) subscribe(resumeToken string) (*watcher, []*hubEvent, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var backlog []*hubEvent
+	if resumeToken != "" {
+		after, err := h.parseToken(resumeToken)
+		if err != nil {
+			return nil, nil, err
+		}
+		oldest := h.next
+		if len(h.history) > 0 {
+			oldest = h.history[0].seq
+		}
+		if after+1 < oldest {
+			return nil, nil, status.Error(codes.OutOfRange, "Resume token expired, events after it are no longer kept.")
+		}
+		for _, event := range h.history {
+			if event.seq > after {
+				backlog = append(backlog, event)
+			}
+		}
+	}
+	w := &watcher{events: make(chan *hubEvent, watcherBuffer)}
+	h.watchers[w] = struct{}{}
+	return w, backlog, nil
+}
+
+// Remove the watcher if it is still registered.
+func (h *eventHub) unsubscribe(w *watcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.watchers[w]; ok {
+		delete(h.watchers, w)
+		close(w.events)
+	}
+}
+
+func (h *eventHub) token(event *hubEvent) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%d", h.epoch, event.seq)))
+}
+
+// Sequence of the event the token was issued for. Tokens of another hub, e.g. before a restart, are expired.
+func (h *eventHub) parseToken(token string) (uint64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, model.NewInvalidArgumentError("resume_token", "Invalid resume token.")
+	}
+	epoch, seq, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return 0, model.NewInvalidArgumentError("resume_token", "Invalid resume token.")
+	}
+	after, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return 0, model.NewInvalidArgumentError("resume_token", "Invalid resume token.")
+	}
+	if epoch != h.epoch {
+		return 0, status.Error(codes.OutOfRange, "Resume token was issued by another server instance.")
+	}
+	if after >= h.next {
+		return 0, model.NewInvalidArgumentError("resume_token", "Invalid resume token.")
+	}
+	return after, nil
+}
+
+// Implements Watch function according to proto definition.
+// Streams changes of users as they are published, after the resume token if one is given.
+func (s *Server) Watch(req *pb.WatchRequest, stream pb.UserAPI_WatchServer) error {
+	s.logger.Printf("INFO:gRPC|Watch called.")
+	w, backlog, err := s.hub.subscribe(req.ResumeToken)
+	if err != nil {
+		s.logger.Printf("WARNING:gRPC|Could not watch. [%s]", err)
+		return toStatusError(err)
+	}
+	defer s.hub.unsubscribe(w)
+
+	send := func(event *hubEvent) error {
+		if !watchMatches(req, event) {
+			return nil
+		}
+		return stream.Send(&pb.UserChangeEvent{
+			ResumeToken: s.hub.token(event),
+			Type:        event.eventName,
+			Payload:     event.payload,
+			OccurredAt:  timestamppb.New(event.occurredAt),
+		})
+	}
+	for _, event := range backlog {
+		if err := send(event); err != nil {
+			s.logger.Printf("WARNING:gRPC|Watch stopped. [%s]", err)
+			return err
+		}
+	}
+	ctx := stream.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			s.logger.Printf("INFO:gRPC|Watch ended. [%s]", ctx.Err())
+			return toStatusError(ctx.Err())
+		case <-s.hub.done:
+			s.logger.Printf("INFO:gRPC|Watch ended by shutdown.")
+			return status.Error(codes.Unavailable, "Server is shutting down, watch again.")
+		case event, ok := <-w.events:
+			if !ok {
+				s.logger.Printf("WARNING:gRPC|Watcher fell behind.")
+				return status.Error(codes.ResourceExhausted, "Watcher fell behind, resume with the last resume token.")
+			}
+			if err := send(event); err != nil {
+				s.logger.Printf("WARNING:gRPC|Watch stopped. [%s]", err)
+				return err
+			}
+		}
+	}
+}
+
+// Reports whether the user of the event passes the filters of the request. Empty filters match every user.
+// The country filter matches the country before or after the change, so watchers also see users leaving it.
+func watchMatches(req *pb.WatchRequest, event *hubEvent) bool {
+	if req.UserId != "" && event.payload.Id != req.UserId {
+		return false
+	}
+	if req.Country != "" && event.payload.Country != req.Country && event.previousCountry != req.Country {
+		return false
+	}
+	return true
+}
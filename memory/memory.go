@@ -0,0 +1,394 @@
+package memory
+
+import (
+	"context"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/berkantay/user-management-service/model"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+)
+
+// Storage keeps users in process memory. It is meant for local development and tests.
+type Storage struct {
+	mu     sync.RWMutex
+	users  map[string]model.User
+	logger *log.Logger
+}
+
+// Configure storage by changing logger.
+type StorageOption func(*Storage)
+
+func WithLogger(logger *log.Logger) StorageOption {
+	return func(s *Storage) {
+		s.logger = logger
+	}
+}
+
+// Create new empty in-memory storage.
+func NewStorage(opts ...StorageOption) *Storage {
+	s := &Storage{
+		users:  make(map[string]model.User),
+		logger: log.New(io.Discard, "", 0),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// In-memory storage is always alive.
+func (s *Storage) HealthCheck(ctx context.Context) error {
+	s.logger.Printf("INFO:Memory|Storage alive..")
+	return nil
+}
+
+// Create user in storage with given type.
+func (s *Storage) CreateUser(ctx context.Context, user *model.User) (*string, error) {
+	s.logger.Printf("INFO:Memory|Creating user.")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[user.ID]; ok {
+		s.logger.Printf("ERROR:Memory|Could not create user. [%s] already exists", user.ID)
+		return nil, model.NewAlreadyExistsError("user", "id", nil)
+	}
+	if field := s.duplicateField(user); field != "" {
+		s.logger.Printf("ERROR:Memory|Could not create user. Duplicate [%s]", field)
+		return nil, model.NewAlreadyExistsError("user", field, nil)
+	}
+	stored := *user
+	stored.NormalizedEmail = model.NormalizeEmail(user.Email)
+	stored.Version = 1
+	s.users[user.ID] = stored
+
+	insertionId := user.ID
+	s.logger.Printf("INFO:Memory|Creation successful.[%s]", insertionId)
+	return &insertionId, nil
+}
+
+// Create users in storage one by one. Returns one error per user, nil for created users.
+func (s *Storage) CreateUsers(ctx context.Context, users []*model.User) ([]error, error) {
+	errs := make([]error, len(users))
+	for i, user := range users {
+		_, errs[i] = s.CreateUser(ctx, user)
+	}
+	return errs, nil
+}
+
+// Get users with any of the ids, including soft deleted users. Unknown ids are left out.
+func (s *Storage) GetUsers(ctx context.Context, ids []string) ([]model.User, error) {
+	s.logger.Printf("INFO:Memory|Getting [%d] users.", len(ids))
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var users []model.User
+	for _, id := range ids {
+		if stored, ok := s.users[id]; ok {
+			users = append(users, stored)
+		}
+	}
+	return users, nil
+}
+
+// Get user with corresponding id, including soft deleted users.
+func (s *Storage) GetUser(ctx context.Context, id string) (*model.User, error) {
+	s.logger.Printf("INFO:Memory|Getting user with id:[%s]", id)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored, ok := s.users[id]
+	if !ok {
+		s.logger.Printf("ERROR:Memory|Could not get [%s] error is: [not found]", id)
+		return nil, model.NewNotFoundError("user", id)
+	}
+	return &stored, nil
+}
+
+// Update the given fields of the user in storage and return the stored user. Updates only one item.
+func (s *Storage) UpdateUser(ctx context.Context, user *model.User, fields []string) (*model.User, error) {
+	s.logger.Printf("INFO:Memory|Updating user")
+	fields, err := model.UpdateMask(fields)
+	if err != nil {
+		s.logger.Printf("ERROR:Memory|Update error is  [%s]", err)
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.users[user.ID]
+	if !ok || stored.DeletedAt != nil {
+		s.logger.Printf("ERROR:Memory|Update error is  [%s] not found", user.ID)
+		return nil, model.NewNotFoundError("user", user.ID)
+	}
+	if user.Version != 0 && user.Version != stored.Version {
+		s.logger.Printf("ERROR:Memory|Update error is  version mismatch [%s]", user.ID)
+		return nil, model.NewVersionConflictError("user", user.ID)
+	}
+	stored.Apply(user, fields)
+	if field := s.duplicateField(&stored); field != "" {
+		s.logger.Printf("ERROR:Memory|Update error is  duplicate [%s]", field)
+		return nil, model.NewAlreadyExistsError("user", field, nil)
+	}
+	stored.UpdatedAt = time.Now()
+	stored.Version++
+	s.users[user.ID] = stored
+
+	s.logger.Printf("INFO:Memory|Update successful user. [%s]", user.ID)
+	return &stored, nil
+}
+
+// Soft delete user in storage with corresponding id and return it. A non-zero version must match the stored one.
+func (s *Storage) DeleteUser(ctx context.Context, id string, version int64) (*model.User, error) {
+	s.logger.Printf("INFO:Memory|Deleting user with id:[%s]", id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.users[id]
+	if !ok || stored.DeletedAt != nil {
+		s.logger.Printf("ERROR:Memory|Could not delete [%s] error is: [not found]", id)
+		return nil, model.NewNotFoundError("user", id)
+	}
+	if version != 0 && version != stored.Version {
+		s.logger.Printf("ERROR:Memory|Could not delete [%s] error is: [version mismatch]", id)
+		return nil, model.NewVersionConflictError("user", id)
+	}
+	now := time.Now()
+	stored.DeletedAt = &now
+	stored.UpdatedAt = now
+	stored.Version++
+	s.users[id] = stored
+
+	s.logger.Printf("INFO:Memory|Delete successful.")
+	return &stored, nil
+}
+
+// Restore soft deleted user and return it. A non-zero version must match the stored one.
+func (s *Storage) RestoreUser(ctx context.Context, id string, version int64) (*model.User, error) {
+	s.logger.Printf("INFO:Memory|Restoring user with id:[%s]", id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.users[id]
+	if !ok {
+		s.logger.Printf("ERROR:Memory|Could not restore [%s] error is: [not found]", id)
+		return nil, model.NewNotFoundError("user", id)
+	}
+	if stored.DeletedAt == nil {
+		s.logger.Printf("ERROR:Memory|Could not restore [%s] error is: [not deleted]", id)
+		return nil, model.NewFailedPreconditionError("user", id, "User is not deleted.")
+	}
+	if version != 0 && version != stored.Version {
+		s.logger.Printf("ERROR:Memory|Could not restore [%s] error is: [version mismatch]", id)
+		return nil, model.NewVersionConflictError("user", id)
+	}
+	stored.DeletedAt = nil
+	stored.UpdatedAt = time.Now()
+	stored.Version++
+	s.users[id] = stored
+
+	s.logger.Printf("INFO:Memory|Restore successful.")
+	return &stored, nil
+}
+
+// Permanently remove soft deleted user with corresponding id and return it.
+func (s *Storage) PurgeUser(ctx context.Context, id string) (*model.User, error) {
+	s.logger.Printf("INFO:Memory|Purging user with id:[%s]", id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.users[id]
+	if !ok {
+		s.logger.Printf("ERROR:Memory|Could not purge [%s] error is: [not found]", id)
+		return nil, model.NewNotFoundError("user", id)
+	}
+	if stored.DeletedAt == nil {
+		s.logger.Printf("ERROR:Memory|Could not purge [%s] error is: [not deleted]", id)
+		return nil, model.NewFailedPreconditionError("user", id, "User must be deleted before it is purged.")
+	}
+	delete(s.users, id)
+
+	s.logger.Printf("INFO:Memory|Purge successful.")
+	return &stored, nil
+}
+
+// Users deleted before the given time, the earliest deleted first, at most limit.
+func (s *Storage) DeletedUsers(ctx context.Context, before time.Time, limit int64) ([]model.User, error) {
+	s.logger.Printf("INFO:Memory|Getting users deleted before [%s]", before)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var users []model.User
+	for _, u := range s.users {
+		if u.DeletedAt != nil && u.DeletedAt.Before(before) {
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if !users[i].DeletedAt.Equal(*users[j].DeletedAt) {
+			return users[i].DeletedAt.Before(*users[j].DeletedAt)
+		}
+		return users[i].ID < users[j].ID
+	})
+	if int64(len(users)) > limit {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+// Query users with a filter. Returns the requested page, nil when nothing matches, and its pagination metadata.
+func (s *Storage) QueryUsers(ctx context.Context, filter *model.UserQuery) ([]model.User, *model.UserPage, error) {
+	s.logger.Printf("INFO:Memory|Querying user with given filter")
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	limit := *filter.Size
+	skip := *filter.Page*limit - limit
+	if filter.After != nil {
+		skip = 0
+	}
+
+	var matched []model.User
+	for _, u := range s.users {
+		if matches(&u, filter) {
+			matched = append(matched, u)
+		}
+	}
+	order := filter.Order()
+	sort.Slice(matched, func(i, j int) bool {
+		return compare(model.CursorOf(&matched[i], order), model.CursorOf(&matched[j], order), order) < 0
+	})
+
+	var result []model.User
+	for _, u := range matched {
+		if filter.After != nil && compare(model.CursorOf(&u, order), filter.After, order) <= 0 {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		if int64(len(result)) > limit {
+			break
+		}
+		result = append(result, u)
+	}
+
+	page := model.NewUserPage(*filter.Page, *filter.Size, int64(len(matched)))
+	result, page.NextCursor = model.TrimPage(result, limit, order)
+	s.logger.Printf("INFO:Memory|Query result")
+	return result, page, nil
+}
+
+// Calls fn for every user matching the filter in query order. Paging fields of the filter are ignored.
+// Matches are copied first so fn runs without holding the lock. Stops at the first error of fn or when the context is done.
+func (s *Storage) StreamUsers(ctx context.Context, filter *model.UserQuery, fn func(*model.User) error) error {
+	s.logger.Printf("INFO:Memory|Streaming users with given filter")
+	s.mu.RLock()
+	var matched []model.User
+	for _, u := range s.users {
+		if matches(&u, filter) {
+			matched = append(matched, u)
+		}
+	}
+	s.mu.RUnlock()
+
+	order := filter.Order()
+	sort.Slice(matched, func(i, j int) bool {
+		return compare(model.CursorOf(&matched[i], order), model.CursorOf(&matched[j], order), order) < 0
+	})
+	for i := range matched {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(&matched[i]); err != nil {
+			return err
+		}
+	}
+	s.logger.Printf("INFO:Memory|Streamed [%d] users", len(matched))
+	return nil
+}
+
+// Storage has nothing to release.
+func (s *Storage) GracefullShutdown(ctx context.Context) error {
+	s.logger.Printf("INFO:Memory|Closed.")
+	return nil
+}
+
+// Reports whether user satisfies the filter.
+func matches(user *model.User, filter *model.UserQuery) bool {
+	if !filter.IncludeDeleted && user.DeletedAt != nil {
+		return false
+	}
+	if filter.ID != nil && user.ID != *filter.ID {
+		return false
+	}
+	if filter.FirstName != nil && user.FirstName != cases.Title(language.English, cases.Compact).String(*filter.FirstName) {
+		return false
+	}
+	if filter.LastName != nil && user.LastName != cases.Title(language.English, cases.Compact).String(*filter.LastName) {
+		return false
+	}
+	if filter.NickName != nil && user.NickName != *filter.NickName {
+		return false
+	}
+	if filter.Email != nil && user.NormalizedEmail != model.NormalizeEmail(*filter.Email) {
+		return false
+	}
+	if filter.Country != nil && user.Country != *filter.Country {
+		return false
+	}
+	if filter.Search != nil && !containsSearch(user, *filter.Search) {
+		return false
+	}
+	return true
+}
+
+// Compares two positions in the given order. Returns -1, 0 or 1.
+func compare(a, b *model.Cursor, order []model.SortOrder) int {
+	for i, o := range order {
+		c := model.CompareSortValues(a.Values[i], b.Values[i])
+		if o.Descending {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// Reports whether any searchable field of the user contains the text, ignoring case and diacritics.
+func containsSearch(user *model.User, text string) bool {
+	folded := model.FoldText(text)
+	for _, term := range model.SearchTerms(user) {
+		if strings.Contains(term, folded) {
+			return true
+		}
+	}
+	return false
+}
+
+// Unique field of the user already taken by another user, empty if none.
+func (s *Storage) duplicateField(user *model.User) string {
+	email := model.NormalizeEmail(user.Email)
+	for id, u := range s.users {
+		if id == user.ID {
+			continue
+		}
+		if u.NormalizedEmail == email {
+			return "email"
+		}
+		if user.NickName != "" && u.NickName == user.NickName {
+			return "nickname"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,444 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/berkantay/user-management-service/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func int64Ptr(i int64) *int64 {
+	return &i
+}
+
+func seed(t *testing.T, s *Storage, users ...model.User) {
+	for i := range users {
+		if users[i].Email == "" {
+			users[i].Email = users[i].ID + "@example.com"
+		}
+		if _, err := s.CreateUser(context.Background(), &users[i]); err != nil {
+			t.Fatalf("CreateUser returned unexpected error: %v", err)
+		}
+	}
+}
+
+func TestCreateUser(t *testing.T) {
+	s := NewStorage()
+
+	id, err := s.CreateUser(context.Background(), &model.User{ID: "1", FirstName: "John"})
+	assert.Nil(t, err)
+	assert.Equal(t, "1", *id)
+
+	_, err = s.CreateUser(context.Background(), &model.User{ID: "1", FirstName: "Jane"})
+	assert.True(t, errors.Is(err, model.ErrAlreadyExists))
+}
+
+func TestUniqueEmailAndNickname(t *testing.T) {
+	s := NewStorage()
+	seed(t, s,
+		model.User{ID: "1", Email: "john@example.com", NickName: "jd"},
+		model.User{ID: "2", Email: "jane@example.com"},
+		model.User{ID: "3", Email: "anna@example.com"},
+	)
+
+	tests := []struct {
+		name  string
+		user  model.User
+		field string
+	}{
+		{"email", model.User{ID: "4", Email: "John@Example.com"}, "email"},
+		{"nickname", model.User{ID: "4", Email: "other@example.com", NickName: "jd"}, "nickname"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := s.CreateUser(context.Background(), &test.user)
+			var domainErr *model.Error
+			assert.True(t, errors.As(err, &domainErr))
+			assert.True(t, errors.Is(err, model.ErrAlreadyExists))
+			assert.Equal(t, test.field, domainErr.Field)
+		})
+	}
+
+	_, err := s.UpdateUser(context.Background(), &model.User{ID: "2", Email: "jane@example.com", NickName: "jd"}, nil)
+	assert.True(t, errors.Is(err, model.ErrAlreadyExists))
+
+	// Users keep their own email and empty nicknames never conflict.
+	_, err = s.UpdateUser(context.Background(), &model.User{ID: "2", Email: "JANE@example.com"}, nil)
+	assert.Nil(t, err)
+}
+
+func TestUpdateUser(t *testing.T) {
+	s := NewStorage()
+	seed(t, s, model.User{ID: "1", FirstName: "John", Country: "TR"})
+
+	_, err := s.UpdateUser(context.Background(), &model.User{ID: "1", FirstName: "Jane", Country: "UK"}, nil)
+	assert.Nil(t, err)
+
+	users, _, err := s.QueryUsers(context.Background(), &model.UserQuery{Country: stringPtr("UK"), Page: int64Ptr(1), Size: int64Ptr(10)})
+	assert.Nil(t, err)
+	assert.Len(t, users, 1)
+	assert.Equal(t, "Jane", users[0].FirstName)
+	assert.False(t, users[0].UpdatedAt.IsZero())
+
+	_, err = s.UpdateUser(context.Background(), &model.User{ID: "2"}, nil)
+	assert.True(t, errors.Is(err, model.ErrNotFound))
+}
+
+func TestUpdateUserMask(t *testing.T) {
+	s := NewStorage()
+	seed(t, s, model.User{ID: "1", FirstName: "Güneş", LastName: "Doe", Email: "gunes@example.com", Password: "hash", Country: "TR"})
+
+	_, err := s.UpdateUser(context.Background(), &model.User{ID: "1", Country: "UK"}, []string{"country"})
+	assert.Nil(t, err)
+	_, err = s.UpdateUser(context.Background(), &model.User{ID: "1", LastName: "Smith"}, []string{"last_name"})
+	assert.Nil(t, err)
+
+	users, _, err := s.QueryUsers(context.Background(), &model.UserQuery{Search: stringPtr("gunes"), Page: int64Ptr(1), Size: int64Ptr(10)})
+	assert.Nil(t, err)
+	assert.Len(t, users, 1)
+	assert.Equal(t, "Güneş", users[0].FirstName)
+	assert.Equal(t, "Smith", users[0].LastName)
+	assert.Equal(t, "hash", users[0].Password)
+	assert.Equal(t, "UK", users[0].Country)
+
+	_, err = s.UpdateUser(context.Background(), &model.User{ID: "1"}, []string{"id"})
+	assert.True(t, errors.Is(err, model.ErrInvalidArgument))
+}
+
+func TestUpdateUserReturnsStored(t *testing.T) {
+	s := NewStorage()
+	created := model.User{ID: "1", FirstName: "John", Email: "john@example.com", CreatedAt: time.Now().Add(-time.Hour)}
+	seed(t, s, created)
+
+	update, err := s.UpdateUser(context.Background(), &model.User{ID: "1", Country: "UK"}, []string{"country"})
+	assert.Nil(t, err)
+	assert.Equal(t, "John", update.FirstName)
+	assert.Equal(t, "john@example.com", update.Email)
+	assert.Equal(t, "UK", update.Country)
+	assert.Equal(t, int64(2), update.Version)
+	assert.False(t, update.CreatedAt.IsZero())
+	assert.True(t, update.UpdatedAt.After(update.CreatedAt))
+}
+
+func TestVersion(t *testing.T) {
+	s := NewStorage()
+	seed(t, s, model.User{ID: "1", FirstName: "John"})
+
+	_, err := s.UpdateUser(context.Background(), &model.User{ID: "1", Country: "UK", Version: 1}, []string{"country"})
+	assert.Nil(t, err)
+	// A second writer still holding version 1 must not overwrite the first.
+	_, err = s.UpdateUser(context.Background(), &model.User{ID: "1", Country: "TR", Version: 1}, []string{"country"})
+	assert.True(t, errors.Is(err, model.ErrConflict))
+	_, err = s.UpdateUser(context.Background(), &model.User{ID: "1", FirstName: "Jane"}, []string{"first_name"})
+	assert.Nil(t, err)
+
+	users, _, err := s.QueryUsers(context.Background(), &model.UserQuery{ID: stringPtr("1"), Page: int64Ptr(1), Size: int64Ptr(10)})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), users[0].Version)
+	assert.Equal(t, "UK", users[0].Country)
+
+	_, err = s.DeleteUser(context.Background(), "1", 2)
+	assert.True(t, errors.Is(err, model.ErrConflict))
+	_, err = s.DeleteUser(context.Background(), "1", 3)
+	assert.Nil(t, err)
+	_, err = s.DeleteUser(context.Background(), "1", 3)
+	assert.True(t, errors.Is(err, model.ErrNotFound))
+}
+
+func TestGetUser(t *testing.T) {
+	s := NewStorage()
+	seed(t, s, model.User{ID: "1", FirstName: "John"})
+	ctx := context.Background()
+
+	user, err := s.GetUser(ctx, "1")
+	assert.Nil(t, err)
+	assert.Equal(t, "John", user.FirstName)
+	assert.Equal(t, int64(1), user.Version)
+
+	_, err = s.GetUser(ctx, "2")
+	assert.True(t, errors.Is(err, model.ErrNotFound))
+
+	_, err = s.DeleteUser(ctx, "1", 0)
+	assert.Nil(t, err)
+	user, err = s.GetUser(ctx, "1")
+	assert.Nil(t, err)
+	assert.NotNil(t, user.DeletedAt)
+}
+
+func TestCreateAndGetUsers(t *testing.T) {
+	s := NewStorage()
+	seed(t, s, model.User{ID: "1", Email: "taken@example.com"})
+	ctx := context.Background()
+
+	errs, err := s.CreateUsers(ctx, []*model.User{
+		{ID: "2", Email: "two@example.com"},
+		{ID: "3", Email: "Taken@example.com"},
+		{ID: "4", Email: "four@example.com"},
+	})
+	assert.Nil(t, err)
+	assert.Len(t, errs, 3)
+	assert.Nil(t, errs[0])
+	assert.True(t, errors.Is(errs[1], model.ErrAlreadyExists))
+	assert.Nil(t, errs[2])
+
+	users, err := s.GetUsers(ctx, []string{"1", "3", "4"})
+	assert.Nil(t, err)
+	ids := []string{}
+	for _, u := range users {
+		ids = append(ids, u.ID)
+	}
+	assert.ElementsMatch(t, []string{"1", "4"}, ids)
+}
+
+func TestStreamUsers(t *testing.T) {
+	s := NewStorage()
+	seed(t, s, model.User{ID: "1", LastName: "Young"}, model.User{ID: "2", LastName: "Adams"}, model.User{ID: "3", LastName: "Moore"})
+	ctx := context.Background()
+	_, err := s.DeleteUser(ctx, "3", 0)
+	assert.Nil(t, err)
+
+	var ids []string
+	err = s.StreamUsers(ctx, &model.UserQuery{OrderBy: []model.SortOrder{{Field: "last_name"}}}, func(u *model.User) error {
+		ids = append(ids, u.ID)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"2", "1"}, ids)
+
+	stop := errors.New("stop")
+	calls := 0
+	err = s.StreamUsers(ctx, &model.UserQuery{}, func(u *model.User) error {
+		calls++
+		return stop
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, 1, calls)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	err = s.StreamUsers(cancelled, &model.UserQuery{}, func(u *model.User) error { return nil })
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestSoftDelete(t *testing.T) {
+	s := NewStorage()
+	seed(t, s, model.User{ID: "1"}, model.User{ID: "2"})
+	ctx := context.Background()
+
+	_, err := s.DeleteUser(ctx, "1", 0)
+	assert.Nil(t, err)
+	_, err = s.UpdateUser(ctx, &model.User{ID: "1", Country: "UK"}, []string{"country"})
+	assert.True(t, errors.Is(err, model.ErrNotFound))
+
+	users, _, err := s.QueryUsers(ctx, &model.UserQuery{IncludeDeleted: true, Page: int64Ptr(1), Size: int64Ptr(10)})
+	assert.Nil(t, err)
+	assert.Len(t, users, 2)
+	assert.Equal(t, model.StatusDeleted, users[0].Status())
+	assert.NotNil(t, users[0].DeletedAt)
+
+	_, err = s.PurgeUser(ctx, "2")
+	assert.True(t, errors.Is(err, model.ErrFailedPrecondition))
+	_, err = s.RestoreUser(ctx, "2", 0)
+	assert.True(t, errors.Is(err, model.ErrFailedPrecondition))
+
+	restored, err := s.RestoreUser(ctx, "1", 2)
+	assert.Nil(t, err)
+	assert.Nil(t, restored.DeletedAt)
+	assert.Equal(t, int64(3), restored.Version)
+
+	_, err = s.DeleteUser(ctx, "1", 0)
+	assert.Nil(t, err)
+	deleted, err := s.DeletedUsers(ctx, time.Now().Add(-time.Hour), 10)
+	assert.Nil(t, err)
+	assert.Empty(t, deleted)
+	deleted, err = s.DeletedUsers(ctx, time.Now().Add(time.Second), 10)
+	assert.Nil(t, err)
+	assert.Len(t, deleted, 1)
+	assert.Equal(t, "1", deleted[0].ID)
+	_, err = s.PurgeUser(ctx, "1")
+	assert.Nil(t, err)
+
+	_, err = s.RestoreUser(ctx, "1", 0)
+	assert.True(t, errors.Is(err, model.ErrNotFound))
+	_, err = s.DeleteUser(ctx, "2", 0)
+	assert.Nil(t, err)
+	purgedUser, err := s.PurgeUser(ctx, "2")
+	assert.Nil(t, err)
+	assert.Equal(t, "2", purgedUser.ID)
+	assert.NotNil(t, purgedUser.DeletedAt)
+	_, err = s.PurgeUser(ctx, "2")
+	assert.True(t, errors.Is(err, model.ErrNotFound))
+}
+
+func TestDeleteUser(t *testing.T) {
+	s := NewStorage()
+	seed(t, s, model.User{ID: "1"}, model.User{ID: "2"})
+
+	deleted, err := s.DeleteUser(context.Background(), "1", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "1", deleted.ID)
+	assert.NotNil(t, deleted.DeletedAt)
+	assert.Equal(t, int64(2), deleted.Version)
+
+	_, err = s.DeleteUser(context.Background(), "1", 0)
+	assert.True(t, errors.Is(err, model.ErrNotFound))
+
+	users, _, err := s.QueryUsers(context.Background(), &model.UserQuery{Page: int64Ptr(1), Size: int64Ptr(10)})
+	assert.Nil(t, err)
+	assert.Len(t, users, 1)
+	assert.Equal(t, "2", users[0].ID)
+}
+
+func TestQueryUsersFilter(t *testing.T) {
+	s := NewStorage()
+	seed(t, s,
+		model.User{ID: "1", FirstName: "John", LastName: "Doe", NickName: "jd", Email: "jd@example.com", Country: "TR"},
+		model.User{ID: "2", FirstName: "Jane", LastName: "Doe", NickName: "jane", Country: "UK"},
+		model.User{ID: "3", FirstName: "John", LastName: "Smith", NickName: "js", Country: "UK"},
+	)
+
+	tests := []struct {
+		name   string
+		filter model.UserQuery
+		want   []string
+	}{
+		{"no filter", model.UserQuery{}, []string{"1", "2", "3"}},
+		{"first name title cased", model.UserQuery{FirstName: stringPtr("john")}, []string{"1", "3"}},
+		{"last name", model.UserQuery{LastName: stringPtr("Doe")}, []string{"1", "2"}},
+		{"nickname", model.UserQuery{NickName: stringPtr("jane")}, []string{"2"}},
+		{"country", model.UserQuery{Country: stringPtr("UK")}, []string{"2", "3"}},
+		{"id", model.UserQuery{ID: stringPtr("2")}, []string{"2"}},
+		{"email case insensitive", model.UserQuery{Email: stringPtr("JD@Example.com")}, []string{"1"}},
+		{"combined", model.UserQuery{FirstName: stringPtr("John"), Country: stringPtr("UK")}, []string{"3"}},
+		{"no match", model.UserQuery{Country: stringPtr("US")}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.filter.Page = int64Ptr(1)
+			test.filter.Size = int64Ptr(10)
+			users, _, err := s.QueryUsers(context.Background(), &test.filter)
+			assert.Nil(t, err)
+			var ids []string
+			for _, u := range users {
+				ids = append(ids, u.ID)
+			}
+			assert.Equal(t, test.want, ids)
+		})
+	}
+}
+
+func TestQueryUsersPagination(t *testing.T) {
+	s := NewStorage()
+	seed(t, s, model.User{ID: "1"}, model.User{ID: "2"}, model.User{ID: "3"})
+
+	page, meta, err := s.QueryUsers(context.Background(), &model.UserQuery{Page: int64Ptr(2), Size: int64Ptr(2)})
+	assert.Nil(t, err)
+	assert.Len(t, page, 1)
+	assert.Equal(t, "3", page[0].ID)
+	assert.Equal(t, &model.UserPage{Page: 2, Size: 2, TotalCount: 3, TotalPages: 2}, meta)
+
+	page, meta, err = s.QueryUsers(context.Background(), &model.UserQuery{Page: int64Ptr(1), Size: int64Ptr(2)})
+	assert.Nil(t, err)
+	assert.Len(t, page, 2)
+	assert.Equal(t, int64Ptr(2), meta.NextPage)
+
+	page, _, err = s.QueryUsers(context.Background(), &model.UserQuery{Page: int64Ptr(3), Size: int64Ptr(2)})
+	assert.Nil(t, err)
+	assert.Nil(t, page)
+}
+
+func TestQueryUsersKeyset(t *testing.T) {
+	s := NewStorage()
+	now := time.Now()
+	seed(t, s,
+		model.User{ID: "b", CreatedAt: now},
+		model.User{ID: "a", CreatedAt: now},
+		model.User{ID: "c", CreatedAt: now.Add(time.Second)},
+	)
+
+	page, meta, err := s.QueryUsers(context.Background(), &model.UserQuery{Page: int64Ptr(1), Size: int64Ptr(2)})
+	assert.Nil(t, err)
+	assert.Equal(t, "a", page[0].ID)
+	assert.Equal(t, "b", page[1].ID)
+	assert.Equal(t, &model.Cursor{Values: []any{now, "b"}}, meta.NextCursor)
+
+	// Inserting before the cursor must not shift the following page.
+	seed(t, s, model.User{ID: "0", CreatedAt: now.Add(-time.Second)})
+
+	page, meta, err = s.QueryUsers(context.Background(), &model.UserQuery{Page: int64Ptr(1), Size: int64Ptr(2), After: meta.NextCursor})
+	assert.Nil(t, err)
+	assert.Len(t, page, 1)
+	assert.Equal(t, "c", page[0].ID)
+	assert.Nil(t, meta.NextCursor)
+	assert.Equal(t, int64(4), meta.TotalCount)
+}
+
+func TestQueryUsersOrderBy(t *testing.T) {
+	s := NewStorage()
+	seed(t, s,
+		model.User{ID: "1", LastName: "Doe", FirstName: "John"},
+		model.User{ID: "2", LastName: "Smith", FirstName: "Anna"},
+		model.User{ID: "3", LastName: "Doe", FirstName: "Jane"},
+		model.User{ID: "4", LastName: "Adams", FirstName: "Jane"},
+	)
+	orderBy := []model.SortOrder{{Field: "last_name"}, {Field: "first_name", Descending: true}}
+
+	var ids []string
+	var after *model.Cursor
+	for {
+		page, meta, err := s.QueryUsers(context.Background(), &model.UserQuery{Page: int64Ptr(1), Size: int64Ptr(1), OrderBy: orderBy, After: after})
+		assert.Nil(t, err)
+		for _, u := range page {
+			ids = append(ids, u.ID)
+		}
+		if meta.NextCursor == nil {
+			break
+		}
+		after = meta.NextCursor
+	}
+
+	assert.Equal(t, []string{"4", "1", "3", "2"}, ids)
+}
+
+func TestQueryUsersSearch(t *testing.T) {
+	s := NewStorage()
+	seed(t, s,
+		model.User{ID: "1", FirstName: "Güneş", LastName: "Yılmaz", NickName: "sunny", Email: "gunes@example.com"},
+		model.User{ID: "2", FirstName: "John", LastName: "Doe", NickName: "100%_real", Email: "jd@example.com"},
+		model.User{ID: "3", FirstName: "Ayşe", LastName: "Güneşli", NickName: "ay", Email: "ayse@example.com"},
+	)
+
+	tests := []struct {
+		name   string
+		search string
+		want   []string
+	}{
+		{"diacritic insensitive", "Gunes", []string{"1", "3"}},
+		{"prefix", "yil", []string{"1"}},
+		{"substring", "unn", []string{"1"}},
+		{"email", "JD@", []string{"2"}},
+		{"wildcards are literal", "%_", []string{"2"}},
+		{"regexp is literal", ".*", nil},
+		{"no cross field match", "john doe", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			users, _, err := s.QueryUsers(context.Background(), &model.UserQuery{Search: stringPtr(test.search), Page: int64Ptr(1), Size: int64Ptr(10)})
+			assert.Nil(t, err)
+			var ids []string
+			for _, u := range users {
+				ids = append(ids, u.ID)
+			}
+			assert.Equal(t, test.want, ids)
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package model
+
+import "fmt"
+
+// Largest number of items a batch request may carry.
+const MaxBatchSize = 1000
+
+// Outcome of one item of a batch. Err is set when the item failed, User otherwise.
+type UserResult struct {
+	User *User
+	Err  error
+}
+
+// Checks the number of items of a batch request.
+func CheckBatchSize(size int) error {
+	if size == 0 {
+		return NewInvalidArgumentError("batch", "Batch is empty.")
+	}
+	if size > MaxBatchSize {
+		return NewInvalidArgumentError("batch", fmt.Sprintf("Batch is larger than %d.", MaxBatchSize))
+	}
+	return nil
+}
+
+// User of an import. Password of the user is already a bcrypt hash when PasswordHashed is set.
+type ImportUser struct {
+	User           *User
+	PasswordHashed bool
+}
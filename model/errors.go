@@ -0,0 +1,121 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error kinds raised by the user service and its repositories. Use errors.Is to check the kind of an error.
+var (
+	ErrNotFound           = errors.New("not found")
+	ErrAlreadyExists      = errors.New("already exists")
+	ErrInvalidArgument    = errors.New("invalid argument")
+	ErrConflict           = errors.New("conflict")
+	ErrFailedPrecondition = errors.New("failed precondition")
+	ErrPermissionDenied   = errors.New("permission denied")
+	ErrUnavailable        = errors.New("unavailable")
+)
+
+// Error describes a domain failure with enough context to report it to clients.
+type Error struct {
+	Kind     error  // One of the Err* kinds above.
+	Resource string // Type of the resource the error is about, e.g. "user".
+	ID       string // Identifier of the resource, if known.
+	Field    string // Offending field, if the error is about a single field.
+	Message  string // Human readable description.
+	Err      error  // Underlying cause, if any.
+}
+
+func (e *Error) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = e.Kind.Error()
+	}
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s", msg, e.Err)
+	}
+	return msg
+}
+
+// Is reports whether target is the kind of the error.
+func (e *Error) Is(target error) bool {
+	return e.Kind == target
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Resource with given id does not exist.
+func NewNotFoundError(resource, id string) *Error {
+	return &Error{
+		Kind:     ErrNotFound,
+		Resource: resource,
+		ID:       id,
+		Message:  fmt.Sprintf("%s %s not found", resource, id),
+	}
+}
+
+// Resource could not be stored because field value is already taken.
+func NewAlreadyExistsError(resource, field string, err error) *Error {
+	return &Error{
+		Kind:     ErrAlreadyExists,
+		Resource: resource,
+		Field:    field,
+		Message:  fmt.Sprintf("%s with same %s already exists", resource, field),
+		Err:      err,
+	}
+}
+
+// Field of the request is not acceptable.
+func NewInvalidArgumentError(field, message string) *Error {
+	return &Error{
+		Kind:    ErrInvalidArgument,
+		Field:   field,
+		Message: message,
+	}
+}
+
+// Resource was changed concurrently, retrying with fresh state may succeed.
+func NewConflictError(resource, id, message string) *Error {
+	return &Error{
+		Kind:     ErrConflict,
+		Resource: resource,
+		ID:       id,
+		Message:  message,
+	}
+}
+
+// Stored version of the resource differs from the version the caller expected.
+func NewVersionConflictError(resource, id string) *Error {
+	return NewConflictError(resource, id, fmt.Sprintf("%s %s was changed by someone else", resource, id))
+}
+
+// Resource is not in the state the operation requires, e.g. purging an active user.
+func NewFailedPreconditionError(resource, id, message string) *Error {
+	return &Error{
+		Kind:     ErrFailedPrecondition,
+		Resource: resource,
+		ID:       id,
+		Message:  message,
+	}
+}
+
+// Caller is not allowed to change the resource, e.g. credentials did not match.
+func NewPermissionDeniedError(resource, id, message string) *Error {
+	return &Error{
+		Kind:     ErrPermissionDenied,
+		Resource: resource,
+		ID:       id,
+		Message:  message,
+	}
+}
+
+// Backing service could not be reached.
+func NewUnavailableError(err error) *Error {
+	return &Error{
+		Kind:    ErrUnavailable,
+		Message: "storage unavailable",
+		Err:     err,
+	}
+}
@@ -0,0 +1,119 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Names of the events sent for user changes.
+const (
+	EventUserCreated     = "user_created"
+	EventUserDeleted     = "user_deleted"
+	EventUserUpdated     = "user_updated"
+	EventUserRestored    = "user_restored"
+	EventUserPurged      = "user_purged"
+	EventPasswordChanged = "password_changed"
+)
+
+// Broker topic user events are published to.
+const UserTopic = "user"
+
+// CloudEvents attributes of user events. The type of an event is EventTypePrefix followed by its name.
+const (
+	CloudEventsVersion  = "1.0"
+	EventSource         = "/user-management-service"
+	EventTypePrefix     = "com.github.berkantay.user-management-service."
+	EventContentType    = "application/json"
+	UserEventDataSchema = "urn:user-management-service:schema:user:v1" // See schemas/user-v1.json, a breaking change of the data gets a new version.
+)
+
+// CloudEvents 1.0 envelope of a user change in structured JSON mode.
+type UserEvent struct {
+	SpecVersion     string            `json:"specversion"`
+	ID              string            `json:"id"` // Unique per event, consumers can drop redelivered events by it.
+	Source          string            `json:"source"`
+	Type            string            `json:"type"`
+	Subject         string            `json:"subject"` // Id of the changed user.
+	Time            time.Time         `json:"time"`    // Time the change occurred.
+	DataContentType string            `json:"datacontenttype"`
+	DataSchema      string            `json:"dataschema"`
+	Data            *UserEventPayload `json:"data"`
+}
+
+// User as it is after the change, without its password.
+type UserEventPayload struct {
+	ID        string     `json:"id,omitempty"`
+	FirstName string     `json:"first_name,omitempty"`
+	LastName  string     `json:"last_name,omitempty"`
+	NickName  string     `json:"nick_name,omitempty"`
+	Email     string     `json:"email,omitempty"`
+	Country   string     `json:"country,omitempty"`
+	Version   int64      `json:"version,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	Status    string     `json:"status,omitempty"`
+}
+
+// Event with given id reporting the change of the user at the given time.
+func NewUserEvent(id, eventName string, user *User, occurredAt time.Time) *UserEvent {
+	return &UserEvent{
+		SpecVersion:     CloudEventsVersion,
+		ID:              id,
+		Source:          EventSource,
+		Type:            EventTypePrefix + eventName,
+		Subject:         user.ID,
+		Time:            occurredAt.UTC(),
+		DataContentType: EventContentType,
+		DataSchema:      UserEventDataSchema,
+		Data: &UserEventPayload{
+			ID:        user.ID,
+			FirstName: user.FirstName,
+			LastName:  user.LastName,
+			NickName:  user.NickName,
+			Email:     user.Email,
+			Country:   user.Country,
+			Version:   user.Version,
+			CreatedAt: timePtr(user.CreatedAt),
+			UpdatedAt: timePtr(user.UpdatedAt),
+			DeletedAt: user.DeletedAt,
+			Status:    user.Status(),
+		},
+	}
+}
+
+// Nil for the zero time so it is left out of events.
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// Event waiting to be published. It is stored in the same transaction as the change it reports,
+// so the change and its event are either both kept or both lost.
+type OutboxEvent struct {
+	ID        string     `bson:"_id"`
+	Topic     string     `bson:"topic"`
+	Payload   []byte     `bson:"payload"` // Structured CloudEvent as it is published.
+	CreatedAt time.Time  `bson:"created_at"`
+	SentAt    *time.Time `bson:"sent_at,omitempty"` // Nil until the broker accepted the message.
+	Attempts  int64      `bson:"attempts"`          // Failed publish attempts.
+	LastError string     `bson:"last_error,omitempty"`
+	ParkedAt  *time.Time `bson:"parked_at,omitempty"` // Set when the relay gave up on the event, it is not published.
+}
+
+// Outbox event with given id carrying the user event. The change occurs now, in the transaction storing the event.
+func NewOutboxEvent(id, eventName string, user *User) (*OutboxEvent, error) {
+	now := time.Now()
+	payload, err := json.Marshal(NewUserEvent(id, eventName, user, now))
+	if err != nil {
+		return nil, err
+	}
+	return &OutboxEvent{
+		ID:        id,
+		Topic:     UserTopic,
+		Payload:   payload,
+		CreatedAt: now,
+	}, nil
+}
@@ -1,6 +1,7 @@
 package model
 
 import (
+	"strings"
 	"time"
 )
 
@@ -9,30 +10,78 @@ type User struct {
 	FirstName string    `bson:"first_name" json:"first_name"`
 	LastName  string    `bson:"last_name" json:"last_name"`
 	NickName  string    `bson:"nickname" json:"nickname"`
-	Password  string    `bson:"password" json:"password"`
+	Password  string    `bson:"password" json:"-"` // Bcrypt hash, never serialized to clients or events.
 	Email     string    `bson:"email" json:"email"`
 	Country   string    `bson:"country" json:"country"`
 	CreatedAt time.Time `bson:"created_at" json:"created_at"`
 	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+	// Incremented by every write. On updates it is the version the caller expects to replace, 0 replaces any.
+	Version int64 `bson:"version" json:"version"`
+	// Time the user was soft deleted, nil while active. Deleted users are purged after a retention period.
+	DeletedAt *time.Time `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
+	// Lower cased email kept by repositories for case-insensitive matching.
+	NormalizedEmail string `bson:"email_normalized" json:"-"`
+	// Folded searchable fields kept by repositories for search, see SearchTerms.
+	SearchTerms []string `bson:"search" json:"-"`
+}
+
+// Status of a user, derived from DeletedAt.
+const (
+	StatusActive  = "active"
+	StatusDeleted = "deleted"
+)
+
+func (u *User) Status() string {
+	if u.DeletedAt != nil {
+		return StatusDeleted
+	}
+	return StatusActive
+}
+
+// Normalizes email for case-insensitive comparison.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
 }
 
 type UserQuery struct {
-	ID        *string `bson:"_id,omitempty"`
-	FirstName *string `bson:"first_name" json:"first_name"`
-	LastName  *string `bson:"last_name" json:"last_name"`
-	NickName  *string `bson:"nickname" json:"nickname"`
-	Email     *string `bson:"email" json:"email"`
-	Country   *string `bson:"country" json:"country"`
-	Page      *int64  `bson:"page" json:"page"`
-	Size      *int64  `bson:"size" json:"size"`
+	ID        *string     `bson:"_id,omitempty"`
+	FirstName *string     `bson:"first_name" json:"first_name"`
+	LastName  *string     `bson:"last_name" json:"last_name"`
+	NickName  *string     `bson:"nickname" json:"nickname"`
+	Email     *string     `bson:"email" json:"email"`
+	Country   *string     `bson:"country" json:"country"`
+	Search    *string     `bson:"-" json:"search,omitempty"` // Matches users containing the text in names, nickname or email.
+	Page      *int64      `bson:"page" json:"page"`
+	Size      *int64      `bson:"size" json:"size"`
+	OrderBy   []SortOrder `bson:"-" json:"order_by,omitempty"`
+	After     *Cursor     `bson:"-" json:"-"` // Keyset position to continue from. Page is ignored when set.
+	// Soft deleted users are left out unless set.
+	IncludeDeleted bool `bson:"-" json:"include_deleted,omitempty"`
 }
 
+// Pagination metadata of a query result.
 type UserPage struct {
-	NumberOfItem int
-	Limit        int
+	Page       int64
+	Size       int64
+	TotalCount int64
+	TotalPages int64
+	NextPage   *int64  // Nil on the last page.
+	NextCursor *Cursor // Position to continue from, nil on the last page.
 }
 
-type UserEvent struct {
-	EventName string `json:"event_name,omitempty"`
-	Payload   any    `json:"payload,omitempty"`
+// Computes pagination metadata of the requested page from the total number of matching users.
+func NewUserPage(page, size, totalCount int64) *UserPage {
+	p := &UserPage{
+		Page:       page,
+		Size:       size,
+		TotalCount: totalCount,
+	}
+	if size > 0 {
+		p.TotalPages = (totalCount + size - 1) / size
+	}
+	if page < p.TotalPages {
+		next := page + 1
+		p.NextPage = &next
+	}
+	return p
 }
@@ -0,0 +1,95 @@
+package model
+
+import (
+	"strings"
+	"time"
+)
+
+// Fields users can be ordered by.
+var SortFields = []string{"first_name", "last_name", "nickname", "email", "country", "created_at", "updated_at"}
+
+// Ordering on a single field.
+type SortOrder struct {
+	Field      string `json:"field"`
+	Descending bool   `json:"descending,omitempty"`
+}
+
+// Position of a user in the query order, used for keyset pagination.
+type Cursor struct {
+	Values []any // Values of the last user for each field of UserQuery.Order, in the same order.
+}
+
+// Effective order of the query results. Defaults to creation order and always ends with id to break ties.
+func (q *UserQuery) Order() []SortOrder {
+	order := make([]SortOrder, 0, len(q.OrderBy)+1)
+	order = append(order, q.OrderBy...)
+	if len(order) == 0 {
+		order = append(order, SortOrder{Field: "created_at"})
+	}
+	return append(order, SortOrder{Field: "id"})
+}
+
+// Value of the field used for ordering. Time fields return time.Time, the others string.
+func (u *User) SortValue(field string) any {
+	switch field {
+	case "id":
+		return u.ID
+	case "first_name":
+		return u.FirstName
+	case "last_name":
+		return u.LastName
+	case "nickname":
+		return u.NickName
+	case "email":
+		return u.Email
+	case "country":
+		return u.Country
+	case "created_at":
+		return u.CreatedAt
+	case "updated_at":
+		return u.UpdatedAt
+	}
+	return nil
+}
+
+// Reports whether the field holds a time.
+func IsTimeField(field string) bool {
+	return field == "created_at" || field == "updated_at"
+}
+
+// Cursor pointing at the user in the given order.
+func CursorOf(user *User, order []SortOrder) *Cursor {
+	values := make([]any, len(order))
+	for i, o := range order {
+		values[i] = user.SortValue(o.Field)
+	}
+	return &Cursor{Values: values}
+}
+
+// Compares two sort values of the same field. Returns -1, 0 or 1.
+func CompareSortValues(a, b any) int {
+	switch a := a.(type) {
+	case time.Time:
+		b := b.(time.Time)
+		switch {
+		case a.Before(b):
+			return -1
+		case a.After(b):
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(a, b.(string))
+	}
+	return 0
+}
+
+// Repositories fetch one user more than the page size to detect a following page.
+// TrimPage drops that extra user and returns the cursor of the last user kept, nil if there is no following page.
+func TrimPage(users []User, size int64, order []SortOrder) ([]User, *Cursor) {
+	if int64(len(users)) <= size {
+		return users, nil
+	}
+	users = users[:size]
+	return users, CursorOf(&users[len(users)-1], order)
+}
@@ -0,0 +1,41 @@
+package model
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Letters that do not decompose into a base letter and a combining mark.
+var foldReplacer = strings.NewReplacer(
+	"ı", "i",
+	"ł", "l",
+	"ø", "o",
+	"đ", "d",
+	"ß", "ss",
+	"æ", "ae",
+	"œ", "oe",
+)
+
+// Folds text for search: lower cases, strips diacritics and drops control characters, so "Güneş" becomes "gunes".
+func FoldText(text string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), runes.Remove(runes.In(unicode.Cc)), norm.NFC)
+	folded, _, err := transform.String(t, strings.ToLower(text))
+	if err != nil {
+		folded = strings.ToLower(text)
+	}
+	return foldReplacer.Replace(folded)
+}
+
+// Folded values of the searchable fields of the user.
+func SearchTerms(user *User) []string {
+	return []string{
+		FoldText(user.FirstName),
+		FoldText(user.LastName),
+		FoldText(user.NickName),
+		FoldText(user.Email),
+	}
+}
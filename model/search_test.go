@@ -0,0 +1,27 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFoldText(t *testing.T) {
+	tests := map[string]string{
+		"Güneş":          "gunes",
+		"GUNES":          "gunes",
+		"Işık":           "isik",
+		"İstanbul":       "istanbul",
+		"Çağrı Öztürk":   "cagri ozturk",
+		"José Müller":    "jose muller",
+		"Łukasz Søren":   "lukasz soren",
+		"Straße":         "strasse",
+		"a\x1fb":         "ab",
+		"john@Mail.COM":  "john@mail.com",
+		"(.*)+?[regexp]": "(.*)+?[regexp]",
+	}
+
+	for in, want := range tests {
+		assert.Equal(t, want, FoldText(in), in)
+	}
+}
@@ -0,0 +1,70 @@
+package model
+
+import "fmt"
+
+// Fields of a user an update can change. The password is left out, it only changes through a password change.
+var UpdateFields = []string{"first_name", "last_name", "nickname", "email", "country"}
+
+// Checks the fields of an update mask. Repositories also accept the password field to store a new hash.
+// An empty mask selects every field in UpdateFields.
+func UpdateMask(fields []string) ([]string, error) {
+	if len(fields) == 0 {
+		return UpdateFields, nil
+	}
+	seen := make(map[string]bool)
+	for _, field := range fields {
+		if !isUpdateField(field) {
+			return nil, NewInvalidArgumentError("update_mask", fmt.Sprintf("Can not update [%s].", field))
+		}
+		if seen[field] {
+			return nil, NewInvalidArgumentError("update_mask", fmt.Sprintf("Duplicate field [%s].", field))
+		}
+		seen[field] = true
+	}
+	return fields, nil
+}
+
+// Copies the given fields of update into the user and refreshes the derived fields.
+func (u *User) Apply(update *User, fields []string) {
+	for _, field := range fields {
+		switch field {
+		case "first_name":
+			u.FirstName = update.FirstName
+		case "last_name":
+			u.LastName = update.LastName
+		case "nickname":
+			u.NickName = update.NickName
+		case "password":
+			u.Password = update.Password
+		case "email":
+			u.Email = update.Email
+		case "country":
+			u.Country = update.Country
+		}
+	}
+	u.NormalizedEmail = NormalizeEmail(u.Email)
+	u.SearchTerms = SearchTerms(u)
+}
+
+// Reports whether any of the fields is one of the searchable fields, see SearchTerms.
+func TouchesSearch(fields []string) bool {
+	for _, field := range fields {
+		switch field {
+		case "first_name", "last_name", "nickname", "email":
+			return true
+		}
+	}
+	return false
+}
+
+func isUpdateField(field string) bool {
+	if field == "password" {
+		return true
+	}
+	for _, f := range UpdateFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
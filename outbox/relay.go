@@ -0,0 +1,321 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/berkantay/user-management-service/model"
+	"github.com/google/uuid"
+)
+
+// Storage of the outbox events.
+type Store interface {
+	PendingEvents(ctx context.Context, limit int) ([]model.OutboxEvent, error)
+	MarkEventSent(ctx context.Context, id string, sentAt time.Time) error
+	MarkEventFailed(ctx context.Context, id string, reason string) error
+	// Moves the event aside, parked events are no longer pending.
+	ParkEvent(ctx context.Context, id string, parkedAt time.Time) error
+	OutboxLag(ctx context.Context) (int64, time.Time, error)
+	// Takes or extends the relay lease of owner until the given time. Returns false while another owner holds it.
+	AcquireRelayLease(ctx context.Context, owner string, until time.Time) (bool, error)
+}
+
+type EventPublisher interface {
+	Publish(topic string, payload []byte) error
+}
+
+// Publisher waiting for the broker to acknowledge the message. The relay prefers it when available,
+// so events are only marked as sent once the broker has them.
+type SyncPublisher interface {
+	PublishSync(ctx context.Context, topic string, payload []byte) error
+}
+
+// Lag and throughput of the relay.
+type Stats struct {
+	Pending         int64      `json:"pending"`     // Events not published yet.
+	LagSeconds      float64    `json:"lag_seconds"` // Age of the oldest pending event.
+	Published       int64      `json:"published"`   // Events published since start.
+	Failed          int64      `json:"failed"`      // Failed publish attempts since start.
+	Parked          int64      `json:"parked"`      // Events given up on since start.
+	LastPublishedAt *time.Time `json:"last_published_at,omitempty"`
+}
+
+// Publishes the events of the outbox in creation order and marks them as sent.
+// Delivery is at least once: an event published just before a crash is published again.
+// Only the relay holding the lease of the store publishes, so replicas do not publish the same events.
+type Relay struct {
+	store       Store
+	publisher   EventPublisher
+	logger      *log.Logger
+	interval    time.Duration
+	batchSize   int
+	retries     int
+	backoff     time.Duration
+	maxAttempts int64
+	owner       string // Identifies the relay in the lease.
+	leaseTTL    time.Duration
+	leaseUntil  time.Time // Zero while the lease is not held.
+
+	mu              sync.Mutex
+	pending         int64
+	oldest          time.Time
+	published       int64
+	failed          int64
+	parked          int64
+	lastPublishedAt *time.Time
+}
+
+// Configure relay by changing polling or retries.
+type RelayOption func(*Relay)
+
+func WithLogger(logger *log.Logger) RelayOption {
+	return func(r *Relay) {
+		r.logger = logger
+	}
+}
+
+// Time between two polls of the outbox.
+func WithInterval(interval time.Duration) RelayOption {
+	return func(r *Relay) {
+		r.interval = interval
+	}
+}
+
+// Events read from the outbox at once.
+func WithBatchSize(size int) RelayOption {
+	return func(r *Relay) {
+		r.batchSize = size
+	}
+}
+
+// Publish attempts after the first failure of an event, waiting backoff before the first and doubling it after each.
+func WithRetries(retries int, backoff time.Duration) RelayOption {
+	return func(r *Relay) {
+		r.retries = retries
+		r.backoff = backoff
+	}
+}
+
+// Failed publish attempts after which an event is parked, once a later event is published.
+// Parking only then keeps a broker outage from parking events.
+func WithMaxAttempts(attempts int64) RelayOption {
+	return func(r *Relay) {
+		r.maxAttempts = attempts
+	}
+}
+
+// Time the lease is taken for. A relay that stopped is replaced by another one after this long,
+// it must be longer than the interval.
+func WithLeaseTTL(ttl time.Duration) RelayOption {
+	return func(r *Relay) {
+		r.leaseTTL = ttl
+	}
+}
+
+// Create new relay publishing the events of the store.
+func NewRelay(store Store, publisher EventPublisher, opts ...RelayOption) *Relay {
+	r := &Relay{
+		store:       store,
+		publisher:   publisher,
+		logger:      log.New(io.Discard, "", 0),
+		interval:    time.Second,
+		batchSize:   100,
+		retries:     3,
+		backoff:     100 * time.Millisecond,
+		maxAttempts: 20,
+		owner:       uuid.NewString(),
+		leaseTTL:    30 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Relay events every interval until the context is done.
+func (r *Relay) Run(ctx context.Context) {
+	r.logger.Printf("INFO:Outbox|Relay started, interval [%s]", r.interval)
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		r.RelayPending(ctx)
+		select {
+		case <-ctx.Done():
+			r.logger.Printf("INFO:Outbox|Relay stopped.")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Publishes pending events until none is left and returns how many were published. Does nothing while
+// another relay holds the lease. Stops at the first event that can not be published so events stay in order,
+// it is retried on the next call. Events that failed max attempts times are skipped instead and parked
+// as soon as a later event is published.
+func (r *Relay) RelayPending(ctx context.Context) (int, error) {
+	defer r.refreshLag(ctx)
+	published := 0
+	for {
+		if !r.holdLease(ctx) {
+			return published, nil
+		}
+		events, err := r.store.PendingEvents(ctx, r.batchSize)
+		if err != nil {
+			r.logger.Printf("ERROR:Outbox|Could not read pending events [%s]", err)
+			return published, err
+		}
+		var stuck []*model.OutboxEvent
+		for i := range events {
+			event := &events[i]
+			if !r.holdLease(ctx) {
+				return published, nil
+			}
+			err := r.publish(ctx, event)
+			if err == nil {
+				published++
+				r.park(ctx, stuck)
+				stuck = nil
+				continue
+			}
+			if ctx.Err() != nil || event.Attempts < r.maxAttempts {
+				return published, err
+			}
+			stuck = append(stuck, event)
+		}
+		if len(stuck) > 0 {
+			// Nothing after them was published, the broker may be down.
+			return published, fmt.Errorf("%d events failed %d times", len(stuck), r.maxAttempts)
+		}
+		if len(events) < r.batchSize {
+			if published > 0 {
+				r.logger.Printf("INFO:Outbox|Published [%d] events.", published)
+			}
+			return published, nil
+		}
+	}
+}
+
+// Snapshot of the relay metrics.
+func (r *Relay) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := Stats{
+		Pending:         r.pending,
+		Published:       r.published,
+		Failed:          r.failed,
+		Parked:          r.parked,
+		LastPublishedAt: r.lastPublishedAt,
+	}
+	if !r.oldest.IsZero() {
+		stats.LagSeconds = time.Since(r.oldest).Seconds()
+	}
+	return stats
+}
+
+// Takes the lease, or extends it when half of it is used. Returns false while another relay holds it.
+func (r *Relay) holdLease(ctx context.Context) bool {
+	now := time.Now()
+	if r.leaseUntil.Sub(now) > r.leaseTTL/2 {
+		return true
+	}
+	until := now.Add(r.leaseTTL)
+	held, err := r.store.AcquireRelayLease(ctx, r.owner, until)
+	if err != nil {
+		r.logger.Printf("ERROR:Outbox|Could not take relay lease [%s]", err)
+		return false
+	}
+	if !held {
+		if !r.leaseUntil.IsZero() {
+			r.logger.Printf("WARNING:Outbox|Relay lease taken by another relay.")
+		}
+		r.leaseUntil = time.Time{}
+		return false
+	}
+	if r.leaseUntil.IsZero() {
+		r.logger.Printf("INFO:Outbox|Relay lease taken [%s]", r.owner)
+	}
+	r.leaseUntil = until
+	return true
+}
+
+// Moves the events aside, they are no longer published.
+func (r *Relay) park(ctx context.Context, events []*model.OutboxEvent) {
+	for _, event := range events {
+		if err := r.store.ParkEvent(ctx, event.ID, time.Now()); err != nil {
+			r.logger.Printf("ERROR:Outbox|Could not park event [%s] [%s]", event.ID, err)
+			continue
+		}
+		r.logger.Printf("ERROR:Outbox|Parked event [%s] after [%d] failed attempts [%s]", event.ID, event.Attempts, event.LastError)
+		r.mu.Lock()
+		r.parked++
+		r.mu.Unlock()
+	}
+}
+
+// Publishes the event with retries and marks it as sent, or records the failure in the store and the event.
+func (r *Relay) publish(ctx context.Context, event *model.OutboxEvent) error {
+	backoff := r.backoff
+	var err error
+	for attempt := 0; attempt <= r.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		if err = r.send(ctx, event); err == nil {
+			break
+		}
+		r.logger.Printf("WARNING:Outbox|Could not publish event [%s] [%s]", event.ID, err)
+		event.Attempts++
+		event.LastError = err.Error()
+		r.mu.Lock()
+		r.failed++
+		r.mu.Unlock()
+		if markErr := r.store.MarkEventFailed(ctx, event.ID, err.Error()); markErr != nil {
+			r.logger.Printf("ERROR:Outbox|Could not record failure of event [%s] [%s]", event.ID, markErr)
+		}
+	}
+	if err != nil {
+		r.logger.Printf("ERROR:Outbox|Giving up on event [%s] until next poll [%s]", event.ID, err)
+		return err
+	}
+	now := time.Now()
+	// A failure here publishes the event again on the next poll.
+	if err := r.store.MarkEventSent(ctx, event.ID, now); err != nil {
+		r.logger.Printf("ERROR:Outbox|Could not mark event [%s] as sent [%s]", event.ID, err)
+		return err
+	}
+	r.mu.Lock()
+	r.published++
+	r.lastPublishedAt = &now
+	r.mu.Unlock()
+	return nil
+}
+
+// Publishes the event, waiting for the acknowledgement if the publisher supports it.
+func (r *Relay) send(ctx context.Context, event *model.OutboxEvent) error {
+	if publisher, ok := r.publisher.(SyncPublisher); ok {
+		return publisher.PublishSync(ctx, event.Topic, event.Payload)
+	}
+	return r.publisher.Publish(event.Topic, event.Payload)
+}
+
+// Reads the number and age of pending events from the store.
+func (r *Relay) refreshLag(ctx context.Context) {
+	pending, oldest, err := r.store.OutboxLag(ctx)
+	if err != nil {
+		r.logger.Printf("ERROR:Outbox|Could not read lag [%s]", err)
+		return
+	}
+	r.mu.Lock()
+	r.pending = pending
+	r.oldest = oldest
+	r.mu.Unlock()
+}
@@ -0,0 +1,262 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/berkantay/user-management-service/model"
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryStore struct {
+	events     []*model.OutboxEvent
+	leaseOwner string
+	leaseUntil time.Time
+}
+
+func newMemoryStore(count int, createdAt time.Time) *memoryStore {
+	store := &memoryStore{}
+	for i := 0; i < count; i++ {
+		store.events = append(store.events, &model.OutboxEvent{
+			ID:        fmt.Sprintf("event-%d", i),
+			Topic:     model.UserTopic,
+			Payload:   []byte(fmt.Sprintf("payload-%d", i)),
+			CreatedAt: createdAt,
+		})
+	}
+	return store
+}
+
+func (m *memoryStore) PendingEvents(ctx context.Context, limit int) ([]model.OutboxEvent, error) {
+	var pending []model.OutboxEvent
+	for _, event := range m.events {
+		if event.SentAt == nil && event.ParkedAt == nil && len(pending) < limit {
+			pending = append(pending, *event)
+		}
+	}
+	return pending, nil
+}
+
+func (m *memoryStore) MarkEventSent(ctx context.Context, id string, sentAt time.Time) error {
+	m.find(id).SentAt = &sentAt
+	return nil
+}
+
+func (m *memoryStore) MarkEventFailed(ctx context.Context, id string, reason string) error {
+	event := m.find(id)
+	event.Attempts++
+	event.LastError = reason
+	return nil
+}
+
+func (m *memoryStore) ParkEvent(ctx context.Context, id string, parkedAt time.Time) error {
+	m.find(id).ParkedAt = &parkedAt
+	return nil
+}
+
+func (m *memoryStore) AcquireRelayLease(ctx context.Context, owner string, until time.Time) (bool, error) {
+	if m.leaseOwner != owner && time.Now().Before(m.leaseUntil) {
+		return false, nil
+	}
+	m.leaseOwner = owner
+	m.leaseUntil = until
+	return true, nil
+}
+
+func (m *memoryStore) OutboxLag(ctx context.Context) (int64, time.Time, error) {
+	var pending int64
+	var oldest time.Time
+	for _, event := range m.events {
+		if event.SentAt == nil && event.ParkedAt == nil {
+			if pending == 0 {
+				oldest = event.CreatedAt
+			}
+			pending++
+		}
+	}
+	return pending, oldest, nil
+}
+
+func (m *memoryStore) find(id string) *model.OutboxEvent {
+	for _, event := range m.events {
+		if event.ID == id {
+			return event
+		}
+	}
+	return nil
+}
+
+// Fails the first failures calls and every call with the poison payload, then records the payloads.
+type flakyPublisher struct {
+	failures  int
+	poison    string
+	published []string
+}
+
+func (p *flakyPublisher) Publish(topic string, payload []byte) error {
+	if string(payload) == p.poison {
+		return errors.New("message too large")
+	}
+	if p.failures > 0 {
+		p.failures--
+		return errors.New("broker unavailable")
+	}
+	p.published = append(p.published, string(payload))
+	return nil
+}
+
+func TestRelayPublishesInOrder(t *testing.T) {
+	store := newMemoryStore(5, time.Now())
+	publisher := &flakyPublisher{}
+	relay := NewRelay(store, publisher, WithBatchSize(2))
+
+	published, err := relay.RelayPending(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 5, published)
+	assert.Equal(t, []string{"payload-0", "payload-1", "payload-2", "payload-3", "payload-4"}, publisher.published)
+	for _, event := range store.events {
+		assert.NotNil(t, event.SentAt)
+	}
+	stats := relay.Stats()
+	assert.Equal(t, int64(0), stats.Pending)
+	assert.Equal(t, float64(0), stats.LagSeconds)
+	assert.Equal(t, int64(5), stats.Published)
+	assert.NotNil(t, stats.LastPublishedAt)
+
+	published, err = relay.RelayPending(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, published)
+}
+
+func TestRelayRetries(t *testing.T) {
+	store := newMemoryStore(2, time.Now())
+	publisher := &flakyPublisher{failures: 2}
+	relay := NewRelay(store, publisher, WithRetries(2, time.Millisecond))
+
+	published, err := relay.RelayPending(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, published)
+	assert.Equal(t, []string{"payload-0", "payload-1"}, publisher.published)
+	assert.Equal(t, int64(2), store.events[0].Attempts)
+	assert.Equal(t, "broker unavailable", store.events[0].LastError)
+	assert.Equal(t, int64(2), relay.Stats().Failed)
+}
+
+func TestRelayKeepsOrderOnFailure(t *testing.T) {
+	store := newMemoryStore(3, time.Now().Add(-time.Minute))
+	publisher := &flakyPublisher{failures: 3}
+	relay := NewRelay(store, publisher, WithRetries(1, time.Millisecond))
+
+	published, err := relay.RelayPending(context.Background())
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, published)
+	// The first event is not skipped, later events wait for it.
+	assert.Empty(t, publisher.published)
+	assert.Equal(t, int64(2), store.events[0].Attempts)
+	stats := relay.Stats()
+	assert.Equal(t, int64(3), stats.Pending)
+	assert.GreaterOrEqual(t, stats.LagSeconds, 60.0)
+
+	published, err = relay.RelayPending(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 3, published)
+	assert.Equal(t, []string{"payload-0", "payload-1", "payload-2"}, publisher.published)
+}
+
+func TestRelayStopsWhenCancelled(t *testing.T) {
+	store := newMemoryStore(1, time.Now())
+	publisher := &flakyPublisher{failures: 1}
+	relay := NewRelay(store, publisher, WithRetries(1, time.Hour))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := relay.RelayPending(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Nil(t, store.events[0].SentAt)
+}
+
+func TestRelayParksPoisonEvent(t *testing.T) {
+	store := newMemoryStore(3, time.Now())
+	publisher := &flakyPublisher{poison: "payload-0"}
+	relay := NewRelay(store, publisher, WithRetries(0, time.Millisecond), WithMaxAttempts(2))
+
+	published, err := relay.RelayPending(context.Background())
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, published)
+	assert.Nil(t, store.events[0].ParkedAt)
+
+	published, err = relay.RelayPending(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, published)
+	assert.Equal(t, []string{"payload-1", "payload-2"}, publisher.published)
+	assert.NotNil(t, store.events[0].ParkedAt)
+	assert.Nil(t, store.events[0].SentAt)
+	stats := relay.Stats()
+	assert.Equal(t, int64(1), stats.Parked)
+	assert.Equal(t, int64(0), stats.Pending)
+}
+
+func TestRelayDoesNotParkDuringOutage(t *testing.T) {
+	store := newMemoryStore(3, time.Now())
+	publisher := &flakyPublisher{failures: 100}
+	relay := NewRelay(store, publisher, WithRetries(0, time.Millisecond), WithMaxAttempts(1))
+
+	_, err := relay.RelayPending(context.Background())
+	assert.NotNil(t, err)
+	// Every event failed, nothing was published after them.
+	for _, event := range store.events {
+		assert.Equal(t, int64(1), event.Attempts)
+		assert.Nil(t, event.ParkedAt)
+	}
+	assert.Equal(t, int64(0), relay.Stats().Parked)
+}
+
+func TestRelayLease(t *testing.T) {
+	store := newMemoryStore(1, time.Now())
+	first := &flakyPublisher{}
+	second := &flakyPublisher{}
+	relay := NewRelay(store, first)
+	other := NewRelay(store, second)
+
+	published, err := relay.RelayPending(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, published)
+
+	store.events = append(store.events, &model.OutboxEvent{ID: "event-1", Payload: []byte("payload-1"), CreatedAt: time.Now()})
+	published, err = other.RelayPending(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, published)
+	assert.Empty(t, second.published)
+
+	// The lease expired, the other relay takes over.
+	store.leaseUntil = time.Now().Add(-time.Second)
+	published, err = other.RelayPending(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, published)
+	assert.Equal(t, []string{"payload-1"}, second.published)
+}
+
+// Records which publish method was called.
+type syncPublisher struct {
+	flakyPublisher
+	synced int
+}
+
+func (p *syncPublisher) PublishSync(ctx context.Context, topic string, payload []byte) error {
+	p.synced++
+	return p.Publish(topic, payload)
+}
+
+func TestRelayWaitsForAcknowledgement(t *testing.T) {
+	store := newMemoryStore(2, time.Now())
+	publisher := &syncPublisher{}
+	relay := NewRelay(store, publisher)
+
+	published, err := relay.RelayPending(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, published)
+	assert.Equal(t, 2, publisher.synced)
+}
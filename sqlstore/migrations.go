@@ -0,0 +1,129 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/berkantay/user-management-service/model"
+)
+
+// A schema or data change applied inside a transaction.
+type migration func(ctx context.Context, s *Storage, tx *sql.Tx) error
+
+// Migration running a single SQL statement.
+func statement(query string) migration {
+	return func(ctx context.Context, s *Storage, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, query)
+		return err
+	}
+}
+
+// Schema changes in the order they are applied. Never edit an applied migration, append a new one.
+var migrations = []migration{
+	statement(`CREATE TABLE IF NOT EXISTS users (
+		id TEXT PRIMARY KEY,
+		first_name TEXT NOT NULL,
+		last_name TEXT NOT NULL,
+		nickname TEXT NOT NULL,
+		password TEXT NOT NULL,
+		email TEXT NOT NULL,
+		country TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		CONSTRAINT users_email_key UNIQUE (email)
+	)`),
+	statement(`CREATE INDEX IF NOT EXISTS users_country_idx ON users (country)`),
+	statement(`CREATE INDEX IF NOT EXISTS users_created_at_idx ON users (created_at, id)`),
+	statement(`ALTER TABLE users ADD COLUMN email_normalized TEXT NOT NULL DEFAULT ''`),
+	statement(`UPDATE users SET email_normalized = LOWER(TRIM(email))`),
+	statement(`CREATE INDEX IF NOT EXISTS users_email_normalized_idx ON users (email_normalized)`),
+	statement(`ALTER TABLE users ADD COLUMN search_text TEXT NOT NULL DEFAULT ''`),
+	backfillSearchText,
+	statement(`DROP INDEX IF EXISTS users_email_normalized_idx`),
+	statement(`CREATE UNIQUE INDEX IF NOT EXISTS users_email_normalized_key ON users (email_normalized)`),
+	statement(`CREATE UNIQUE INDEX IF NOT EXISTS users_nickname_key ON users (nickname) WHERE nickname <> ''`),
+	statement(`ALTER TABLE users ADD COLUMN version INTEGER NOT NULL DEFAULT 1`),
+	statement(`ALTER TABLE users ADD COLUMN deleted_at TIMESTAMP NULL`),
+	statement(`CREATE INDEX IF NOT EXISTS users_deleted_at_idx ON users (deleted_at)`),
+}
+
+// Applies every migration newer than the recorded schema version. Each migration runs in its own transaction.
+func (s *Storage) migrate(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`)
+	if err != nil {
+		return err
+	}
+
+	current, err := s.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	for i := current; i < len(migrations); i++ {
+		version := i + 1
+		s.logger.Printf("INFO:SQL|Applying migration [%d]", version)
+		if err := s.applyMigration(ctx, version, migrations[i]); err != nil {
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+	}
+	return nil
+}
+
+func (s *Storage) applyMigration(ctx context.Context, version int, m migration) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m(ctx, s, tx); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Current schema version of the database.
+func (s *Storage) SchemaVersion(ctx context.Context) (int, error) {
+	var version int
+	err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
+
+// Folding can not be expressed in SQL, so search text of existing users is computed here.
+func backfillSearchText(ctx context.Context, s *Storage, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, `SELECT id, first_name, last_name, nickname, email FROM users`)
+	if err != nil {
+		return err
+	}
+	var users []model.User
+	for rows.Next() {
+		u := model.User{}
+		if err := rows.Scan(&u.ID, &u.FirstName, &u.LastName, &u.NickName, &u.Email); err != nil {
+			rows.Close()
+			return err
+		}
+		users = append(users, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range users {
+		_, err := tx.ExecContext(ctx, s.rebind(`UPDATE users SET search_text = ? WHERE id = ?`), searchText(&users[i]), users[i].ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Searchable fields joined by a separator folded text can not contain, so matches never span two fields.
+func searchText(user *model.User) string {
+	return strings.Join(model.SearchTerms(user), "\x1f")
+}
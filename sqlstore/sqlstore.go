@@ -0,0 +1,618 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/berkantay/user-management-service/model"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+)
+
+const userColumns = "id, first_name, last_name, nickname, password, email, country, created_at, updated_at, version, deleted_at"
+
+// Storage keeps users in a SQL database through database/sql. Works with SQLite and PostgreSQL drivers.
+type Storage struct {
+	driver string
+	dsn    string
+	db     *sql.DB
+	logger *log.Logger
+}
+
+// Configure storage by changing driver or logger.
+type StorageOption func(*Storage)
+
+// Database driver name as registered to database/sql and its data source name.
+func WithDriver(driver, dsn string) StorageOption {
+	return func(s *Storage) {
+		s.driver = driver
+		s.dsn = dsn
+	}
+}
+
+func WithLogger(logger *log.Logger) StorageOption {
+	return func(s *Storage) {
+		s.logger = logger
+	}
+}
+
+// Open connection to the database and bring schema up to date.
+func NewStorage(ctx context.Context, opts ...StorageOption) (*Storage, error) {
+	s := &Storage{
+		driver: "sqlite3",
+		dsn:    "user-management-service.db",
+		logger: log.New(io.Discard, "", 0),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.logger.Printf("INFO:SQL|Connecting.. [%s]", s.driver)
+	db, err := sql.Open(s.driver, s.dsn)
+	if err != nil {
+		s.logger.Printf("ERROR:SQL|Could not connected [%s]", err)
+		return nil, err
+	}
+	s.db = db
+
+	s.logger.Printf("INFO:SQL|Migrating schema..")
+	if err := s.migrate(ctx); err != nil {
+		s.logger.Printf("ERROR:SQL|Could not migrate schema [%s]", err)
+		db.Close()
+		return nil, err
+	}
+	s.logger.Printf("INFO:SQL|Schema is up to date.")
+	return s, nil
+}
+
+// Check if database is alive or not.
+func (s *Storage) HealthCheck(ctx context.Context) error {
+	if err := s.db.PingContext(ctx); err != nil {
+		s.logger.Printf("ERROR:SQL|Database is NOT alive..")
+		return model.NewUnavailableError(err)
+	}
+	s.logger.Printf("INFO:SQL|Database alive..")
+	return nil
+}
+
+// Create user in database with given type.
+func (s *Storage) CreateUser(ctx context.Context, user *model.User) (*string, error) {
+	s.logger.Printf("INFO:SQL|Creating user.")
+	_, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO users (`+userColumns+`, email_normalized, search_text) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 1, NULL, ?, ?)`),
+		user.ID, user.FirstName, user.LastName, user.NickName, user.Password, user.Email, user.Country,
+		user.CreatedAt.UTC(), user.UpdatedAt.UTC(), model.NormalizeEmail(user.Email), searchText(user))
+	if err != nil {
+		s.logger.Printf("ERROR:SQL|Could not create user. [%s]", err)
+		return nil, toDomainError(err)
+	}
+	insertionId := user.ID
+	s.logger.Printf("INFO:SQL|Creation successful.[%s]", insertionId)
+	return &insertionId, nil
+}
+
+// Create users in database one statement each, so a failing user does not roll back the others.
+// Returns one error per user, nil for created users.
+func (s *Storage) CreateUsers(ctx context.Context, users []*model.User) ([]error, error) {
+	errs := make([]error, len(users))
+	for i, user := range users {
+		_, errs[i] = s.CreateUser(ctx, user)
+		if errors.Is(errs[i], model.ErrUnavailable) {
+			return nil, errs[i]
+		}
+	}
+	return errs, nil
+}
+
+// Get users with any of the ids, including soft deleted users. Unknown ids are left out.
+func (s *Storage) GetUsers(ctx context.Context, ids []string) ([]model.User, error) {
+	s.logger.Printf("INFO:SQL|Getting [%d] users.", len(ids))
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT `+userColumns+` FROM users WHERE id IN (`+placeholders+`)`), args...)
+	if err != nil {
+		s.logger.Printf("ERROR:SQL|Could not get users [%s]", err)
+		return nil, toDomainError(err)
+	}
+	defer rows.Close()
+
+	var users []model.User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			s.logger.Printf("ERROR:SQL|Could not scan row [%s]", err)
+			return nil, err
+		}
+		users = append(users, *u)
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.Printf("ERROR:SQL|Cursor error [%s]", err)
+		return nil, toDomainError(err)
+	}
+	return users, nil
+}
+
+// Get user with corresponding id, including soft deleted users.
+func (s *Storage) GetUser(ctx context.Context, id string) (*model.User, error) {
+	s.logger.Printf("INFO:SQL|Getting user with id:[%s]", id)
+	user, err := s.findUser(ctx, id)
+	if err != nil {
+		s.logger.Printf("ERROR:SQL|Could not get [%s] error is: [%s]", id, err)
+		return nil, err
+	}
+	return user, nil
+}
+
+// Update the given fields of the user in database and return the stored user. Updates only one item.
+// A non-zero user version must match the stored one.
+func (s *Storage) UpdateUser(ctx context.Context, user *model.User, fields []string) (*model.User, error) {
+	s.logger.Printf("INFO:SQL|Updating user")
+	fields, err := model.UpdateMask(fields)
+	if err != nil {
+		s.logger.Printf("ERROR:SQL|Update error is  [%s]", err)
+		return nil, err
+	}
+	for {
+		update, err := s.updateUser(ctx, user, fields)
+		if user.Version == 0 && errors.Is(err, model.ErrConflict) {
+			// The user changed after its searchable fields were read, read them again.
+			s.logger.Printf("WARNING:SQL|User [%s] changed while updating, retrying", user.ID)
+			continue
+		}
+		return update, err
+	}
+}
+
+// Update the given fields of the user once. The search text is folded from the stored user, which
+// must not change in between, so an update without version reports a conflict when it raced another write.
+func (s *Storage) updateUser(ctx context.Context, user *model.User, fields []string) (*model.User, error) {
+	sets, args := updateBuilder(user, fields)
+	version := user.Version
+	if model.TouchesSearch(fields) {
+		// Search text folds all searchable fields, so the ones left out of the mask are read first.
+		// The update only applies if the user did not change in between.
+		current, err := s.findActiveUser(ctx, user.ID)
+		if err != nil {
+			s.logger.Printf("ERROR:SQL|Update error is  [%s]", err)
+			return nil, err
+		}
+		if version == 0 {
+			version = current.Version
+		}
+		current.Apply(user, fields)
+		sets = append(sets, "search_text = ?")
+		args = append(args, searchText(current))
+	}
+	where, whereArgs := " WHERE id = ? AND deleted_at IS NULL", []any{user.ID}
+	if version != 0 {
+		where += " AND version = ?"
+		whereArgs = append(whereArgs, version)
+	}
+	sets = append(sets, "updated_at = ?", "version = version + 1")
+	args = append(args, time.Now().UTC())
+
+	row := s.db.QueryRowContext(ctx, s.rebind(`UPDATE users SET `+strings.Join(sets, ", ")+where+` RETURNING `+userColumns), append(args, whereArgs...)...)
+	update, err := scanUser(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.logger.Printf("ERROR:SQL|Update error is  [%s] not updated", user.ID)
+		if version != 0 {
+			return nil, s.missingOrChanged(ctx, user.ID)
+		}
+		return nil, model.NewNotFoundError("user", user.ID)
+	}
+	if err != nil {
+		s.logger.Printf("ERROR:SQL|Update error is  [%s]", err)
+		return nil, toDomainError(err)
+	}
+	s.logger.Printf("INFO:SQL|Update successful user. [%s]", user.ID)
+	return update, nil
+}
+
+// Soft delete user in database with corresponding id and return it. A non-zero version must match the stored one.
+func (s *Storage) DeleteUser(ctx context.Context, id string, version int64) (*model.User, error) {
+	s.logger.Printf("INFO:SQL|Deleting user with id:[%s]", id)
+	now := time.Now().UTC()
+	where, args := " WHERE id = ? AND deleted_at IS NULL", []any{now, now, id}
+	if version != 0 {
+		where += " AND version = ?"
+		args = append(args, version)
+	}
+	row := s.db.QueryRowContext(ctx, s.rebind(`UPDATE users SET deleted_at = ?, updated_at = ?, version = version + 1`+where+` RETURNING `+userColumns), args...)
+	deleted, err := scanUser(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = model.NewNotFoundError("user", id)
+		if version != 0 {
+			err = s.missingOrChanged(ctx, id)
+		}
+		s.logger.Printf("ERROR:SQL|Could not delete [%s] error is: [%s]", id, err)
+		return nil, err
+	}
+	if err != nil {
+		s.logger.Printf("ERROR:SQL|Could not delete [%s] error is: [%s]", id, err)
+		return nil, toDomainError(err)
+	}
+	s.logger.Printf("INFO:SQL|Delete successful.")
+	return deleted, nil
+}
+
+// Restore soft deleted user and return it. A non-zero version must match the stored one.
+func (s *Storage) RestoreUser(ctx context.Context, id string, version int64) (*model.User, error) {
+	s.logger.Printf("INFO:SQL|Restoring user with id:[%s]", id)
+	where, args := " WHERE id = ? AND deleted_at IS NOT NULL", []any{time.Now().UTC(), id}
+	if version != 0 {
+		where += " AND version = ?"
+		args = append(args, version)
+	}
+	row := s.db.QueryRowContext(ctx, s.rebind(`UPDATE users SET deleted_at = NULL, updated_at = ?, version = version + 1`+where+` RETURNING `+userColumns), args...)
+	restored, err := scanUser(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		current, err := s.findUser(ctx, id)
+		switch {
+		case err != nil:
+		case current.DeletedAt == nil:
+			err = model.NewFailedPreconditionError("user", id, "User is not deleted.")
+		default:
+			err = model.NewVersionConflictError("user", id)
+		}
+		s.logger.Printf("ERROR:SQL|Could not restore [%s] error is: [%s]", id, err)
+		return nil, err
+	}
+	if err != nil {
+		s.logger.Printf("ERROR:SQL|Could not restore [%s] error is: [%s]", id, err)
+		return nil, toDomainError(err)
+	}
+	s.logger.Printf("INFO:SQL|Restore successful.")
+	return restored, nil
+}
+
+// Permanently remove soft deleted user with corresponding id and return it.
+func (s *Storage) PurgeUser(ctx context.Context, id string) (*model.User, error) {
+	s.logger.Printf("INFO:SQL|Purging user with id:[%s]", id)
+	row := s.db.QueryRowContext(ctx, s.rebind(`DELETE FROM users WHERE id = ? AND deleted_at IS NOT NULL RETURNING `+userColumns), id)
+	purged, err := scanUser(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = model.NewNotFoundError("user", id)
+		if _, findErr := s.findUser(ctx, id); findErr == nil {
+			err = model.NewFailedPreconditionError("user", id, "User must be deleted before it is purged.")
+		}
+		s.logger.Printf("ERROR:SQL|Could not purge [%s] error is: [%s]", id, err)
+		return nil, err
+	}
+	if err != nil {
+		s.logger.Printf("ERROR:SQL|Could not purge [%s] error is: [%s]", id, err)
+		return nil, toDomainError(err)
+	}
+	s.logger.Printf("INFO:SQL|Purge successful.")
+	return purged, nil
+}
+
+// Users deleted before the given time, the earliest deleted first, at most limit.
+func (s *Storage) DeletedUsers(ctx context.Context, before time.Time, limit int64) ([]model.User, error) {
+	s.logger.Printf("INFO:SQL|Getting users deleted before [%s]", before)
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT `+userColumns+` FROM users WHERE deleted_at IS NOT NULL AND deleted_at < ? ORDER BY deleted_at, id LIMIT ?`), before.UTC(), limit)
+	if err != nil {
+		s.logger.Printf("ERROR:SQL|Could not get deleted users [%s]", err)
+		return nil, toDomainError(err)
+	}
+	defer rows.Close()
+
+	var users []model.User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			s.logger.Printf("ERROR:SQL|Could not scan row [%s]", err)
+			return nil, err
+		}
+		users = append(users, *u)
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.Printf("ERROR:SQL|Cursor error [%s]", err)
+		return nil, toDomainError(err)
+	}
+	return users, nil
+}
+
+// Query users with a filter. Returns the requested page, nil when nothing matches, and its pagination metadata.
+func (s *Storage) QueryUsers(ctx context.Context, filter *model.UserQuery) ([]model.User, *model.UserPage, error) {
+	s.logger.Printf("INFO:SQL|Querying user with given filter")
+	limit := *filter.Size
+	skip := *filter.Page*limit - limit
+	if filter.After != nil {
+		skip = 0
+	}
+
+	where, args := whereBuilder(filter)
+	var total int64
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT COUNT(*) FROM users`+where), args...).Scan(&total)
+	if err != nil {
+		s.logger.Printf("ERROR:SQL|Count error [%s]", err)
+		return nil, nil, toDomainError(err)
+	}
+
+	order := filter.Order()
+	if filter.After != nil {
+		where, args = keysetCondition(where, args, filter.After, order)
+	}
+	query := `SELECT ` + userColumns + ` FROM users` + where + orderBuilder(order) + ` LIMIT ? OFFSET ?`
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), append(args, limit+1, skip)...)
+	if err != nil {
+		s.logger.Printf("ERROR:SQL|Query error [%s]", err)
+		return nil, nil, toDomainError(err)
+	}
+	defer rows.Close()
+
+	var result []model.User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			s.logger.Printf("ERROR:SQL|Could not scan row [%s]", err)
+			return nil, nil, err
+		}
+		result = append(result, *u)
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.Printf("ERROR:SQL|Cursor error [%s]", err)
+		return nil, nil, toDomainError(err)
+	}
+	page := model.NewUserPage(*filter.Page, *filter.Size, total)
+	result, page.NextCursor = model.TrimPage(result, limit, order)
+	s.logger.Printf("INFO:SQL|Query result")
+	return result, page, nil
+}
+
+// Calls fn for every user matching the filter in query order, scanning rows as they arrive.
+// Paging fields of the filter are ignored. Stops at the first error of fn or when the context is done.
+func (s *Storage) StreamUsers(ctx context.Context, filter *model.UserQuery, fn func(*model.User) error) error {
+	s.logger.Printf("INFO:SQL|Streaming users with given filter")
+	where, args := whereBuilder(filter)
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT `+userColumns+` FROM users`+where+orderBuilder(filter.Order())), args...)
+	if err != nil {
+		s.logger.Printf("ERROR:SQL|Query error [%s]", err)
+		return toDomainError(err)
+	}
+	defer rows.Close()
+
+	var streamed int64
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			s.logger.Printf("ERROR:SQL|Could not scan row [%s]", err)
+			return err
+		}
+		if err := fn(u); err != nil {
+			s.logger.Printf("WARNING:SQL|Stream stopped after [%d] users [%s]", streamed, err)
+			return err
+		}
+		streamed++
+	}
+	if err := ctx.Err(); err != nil {
+		s.logger.Printf("WARNING:SQL|Stream stopped after [%d] users [%s]", streamed, err)
+		return err
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.Printf("ERROR:SQL|Cursor error [%s]", err)
+		return toDomainError(err)
+	}
+	s.logger.Printf("INFO:SQL|Streamed [%d] users", streamed)
+	return nil
+}
+
+// Close the database.
+func (s *Storage) GracefullShutdown(ctx context.Context) error {
+	s.logger.Printf("INFO:SQL|Shutting down..")
+	err := s.db.Close()
+	s.logger.Printf("INFO:SQL|Closed.")
+	return err
+}
+
+// Read a single user by id.
+func (s *Storage) findUser(ctx context.Context, id string) (*model.User, error) {
+	row := s.db.QueryRowContext(ctx, s.rebind(`SELECT `+userColumns+` FROM users WHERE id = ?`), id)
+	u, err := scanUser(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, model.NewNotFoundError("user", id)
+	}
+	if err != nil {
+		return nil, toDomainError(err)
+	}
+	return u, nil
+}
+
+// Read a single user by id, soft deleted users are not found.
+func (s *Storage) findActiveUser(ctx context.Context, id string) (*model.User, error) {
+	u, err := s.findUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if u.DeletedAt != nil {
+		return nil, model.NewNotFoundError("user", id)
+	}
+	return u, nil
+}
+
+// Explains why a conditional write touched no row: the user is gone or was changed in between.
+func (s *Storage) missingOrChanged(ctx context.Context, id string) error {
+	if _, err := s.findActiveUser(ctx, id); err != nil {
+		return err
+	}
+	return model.NewVersionConflictError("user", id)
+}
+
+// Scan a row selected with userColumns.
+func scanUser(row interface{ Scan(dest ...any) error }) (*model.User, error) {
+	u := model.User{}
+	var deletedAt sql.NullTime
+	err := row.Scan(&u.ID, &u.FirstName, &u.LastName, &u.NickName, &u.Password, &u.Email, &u.Country, &u.CreatedAt, &u.UpdatedAt, &u.Version, &deletedAt)
+	if err != nil {
+		return nil, err
+	}
+	if deletedAt.Valid {
+		u.DeletedAt = &deletedAt.Time
+	}
+	return &u, nil
+}
+
+// Builds the SET assignments for the given fields. Field names equal to column names.
+func updateBuilder(user *model.User, fields []string) ([]string, []any) {
+	var sets []string
+	var args []any
+	for _, field := range fields {
+		sets = append(sets, field+" = ?")
+		switch field {
+		case "first_name":
+			args = append(args, user.FirstName)
+		case "last_name":
+			args = append(args, user.LastName)
+		case "nickname":
+			args = append(args, user.NickName)
+		case "password":
+			args = append(args, user.Password)
+		case "email":
+			args = append(args, user.Email)
+			sets = append(sets, "email_normalized = ?")
+			args = append(args, model.NormalizeEmail(user.Email))
+		case "country":
+			args = append(args, user.Country)
+		}
+	}
+	return sets, args
+}
+
+// Builds the WHERE clause for the filter, mirroring the MongoDB filter.
+func whereBuilder(filter *model.UserQuery) (string, []any) {
+	var conditions []string
+	var args []any
+
+	if filter.ID != nil {
+		conditions = append(conditions, "id = ?")
+		args = append(args, *filter.ID)
+	}
+	if filter.FirstName != nil {
+		conditions = append(conditions, "first_name = ?")
+		args = append(args, cases.Title(language.English, cases.Compact).String(*filter.FirstName))
+	}
+	if filter.LastName != nil {
+		conditions = append(conditions, "last_name = ?")
+		args = append(args, cases.Title(language.English, cases.Compact).String(*filter.LastName))
+	}
+	if filter.NickName != nil {
+		conditions = append(conditions, "nickname = ?")
+		args = append(args, *filter.NickName)
+	}
+	if filter.Email != nil {
+		conditions = append(conditions, "email_normalized = ?")
+		args = append(args, model.NormalizeEmail(*filter.Email))
+	}
+	if filter.Country != nil {
+		conditions = append(conditions, "country = ?")
+		args = append(args, *filter.Country)
+	}
+	if filter.Search != nil {
+		conditions = append(conditions, `search_text LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+likeEscaper.Replace(model.FoldText(*filter.Search))+"%")
+	}
+	if !filter.IncludeDeleted {
+		conditions = append(conditions, "deleted_at IS NULL")
+	}
+
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// Builds the ORDER BY clause. Field names are allowlisted by the caller and equal to column names.
+func orderBuilder(order []model.SortOrder) string {
+	terms := make([]string, len(order))
+	for i, o := range order {
+		terms[i] = o.Field
+		if o.Descending {
+			terms[i] += " DESC"
+		}
+	}
+	return " ORDER BY " + strings.Join(terms, ", ")
+}
+
+// Escapes LIKE wildcards so search text is matched literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// Extends the WHERE clause to match users after the cursor in the given order.
+// For order (a, b) it matches a > x OR (a = x AND b > y), comparisons flip for descending fields.
+func keysetCondition(where string, args []any, cursor *model.Cursor, order []model.SortOrder) (string, []any) {
+	branches := make([]string, len(order))
+	for i, o := range order {
+		var terms []string
+		for j := 0; j < i; j++ {
+			terms = append(terms, order[j].Field+" = ?")
+			args = append(args, sqlValue(cursor.Values[j]))
+		}
+		operator := " > ?"
+		if o.Descending {
+			operator = " < ?"
+		}
+		terms = append(terms, o.Field+operator)
+		args = append(args, sqlValue(cursor.Values[i]))
+		branches[i] = "(" + strings.Join(terms, " AND ") + ")"
+	}
+	condition := "(" + strings.Join(branches, " OR ") + ")"
+	if where == "" {
+		return " WHERE " + condition, args
+	}
+	return where + " AND " + condition, args
+}
+
+// Times are stored in UTC.
+func sqlValue(value any) any {
+	if t, ok := value.(time.Time); ok {
+		return t.UTC()
+	}
+	return value
+}
+
+// Rewrites ? placeholders to $n for drivers that need positional parameters.
+func (s *Storage) rebind(query string) string {
+	if s.driver != "postgres" && s.driver != "pgx" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Translates driver errors into domain errors. Drivers are matched by message to stay driver agnostic.
+func toDomainError(err error) error {
+	if errors.Is(err, sql.ErrConnDone) || errors.Is(err, context.DeadlineExceeded) {
+		return model.NewUnavailableError(err)
+	}
+	msg := err.Error()
+	if !strings.Contains(msg, "UNIQUE constraint failed") && !strings.Contains(msg, "duplicate key value") {
+		return err
+	}
+	switch {
+	case strings.Contains(msg, "users.email"), strings.Contains(msg, "users_email"):
+		return model.NewAlreadyExistsError("user", "email", err)
+	case strings.Contains(msg, "users.nickname"), strings.Contains(msg, "users_nickname"):
+		return model.NewAlreadyExistsError("user", "nickname", err)
+	}
+	return model.NewAlreadyExistsError("user", "id", err)
+}
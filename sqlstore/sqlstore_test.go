@@ -0,0 +1,518 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/berkantay/user-management-service/model"
+	"github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func int64Ptr(i int64) *int64 {
+	return &i
+}
+
+func newTestStorage(t *testing.T) *Storage {
+	dsn := filepath.Join(t.TempDir(), "users.db")
+	s, err := NewStorage(context.Background(), WithDriver("sqlite3", dsn))
+	if err != nil {
+		t.Fatalf("NewStorage returned unexpected error: %v", err)
+	}
+	t.Cleanup(func() { s.GracefullShutdown(context.Background()) })
+	return s
+}
+
+func seed(t *testing.T, s *Storage, users ...model.User) {
+	for i := range users {
+		users[i].CreatedAt = time.Now().Add(time.Duration(i) * time.Second)
+		users[i].UpdatedAt = users[i].CreatedAt
+		if users[i].Email == "" {
+			users[i].Email = users[i].ID + "@example.com"
+		}
+		if _, err := s.CreateUser(context.Background(), &users[i]); err != nil {
+			t.Fatalf("CreateUser returned unexpected error: %v", err)
+		}
+	}
+}
+
+func TestMigrationsAreIdempotent(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "users.db")
+	for i := 0; i < 2; i++ {
+		s, err := NewStorage(context.Background(), WithDriver("sqlite3", dsn))
+		assert.Nil(t, err)
+		version, err := s.SchemaVersion(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, len(migrations), version)
+		s.GracefullShutdown(context.Background())
+	}
+}
+
+func TestCreateUserUniqueConstraints(t *testing.T) {
+	s := newTestStorage(t)
+	seed(t, s, model.User{ID: "1", Email: "john@example.com"})
+
+	_, err := s.CreateUser(context.Background(), &model.User{ID: "2", Email: "john@example.com"})
+	var domainErr *model.Error
+	assert.True(t, errors.As(err, &domainErr))
+	assert.True(t, errors.Is(err, model.ErrAlreadyExists))
+	assert.Equal(t, "email", domainErr.Field)
+
+	_, err = s.CreateUser(context.Background(), &model.User{ID: "2", Email: "JOHN@example.com"})
+	assert.True(t, errors.As(err, &domainErr))
+	assert.Equal(t, "email", domainErr.Field)
+
+	_, err = s.CreateUser(context.Background(), &model.User{ID: "1", Email: "other@example.com"})
+	assert.True(t, errors.As(err, &domainErr))
+	assert.Equal(t, "id", domainErr.Field)
+}
+
+func TestUniqueNickname(t *testing.T) {
+	s := newTestStorage(t)
+	seed(t, s, model.User{ID: "1", NickName: "jd"}, model.User{ID: "2"}, model.User{ID: "3"})
+
+	_, err := s.CreateUser(context.Background(), &model.User{ID: "4", Email: "4@example.com", NickName: "jd"})
+	var domainErr *model.Error
+	assert.True(t, errors.As(err, &domainErr))
+	assert.Equal(t, "nickname", domainErr.Field)
+
+	_, err = s.UpdateUser(context.Background(), &model.User{ID: "2", Email: "2@example.com", NickName: "jd"}, nil)
+	assert.True(t, errors.Is(err, model.ErrAlreadyExists))
+}
+
+func TestUpdateUser(t *testing.T) {
+	s := newTestStorage(t)
+	seed(t, s, model.User{ID: "1", FirstName: "John", Country: "TR"})
+
+	_, err := s.UpdateUser(context.Background(), &model.User{ID: "1", FirstName: "Jane", Email: "jane@example.com", Country: "UK"}, nil)
+	assert.Nil(t, err)
+
+	users, _, err := s.QueryUsers(context.Background(), &model.UserQuery{Country: stringPtr("UK"), Page: int64Ptr(1), Size: int64Ptr(10)})
+	assert.Nil(t, err)
+	assert.Len(t, users, 1)
+	assert.Equal(t, "Jane", users[0].FirstName)
+
+	_, err = s.UpdateUser(context.Background(), &model.User{ID: "2"}, nil)
+	assert.True(t, errors.Is(err, model.ErrNotFound))
+}
+
+func TestUpdateUserMask(t *testing.T) {
+	s := newTestStorage(t)
+	seed(t, s, model.User{ID: "1", FirstName: "Güneş", LastName: "Doe", Email: "gunes@example.com", Password: "hash", Country: "TR"})
+
+	_, err := s.UpdateUser(context.Background(), &model.User{ID: "1", Country: "UK"}, []string{"country"})
+	assert.Nil(t, err)
+	_, err = s.UpdateUser(context.Background(), &model.User{ID: "1", LastName: "Smith"}, []string{"last_name"})
+	assert.Nil(t, err)
+
+	users, _, err := s.QueryUsers(context.Background(), &model.UserQuery{Search: stringPtr("gunes"), Page: int64Ptr(1), Size: int64Ptr(10)})
+	assert.Nil(t, err)
+	assert.Len(t, users, 1)
+	assert.Equal(t, "Güneş", users[0].FirstName)
+	assert.Equal(t, "Smith", users[0].LastName)
+	assert.Equal(t, "hash", users[0].Password)
+	assert.Equal(t, "UK", users[0].Country)
+
+	_, err = s.UpdateUser(context.Background(), &model.User{ID: "1"}, []string{"id"})
+	assert.True(t, errors.Is(err, model.ErrInvalidArgument))
+}
+
+func TestUpdateUserReturnsStored(t *testing.T) {
+	s := newTestStorage(t)
+	created := model.User{ID: "1", FirstName: "John", Email: "john@example.com", CreatedAt: time.Now().Add(-time.Hour)}
+	seed(t, s, created)
+
+	update, err := s.UpdateUser(context.Background(), &model.User{ID: "1", Country: "UK"}, []string{"country"})
+	assert.Nil(t, err)
+	assert.Equal(t, "John", update.FirstName)
+	assert.Equal(t, "john@example.com", update.Email)
+	assert.Equal(t, "UK", update.Country)
+	assert.Equal(t, int64(2), update.Version)
+	assert.False(t, update.CreatedAt.IsZero())
+	assert.True(t, update.UpdatedAt.After(update.CreatedAt))
+}
+
+func TestVersion(t *testing.T) {
+	s := newTestStorage(t)
+	seed(t, s, model.User{ID: "1", FirstName: "John"})
+
+	_, err := s.UpdateUser(context.Background(), &model.User{ID: "1", Country: "UK", Version: 1}, []string{"country"})
+	assert.Nil(t, err)
+	// A second writer still holding version 1 must not overwrite the first.
+	_, err = s.UpdateUser(context.Background(), &model.User{ID: "1", Country: "TR", Version: 1}, []string{"country"})
+	assert.True(t, errors.Is(err, model.ErrConflict))
+	_, err = s.UpdateUser(context.Background(), &model.User{ID: "1", FirstName: "Jane"}, []string{"first_name"})
+	assert.Nil(t, err)
+
+	users, _, err := s.QueryUsers(context.Background(), &model.UserQuery{ID: stringPtr("1"), Page: int64Ptr(1), Size: int64Ptr(10)})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), users[0].Version)
+	assert.Equal(t, "UK", users[0].Country)
+
+	_, err = s.DeleteUser(context.Background(), "1", 2)
+	assert.True(t, errors.Is(err, model.ErrConflict))
+	_, err = s.DeleteUser(context.Background(), "1", 3)
+	assert.Nil(t, err)
+	_, err = s.DeleteUser(context.Background(), "1", 3)
+	assert.True(t, errors.Is(err, model.ErrNotFound))
+}
+
+// Sqlite driver letting another write run right before the next update, after the user was read.
+type racingDriver struct {
+	sqlite3.SQLiteDriver
+	race atomic.Pointer[func()]
+}
+
+func (d *racingDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.SQLiteDriver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return racingConn{Conn: conn, driver: d}, nil
+}
+
+type racingConn struct {
+	driver.Conn
+	driver *racingDriver
+}
+
+func (c racingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if strings.HasPrefix(query, "UPDATE users") {
+		if race := c.driver.race.Swap(nil); race != nil {
+			(*race)()
+		}
+	}
+	return c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+}
+
+var racing = &racingDriver{}
+
+func init() {
+	sql.Register("sqlite3-racing", racing)
+}
+
+func TestConcurrentUpdatesWithoutVersion(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "users.db")
+	s, err := NewStorage(context.Background(), WithDriver("sqlite3-racing", dsn))
+	assert.Nil(t, err)
+	defer s.GracefullShutdown(context.Background())
+	seed(t, s, model.User{ID: "1", FirstName: "John", LastName: "Doe"})
+
+	// The last name changes after the first name update read the user.
+	race := func() {
+		_, err := s.UpdateUser(context.Background(), &model.User{ID: "1", LastName: "Smith"}, []string{"last_name"})
+		assert.Nil(t, err)
+	}
+	racing.race.Store(&race)
+	_, err = s.UpdateUser(context.Background(), &model.User{ID: "1", FirstName: "Jane"}, []string{"first_name"})
+	assert.Nil(t, err)
+
+	// The search text holds both changes.
+	for _, search := range []string{"jane", "smith"} {
+		users, _, err := s.QueryUsers(context.Background(), &model.UserQuery{Search: stringPtr(search), Page: int64Ptr(1), Size: int64Ptr(10)})
+		assert.Nil(t, err)
+		assert.Len(t, users, 1)
+	}
+	user, err := s.GetUser(context.Background(), "1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), user.Version)
+}
+
+func TestGetUser(t *testing.T) {
+	s := newTestStorage(t)
+	seed(t, s, model.User{ID: "1", FirstName: "John"})
+	ctx := context.Background()
+
+	user, err := s.GetUser(ctx, "1")
+	assert.Nil(t, err)
+	assert.Equal(t, "John", user.FirstName)
+	assert.Equal(t, int64(1), user.Version)
+
+	_, err = s.GetUser(ctx, "2")
+	assert.True(t, errors.Is(err, model.ErrNotFound))
+
+	_, err = s.DeleteUser(ctx, "1", 0)
+	assert.Nil(t, err)
+	user, err = s.GetUser(ctx, "1")
+	assert.Nil(t, err)
+	assert.NotNil(t, user.DeletedAt)
+}
+
+func TestCreateAndGetUsers(t *testing.T) {
+	s := newTestStorage(t)
+	seed(t, s, model.User{ID: "1", Email: "taken@example.com"})
+	ctx := context.Background()
+
+	errs, err := s.CreateUsers(ctx, []*model.User{
+		{ID: "2", Email: "two@example.com"},
+		{ID: "3", Email: "Taken@example.com"},
+		{ID: "4", Email: "four@example.com"},
+	})
+	assert.Nil(t, err)
+	assert.Len(t, errs, 3)
+	assert.Nil(t, errs[0])
+	assert.True(t, errors.Is(errs[1], model.ErrAlreadyExists))
+	assert.Nil(t, errs[2])
+
+	users, err := s.GetUsers(ctx, []string{"1", "3", "4"})
+	assert.Nil(t, err)
+	ids := []string{}
+	for _, u := range users {
+		ids = append(ids, u.ID)
+	}
+	assert.ElementsMatch(t, []string{"1", "4"}, ids)
+}
+
+func TestStreamUsers(t *testing.T) {
+	s := newTestStorage(t)
+	seed(t, s, model.User{ID: "1", LastName: "Young"}, model.User{ID: "2", LastName: "Adams"}, model.User{ID: "3", LastName: "Moore"})
+	ctx := context.Background()
+	_, err := s.DeleteUser(ctx, "3", 0)
+	assert.Nil(t, err)
+
+	var ids []string
+	err = s.StreamUsers(ctx, &model.UserQuery{OrderBy: []model.SortOrder{{Field: "last_name"}}}, func(u *model.User) error {
+		ids = append(ids, u.ID)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"2", "1"}, ids)
+
+	stop := errors.New("stop")
+	calls := 0
+	err = s.StreamUsers(ctx, &model.UserQuery{}, func(u *model.User) error {
+		calls++
+		return stop
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, 1, calls)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	err = s.StreamUsers(cancelled, &model.UserQuery{}, func(u *model.User) error { return nil })
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestSoftDelete(t *testing.T) {
+	s := newTestStorage(t)
+	seed(t, s, model.User{ID: "1"}, model.User{ID: "2"})
+	ctx := context.Background()
+
+	_, err := s.DeleteUser(ctx, "1", 0)
+	assert.Nil(t, err)
+	_, err = s.UpdateUser(ctx, &model.User{ID: "1", Country: "UK"}, []string{"country"})
+	assert.True(t, errors.Is(err, model.ErrNotFound))
+
+	users, _, err := s.QueryUsers(ctx, &model.UserQuery{IncludeDeleted: true, Page: int64Ptr(1), Size: int64Ptr(10)})
+	assert.Nil(t, err)
+	assert.Len(t, users, 2)
+	assert.Equal(t, model.StatusDeleted, users[0].Status())
+	assert.NotNil(t, users[0].DeletedAt)
+
+	_, err = s.PurgeUser(ctx, "2")
+	assert.True(t, errors.Is(err, model.ErrFailedPrecondition))
+	_, err = s.RestoreUser(ctx, "2", 0)
+	assert.True(t, errors.Is(err, model.ErrFailedPrecondition))
+
+	restored, err := s.RestoreUser(ctx, "1", 2)
+	assert.Nil(t, err)
+	assert.Nil(t, restored.DeletedAt)
+	assert.Equal(t, int64(3), restored.Version)
+
+	_, err = s.DeleteUser(ctx, "1", 0)
+	assert.Nil(t, err)
+	deleted, err := s.DeletedUsers(ctx, time.Now().Add(-time.Hour), 10)
+	assert.Nil(t, err)
+	assert.Empty(t, deleted)
+	deleted, err = s.DeletedUsers(ctx, time.Now().Add(time.Second), 10)
+	assert.Nil(t, err)
+	assert.Len(t, deleted, 1)
+	assert.Equal(t, "1", deleted[0].ID)
+	_, err = s.PurgeUser(ctx, "1")
+	assert.Nil(t, err)
+
+	_, err = s.RestoreUser(ctx, "1", 0)
+	assert.True(t, errors.Is(err, model.ErrNotFound))
+	_, err = s.DeleteUser(ctx, "2", 0)
+	assert.Nil(t, err)
+	purgedUser, err := s.PurgeUser(ctx, "2")
+	assert.Nil(t, err)
+	assert.Equal(t, "2", purgedUser.ID)
+	assert.NotNil(t, purgedUser.DeletedAt)
+	_, err = s.PurgeUser(ctx, "2")
+	assert.True(t, errors.Is(err, model.ErrNotFound))
+}
+
+func TestDeleteUser(t *testing.T) {
+	s := newTestStorage(t)
+	seed(t, s, model.User{ID: "1"})
+
+	deleted, err := s.DeleteUser(context.Background(), "1", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "1", deleted.ID)
+	assert.NotNil(t, deleted.DeletedAt)
+	assert.Equal(t, int64(2), deleted.Version)
+
+	_, err = s.DeleteUser(context.Background(), "1", 0)
+	assert.True(t, errors.Is(err, model.ErrNotFound))
+}
+
+func TestQueryUsersFilter(t *testing.T) {
+	s := newTestStorage(t)
+	seed(t, s,
+		model.User{ID: "1", FirstName: "John", LastName: "Doe", NickName: "jd", Email: "jd@example.com", Country: "TR"},
+		model.User{ID: "2", FirstName: "Jane", LastName: "Doe", NickName: "jane", Country: "UK"},
+		model.User{ID: "3", FirstName: "John", LastName: "Smith", NickName: "js", Country: "UK"},
+	)
+
+	tests := []struct {
+		name   string
+		filter model.UserQuery
+		want   []string
+	}{
+		{"no filter", model.UserQuery{}, []string{"1", "2", "3"}},
+		{"first name title cased", model.UserQuery{FirstName: stringPtr("john")}, []string{"1", "3"}},
+		{"last name", model.UserQuery{LastName: stringPtr("Doe")}, []string{"1", "2"}},
+		{"nickname", model.UserQuery{NickName: stringPtr("jane")}, []string{"2"}},
+		{"country", model.UserQuery{Country: stringPtr("UK")}, []string{"2", "3"}},
+		{"id", model.UserQuery{ID: stringPtr("2")}, []string{"2"}},
+		{"email case insensitive", model.UserQuery{Email: stringPtr("JD@Example.com")}, []string{"1"}},
+		{"combined", model.UserQuery{FirstName: stringPtr("John"), Country: stringPtr("UK")}, []string{"3"}},
+		{"no match", model.UserQuery{Country: stringPtr("US")}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.filter.Page = int64Ptr(1)
+			test.filter.Size = int64Ptr(10)
+			users, _, err := s.QueryUsers(context.Background(), &test.filter)
+			assert.Nil(t, err)
+			var ids []string
+			for _, u := range users {
+				ids = append(ids, u.ID)
+			}
+			assert.Equal(t, test.want, ids)
+		})
+	}
+}
+
+func TestQueryUsersPagination(t *testing.T) {
+	s := newTestStorage(t)
+	seed(t, s, model.User{ID: "1"}, model.User{ID: "2"}, model.User{ID: "3"})
+
+	page, meta, err := s.QueryUsers(context.Background(), &model.UserQuery{Page: int64Ptr(2), Size: int64Ptr(2)})
+	assert.Nil(t, err)
+	assert.Len(t, page, 1)
+	assert.Equal(t, "3", page[0].ID)
+	assert.Equal(t, &model.UserPage{Page: 2, Size: 2, TotalCount: 3, TotalPages: 2}, meta)
+
+	_, meta, err = s.QueryUsers(context.Background(), &model.UserQuery{Country: stringPtr("US"), Page: int64Ptr(1), Size: int64Ptr(2)})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), meta.TotalCount)
+	assert.Nil(t, meta.NextPage)
+}
+
+func TestQueryUsersKeyset(t *testing.T) {
+	s := newTestStorage(t)
+	seed(t, s, model.User{ID: "1"}, model.User{ID: "2"}, model.User{ID: "3"})
+
+	page, meta, err := s.QueryUsers(context.Background(), &model.UserQuery{Page: int64Ptr(1), Size: int64Ptr(2)})
+	assert.Nil(t, err)
+	assert.Len(t, page, 2)
+	assert.NotNil(t, meta.NextCursor)
+
+	// Deleting from the first page must not skip users on the following page.
+	_, err = s.DeleteUser(context.Background(), "1", 0)
+	assert.Nil(t, err)
+
+	page, meta, err = s.QueryUsers(context.Background(), &model.UserQuery{Page: int64Ptr(1), Size: int64Ptr(2), After: meta.NextCursor})
+	assert.Nil(t, err)
+	assert.Len(t, page, 1)
+	assert.Equal(t, "3", page[0].ID)
+	assert.Nil(t, meta.NextCursor)
+}
+
+func TestRebind(t *testing.T) {
+	s := &Storage{driver: "postgres"}
+	assert.Equal(t, "SELECT 1 WHERE a = $1 AND b = $2", s.rebind("SELECT 1 WHERE a = ? AND b = ?"))
+
+	s = &Storage{driver: "sqlite3"}
+	assert.Equal(t, "SELECT 1 WHERE a = ?", s.rebind("SELECT 1 WHERE a = ?"))
+}
+
+func TestQueryUsersOrderBy(t *testing.T) {
+	s := newTestStorage(t)
+	seed(t, s,
+		model.User{ID: "1", LastName: "Doe", FirstName: "John"},
+		model.User{ID: "2", LastName: "Smith", FirstName: "Anna"},
+		model.User{ID: "3", LastName: "Doe", FirstName: "Jane"},
+		model.User{ID: "4", LastName: "Adams", FirstName: "Jane"},
+	)
+	orderBy := []model.SortOrder{{Field: "last_name"}, {Field: "first_name", Descending: true}}
+
+	var ids []string
+	var after *model.Cursor
+	for {
+		page, meta, err := s.QueryUsers(context.Background(), &model.UserQuery{Page: int64Ptr(1), Size: int64Ptr(1), OrderBy: orderBy, After: after})
+		assert.Nil(t, err)
+		for _, u := range page {
+			ids = append(ids, u.ID)
+		}
+		if meta.NextCursor == nil {
+			break
+		}
+		after = meta.NextCursor
+	}
+
+	assert.Equal(t, []string{"4", "1", "3", "2"}, ids)
+
+	page, _, err := s.QueryUsers(context.Background(), &model.UserQuery{Page: int64Ptr(1), Size: int64Ptr(10), OrderBy: []model.SortOrder{{Field: "created_at", Descending: true}}})
+	assert.Nil(t, err)
+	assert.Equal(t, "4", page[0].ID)
+}
+
+func TestQueryUsersSearch(t *testing.T) {
+	s := newTestStorage(t)
+	seed(t, s,
+		model.User{ID: "1", FirstName: "Güneş", LastName: "Yılmaz", NickName: "sunny", Email: "gunes@example.com"},
+		model.User{ID: "2", FirstName: "John", LastName: "Doe", NickName: "100%_real", Email: "jd@example.com"},
+		model.User{ID: "3", FirstName: "Ayşe", LastName: "Güneşli", NickName: "ay", Email: "ayse@example.com"},
+	)
+
+	tests := []struct {
+		name   string
+		search string
+		want   []string
+	}{
+		{"diacritic insensitive", "Gunes", []string{"1", "3"}},
+		{"prefix", "yil", []string{"1"}},
+		{"substring", "unn", []string{"1"}},
+		{"email", "JD@", []string{"2"}},
+		{"wildcards are literal", "%_", []string{"2"}},
+		{"regexp is literal", ".*", nil},
+		{"no cross field match", "john doe", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			users, _, err := s.QueryUsers(context.Background(), &model.UserQuery{Search: stringPtr(test.search), Page: int64Ptr(1), Size: int64Ptr(10)})
+			assert.Nil(t, err)
+			var ids []string
+			for _, u := range users {
+				ids = append(ids, u.ID)
+			}
+			assert.Equal(t, test.want, ids)
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package user
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/berkantay/user-management-service/model"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Fills necessary informations and creates the users with one repository call, or one transaction per user with an outbox.
+// Passwords are hashed in parallel, at most one hash per CPU at a time.
+// Returns one result per user in the same order. A failing user does not stop the others.
+func (service *Service) BatchCreate(ctx context.Context, users []*model.User) ([]model.UserResult, error) {
+	service.logger.Printf("INFO:BatchCreate operation started.")
+	if err := model.CheckBatchSize(len(users)); err != nil {
+		service.logger.Printf("WARNING:Invalid batch[%s]", err)
+		return nil, err
+	}
+	imports := make([]model.ImportUser, len(users))
+	for i, user := range users {
+		imports[i].User = user
+	}
+	results, err := service.createUsers(ctx, imports)
+	if err != nil {
+		service.logger.Printf("ERROR:BatchCreate operation failed [%s]", err)
+		return nil, err
+	}
+	service.logger.Printf("INFO:BatchCreate operation done.")
+	return results, nil
+}
+
+// Creates a batch of imported users like BatchCreate. Passwords already hashed with bcrypt are stored as they are.
+// A dry run only checks the users, nothing is hashed or stored.
+func (service *Service) Import(ctx context.Context, users []model.ImportUser, dryRun bool) ([]model.UserResult, error) {
+	service.logger.Printf("INFO:Import operation started.")
+	if err := model.CheckBatchSize(len(users)); err != nil {
+		service.logger.Printf("WARNING:Invalid batch[%s]", err)
+		return nil, err
+	}
+	if dryRun {
+		results := make([]model.UserResult, len(users))
+		for i, user := range users {
+			results[i].User = user.User
+			if user.PasswordHashed {
+				results[i].Err = checkPasswordHash(user.User.Password)
+			}
+		}
+		service.logger.Printf("INFO:Import dry run done.")
+		return results, nil
+	}
+	results, err := service.createUsers(ctx, users)
+	if err != nil {
+		service.logger.Printf("ERROR:Import operation failed [%s]", err)
+		return nil, err
+	}
+	service.logger.Printf("INFO:Import operation done.")
+	return results, nil
+}
+
+// Returns the users with given ids in the same order. Missing users, and deleted users unless includeDeleted is set,
+// get a not found result.
+func (service *Service) BatchGet(ctx context.Context, ids []string, includeDeleted bool) ([]model.UserResult, error) {
+	service.logger.Printf("INFO:BatchGet operation started.")
+	if err := model.CheckBatchSize(len(ids)); err != nil {
+		service.logger.Printf("WARNING:Invalid batch[%s]", err)
+		return nil, err
+	}
+	var lookup []string
+	for _, id := range ids {
+		if id != "" {
+			lookup = append(lookup, id)
+		}
+	}
+	found, err := service.db.GetUsers(ctx, lookup)
+	if err != nil {
+		service.logger.Printf("ERROR:Could not get users[%s]", err)
+		return nil, err
+	}
+	byId := make(map[string]*model.User, len(found))
+	for i := range found {
+		byId[found[i].ID] = &found[i]
+	}
+
+	results := make([]model.UserResult, len(ids))
+	for i, id := range ids {
+		user, ok := byId[id]
+		switch {
+		case id == "":
+			results[i].Err = model.NewInvalidArgumentError("id", "User id is required.")
+		case !ok || (user.DeletedAt != nil && !includeDeleted):
+			results[i].Err = model.NewNotFoundError("user", id)
+		default:
+			results[i].User = user
+		}
+	}
+	service.logger.Printf("INFO:BatchGet operation done.")
+	return results, nil
+}
+
+// Fills necessary informations, hashes the passwords that are not hashed yet and stores the users, see storeUsers.
+func (service *Service) createUsers(ctx context.Context, users []model.ImportUser) ([]model.UserResult, error) {
+	now := time.Now()
+	results := make([]model.UserResult, len(users))
+	var plain []*model.User
+	var plainPositions []int
+	for i, user := range users {
+		user.User.ID = uuid.NewString()
+		user.User.CreatedAt = now
+		user.User.UpdatedAt = now
+		if user.PasswordHashed {
+			results[i].Err = checkPasswordHash(user.User.Password)
+			continue
+		}
+		plain = append(plain, user.User)
+		plainPositions = append(plainPositions, i)
+	}
+
+	hashErrs, err := hashPasswords(ctx, plain, runtime.GOMAXPROCS(0))
+	if err != nil {
+		return nil, err
+	}
+	for j, err := range hashErrs {
+		if err != nil {
+			service.logger.Printf("ERROR:Could not hash password[%s]", err)
+			results[plainPositions[j]].Err = err
+		}
+	}
+
+	var valid []*model.User
+	var positions []int
+	for i, user := range users {
+		if results[i].Err == nil {
+			valid = append(valid, user.User)
+			positions = append(positions, i)
+		}
+	}
+	if len(valid) == 0 {
+		return results, nil
+	}
+	errs, err := service.storeUsers(ctx, valid)
+	if err != nil {
+		return nil, err
+	}
+	for j, err := range errs {
+		if err != nil {
+			results[positions[j]].Err = err
+			continue
+		}
+		results[positions[j]].User = valid[j]
+	}
+	return results, nil
+}
+
+// Replaces the password of every user with its hash using at most workers goroutines.
+// Returns one error per user, or the context error when it is done before every hash started.
+func hashPasswords(ctx context.Context, users []*model.User, workers int) ([]error, error) {
+	errs := make([]error, len(users))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i := range users {
+		// Select picks randomly when both cases are ready, a done context must not start another hash.
+		if ctx.Err() != nil {
+			wg.Wait()
+			return nil, ctx.Err()
+		}
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return nil, ctx.Err()
+		case sem <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			hashed, err := hashPassword(users[i].Password)
+			if err != nil {
+				errs[i] = model.NewInvalidArgumentError("password", err.Error())
+				return
+			}
+			users[i].Password = hashed
+		}(i)
+	}
+	wg.Wait()
+	return errs, nil
+}
+
+// Checks that the password is a bcrypt hash, so users can sign in with their existing password.
+func checkPasswordHash(hash string) error {
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return model.NewInvalidArgumentError("password_hash", "Password hash is not a bcrypt hash.")
+	}
+	return nil
+}
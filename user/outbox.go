@@ -0,0 +1,94 @@
+package user
+
+import (
+	"context"
+	"errors"
+
+	"github.com/berkantay/user-management-service/model"
+	"github.com/google/uuid"
+)
+
+// Storage keeping events next to the users, see WithOutbox.
+type Outbox interface {
+	// Runs fn in a transaction. Repository calls made with the context given to fn are part of it.
+	InTransaction(ctx context.Context, fn func(ctx context.Context) error) error
+	// Stores the event, with a transaction context it is kept only if the transaction commits.
+	AddEvent(ctx context.Context, event *model.OutboxEvent) error
+}
+
+// Configure service by adding an outbox.
+type ServiceOption func(*Service)
+
+// Store an event for every change in the same transaction as the change. A relay publishes them afterwards.
+func WithOutbox(outbox Outbox) ServiceOption {
+	return func(s *Service) {
+		s.outbox = outbox
+	}
+}
+
+// Runs the write and, with an outbox, stores the event of the written user in the same transaction.
+func (service *Service) write(ctx context.Context, eventName string, fn func(ctx context.Context) (*model.User, error)) (*model.User, error) {
+	if service.outbox == nil {
+		return fn(ctx)
+	}
+	var written *model.User
+	err := service.outbox.InTransaction(ctx, func(ctx context.Context) error {
+		user, err := fn(ctx)
+		if err != nil {
+			return err
+		}
+		event, err := model.NewOutboxEvent(uuid.NewString(), eventName, user)
+		if err != nil {
+			return err
+		}
+		if err := service.outbox.AddEvent(ctx, event); err != nil {
+			return err
+		}
+		written = user
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return written, nil
+}
+
+// Stores a new user. Repositories store new users with version 1.
+func (service *Service) createUser(ctx context.Context, user *model.User) (*model.User, error) {
+	return service.write(ctx, model.EventUserCreated, func(ctx context.Context) (*model.User, error) {
+		if _, err := service.db.CreateUser(ctx, user); err != nil {
+			return nil, err
+		}
+		user.Version = 1
+		return user, nil
+	})
+}
+
+// Stores new users and returns one error per user. With an outbox every user gets its own transaction,
+// a failing insert aborts the transaction it is part of.
+func (service *Service) storeUsers(ctx context.Context, users []*model.User) ([]error, error) {
+	if service.outbox == nil {
+		errs, err := service.db.CreateUsers(ctx, users)
+		if err != nil {
+			return nil, err
+		}
+		for i, user := range users {
+			if errs[i] == nil {
+				user.Version = 1
+			}
+		}
+		return errs, nil
+	}
+	errs := make([]error, len(users))
+	for i, user := range users {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		_, err := service.createUser(ctx, user)
+		if errors.Is(err, model.ErrUnavailable) {
+			return nil, err
+		}
+		errs[i] = err
+	}
+	return errs, nil
+}
@@ -2,6 +2,7 @@ package user
 
 import (
 	"context"
+	"errors"
 	"log"
 	"time"
 
@@ -12,22 +13,37 @@ import (
 
 type UserRepository interface {
 	CreateUser(ctx context.Context, user *model.User) (*string, error)
-	UpdateUser(ctx context.Context, user *model.User) (*model.User, error)
-	DeleteUser(ctx context.Context, id string) (*string, error)
-	QueryUsers(ctx context.Context, filter *model.UserQuery) ([]model.User, error)
+	CreateUsers(ctx context.Context, users []*model.User) ([]error, error)
+	GetUser(ctx context.Context, id string) (*model.User, error)
+	GetUsers(ctx context.Context, ids []string) ([]model.User, error)
+	UpdateUser(ctx context.Context, user *model.User, fields []string) (*model.User, error)
+	DeleteUser(ctx context.Context, id string, version int64) (*model.User, error)
+	RestoreUser(ctx context.Context, id string, version int64) (*model.User, error)
+	PurgeUser(ctx context.Context, id string) (*model.User, error)
+	DeletedUsers(ctx context.Context, before time.Time, limit int64) ([]model.User, error)
+	QueryUsers(ctx context.Context, filter *model.UserQuery) ([]model.User, *model.UserPage, error)
+	StreamUsers(ctx context.Context, filter *model.UserQuery, fn func(*model.User) error) error
 }
 
+// Deleted users read at once by PurgeExpired.
+const purgeBatchSize = 100
+
 type Service struct {
 	db     UserRepository
 	logger *log.Logger
+	outbox Outbox
 }
 
 // Create new user service.
-func NewService(db UserRepository, logger *log.Logger) *Service {
-	return &Service{
+func NewService(db UserRepository, logger *log.Logger, opts ...ServiceOption) *Service {
+	s := &Service{
 		db:     db,
 		logger: logger,
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 // Fills necessary informations and creates user.
@@ -44,53 +60,237 @@ func (service *Service) Create(ctx context.Context, user *model.User) (*string,
 	}
 	user.Password = hashed
 
-	insertionId, err := service.db.CreateUser(ctx, user)
-	if err != nil {
+	if _, err := service.createUser(ctx, user); err != nil {
 		service.logger.Printf("ERROR:Create operation failed [%s]", err)
 		return nil, err
 	}
 	service.logger.Printf("INFO:Create operation done.")
-	service.logger.Printf("INFO:User created with id[%s]", *insertionId)
-	return insertionId, nil
+	service.logger.Printf("INFO:User created with id[%s]", user.ID)
+	return &user.ID, nil
 
 }
 
-// Updates user.
-func (service *Service) Update(ctx context.Context, user *model.User) (*model.User, error) {
+// Returns the user with given id. Deleted users are not found unless includeDeleted is set.
+func (service *Service) Get(ctx context.Context, userId string, includeDeleted bool) (*model.User, error) {
+	service.logger.Printf("INFO:Get operation started.")
+	if userId == "" {
+		service.logger.Printf("WARNING:Get called without id.")
+		return nil, model.NewInvalidArgumentError("id", "User id is required.")
+	}
+	user, err := service.db.GetUser(ctx, userId)
+	if err != nil {
+		service.logger.Printf("ERROR:Could not get user[%s]", err)
+		return nil, err
+	}
+	if user.DeletedAt != nil && !includeDeleted {
+		service.logger.Printf("WARNING:User is deleted[%s]", userId)
+		return nil, model.NewNotFoundError("user", userId)
+	}
+	service.logger.Printf("INFO:Get operation done.")
+	return user, nil
+}
+
+// Updates the given fields of the user, all fields in model.UpdateFields when none given.
+// A non-zero version must match the stored one, the version of the given user is ignored.
+func (service *Service) Update(ctx context.Context, user *model.User, fields []string, version int64) (*model.User, error) {
 	service.logger.Printf("INFO:Update operation started.")
-	update, err := service.db.UpdateUser(ctx, user)
+	if user.ID == "" {
+		service.logger.Printf("WARNING:Update called without id.")
+		return nil, model.NewInvalidArgumentError("id", "User id is required.")
+	}
+	fields, err := model.UpdateMask(fields)
+	if err != nil {
+		service.logger.Printf("WARNING:Invalid update mask[%s]", err)
+		return nil, err
+	}
+	for _, field := range fields {
+		if field == "password" {
+			service.logger.Printf("WARNING:Update called with password.")
+			return nil, model.NewInvalidArgumentError("update_mask", "Password can only be changed with ChangePassword.")
+		}
+	}
+	// Repositories compare the version of the user they are given.
+	guarded := *user
+	guarded.Version = version
+	update, err := service.write(ctx, model.EventUserUpdated, func(ctx context.Context) (*model.User, error) {
+		return service.db.UpdateUser(ctx, &guarded, fields)
+	})
 	if err != nil {
 		service.logger.Printf("ERROR:Could not update user[%s]", err)
 		return nil, err
 	}
 	service.logger.Printf("INFO:Update operation done.")
-	service.logger.Printf("INFO:User updated with [%s]", update)
+	service.logger.Printf("INFO:User updated with id[%s]", update.ID)
 	return update, nil
 }
 
-// Remove user by given id.
-func (service *Service) Delete(ctx context.Context, userId string) (*string, error) {
+// Replaces the password of the user after verifying the current one and returns the user. Only the hash of the new password is stored.
+func (service *Service) ChangePassword(ctx context.Context, userId, currentPassword, newPassword string) (*model.User, error) {
+	service.logger.Printf("INFO:ChangePassword operation started.")
+	if userId == "" {
+		service.logger.Printf("WARNING:ChangePassword called without id.")
+		return nil, model.NewInvalidArgumentError("id", "User id is required.")
+	}
+	if newPassword == "" {
+		service.logger.Printf("WARNING:ChangePassword called without new password.")
+		return nil, model.NewInvalidArgumentError("new_password", "New password is required.")
+	}
+	user, err := service.Get(ctx, userId, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(currentPassword)); err != nil {
+		service.logger.Printf("WARNING:Current password does not match[%s]", userId)
+		return nil, model.NewPermissionDeniedError("user", userId, "Current password does not match.")
+	}
+
+	hashed, err := hashPassword(newPassword)
+	if err != nil {
+		service.logger.Printf("ERROR:Could not hash password[%s]", err)
+		return nil, err
+	}
+	// Version guards against a password change in between.
+	changed, err := service.write(ctx, model.EventPasswordChanged, func(ctx context.Context) (*model.User, error) {
+		return service.db.UpdateUser(ctx, &model.User{ID: userId, Password: hashed, Version: user.Version}, []string{"password"})
+	})
+	if err != nil {
+		service.logger.Printf("ERROR:Could not change password[%s]", err)
+		return nil, err
+	}
+	service.logger.Printf("INFO:ChangePassword operation done.")
+	return changed, nil
+}
+
+// Soft delete user by given id, it can be restored until purged. A non-zero version must match the stored one.
+func (service *Service) Delete(ctx context.Context, userId string, version int64) (*model.User, error) {
 	service.logger.Printf("INFO:Delete operation started.")
-	id, err := service.db.DeleteUser(ctx, userId)
+	if userId == "" {
+		service.logger.Printf("WARNING:Delete called without id.")
+		return nil, model.NewInvalidArgumentError("id", "User id is required.")
+	}
+	user, err := service.write(ctx, model.EventUserDeleted, func(ctx context.Context) (*model.User, error) {
+		return service.db.DeleteUser(ctx, userId, version)
+	})
 	if err != nil {
 		service.logger.Printf("ERROR:Could not delete user[%s]", err)
 		return nil, err
 	}
 	service.logger.Printf("INFO:Delete operation done.")
 	service.logger.Printf("INFO:User deleted with id[%s]", userId)
-	return id, nil
+	return user, nil
+}
+
+// Restore soft deleted user by given id. A non-zero version must match the stored one.
+func (service *Service) Restore(ctx context.Context, userId string, version int64) (*model.User, error) {
+	service.logger.Printf("INFO:Restore operation started.")
+	if userId == "" {
+		service.logger.Printf("WARNING:Restore called without id.")
+		return nil, model.NewInvalidArgumentError("id", "User id is required.")
+	}
+	user, err := service.write(ctx, model.EventUserRestored, func(ctx context.Context) (*model.User, error) {
+		return service.db.RestoreUser(ctx, userId, version)
+	})
+	if err != nil {
+		service.logger.Printf("ERROR:Could not restore user[%s]", err)
+		return nil, err
+	}
+	service.logger.Printf("INFO:Restore operation done.")
+	return user, nil
 }
 
-// Query user for the given UserQuery, return list of users after query operation and error if exists.
-func (service *Service) Query(ctx context.Context, query *model.UserQuery) ([]model.User, error) {
+// Permanently remove soft deleted user by given id.
+func (service *Service) Purge(ctx context.Context, userId string) (*model.User, error) {
+	service.logger.Printf("INFO:Purge operation started.")
+	if userId == "" {
+		service.logger.Printf("WARNING:Purge called without id.")
+		return nil, model.NewInvalidArgumentError("id", "User id is required.")
+	}
+	user, err := service.write(ctx, model.EventUserPurged, func(ctx context.Context) (*model.User, error) {
+		return service.db.PurgeUser(ctx, userId)
+	})
+	if err != nil {
+		service.logger.Printf("ERROR:Could not purge user[%s]", err)
+		return nil, err
+	}
+	service.logger.Printf("INFO:Purge operation done.")
+	return user, nil
+}
+
+// Permanently remove users deleted longer than retention ago one by one, so each gets its purge event.
+// Calls purged, if given, for every removed user. Returns the number of removed users.
+func (service *Service) PurgeExpired(ctx context.Context, retention time.Duration, purged func(*model.User)) (int64, error) {
+	before := time.Now().Add(-retention)
+	var count int64
+	for {
+		users, err := service.db.DeletedUsers(ctx, before, purgeBatchSize)
+		if err != nil {
+			service.logger.Printf("ERROR:Could not get deleted users[%s]", err)
+			return count, err
+		}
+		for i := range users {
+			id := users[i].ID
+			user, err := service.write(ctx, model.EventUserPurged, func(ctx context.Context) (*model.User, error) {
+				return service.db.PurgeUser(ctx, id)
+			})
+			if errors.Is(err, model.ErrNotFound) || errors.Is(err, model.ErrFailedPrecondition) {
+				// Purged or restored since it was read.
+				continue
+			}
+			if err != nil {
+				service.logger.Printf("ERROR:Could not purge deleted users[%s]", err)
+				return count, err
+			}
+			count++
+			if purged != nil {
+				purged(user)
+			}
+		}
+		if len(users) < purgeBatchSize {
+			break
+		}
+	}
+	service.logger.Printf("INFO:Purged [%d] deleted users.", count)
+	return count, nil
+}
+
+// Purge expired users every interval until the context is done. Calls purged, if given, for every removed user.
+func (service *Service) RunPurger(ctx context.Context, retention, interval time.Duration, purged func(*model.User)) {
+	service.logger.Printf("INFO:Purger started, retention [%s] interval [%s]", retention, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		service.PurgeExpired(ctx, retention, purged)
+		select {
+		case <-ctx.Done():
+			service.logger.Printf("INFO:Purger stopped.")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Query user for the given UserQuery, return list of users and pagination metadata after query operation and error if exists.
+func (service *Service) Query(ctx context.Context, query *model.UserQuery) ([]model.User, *model.UserPage, error) {
 	service.logger.Printf("INFO:Query operation started.")
-	users, err := service.db.QueryUsers(ctx, query)
+	users, page, err := service.db.QueryUsers(ctx, query)
 	if err != nil {
 		service.logger.Printf("ERROR:User could not queried[%s]", err)
-		return nil, err
+		return nil, nil, err
 	}
 	service.logger.Printf("INFO:Query operation done.")
-	return users, nil
+	return users, page, nil
+}
+
+// Calls fn for every user matching the query, in query order. Paging fields of the query are ignored.
+// Stops at the first error of fn, so a slow fn slows down reading from the repository.
+func (service *Service) Stream(ctx context.Context, query *model.UserQuery, fn func(*model.User) error) error {
+	service.logger.Printf("INFO:Stream operation started.")
+	if err := service.db.StreamUsers(ctx, query, fn); err != nil {
+		service.logger.Printf("ERROR:Users could not be streamed[%s]", err)
+		return err
+	}
+	service.logger.Printf("INFO:Stream operation done.")
+	return nil
 }
 
 func hashPassword(password string) (string, error) {
@@ -2,6 +2,9 @@ package user
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"testing"
 	"time"
@@ -12,22 +15,78 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-type mockUserRepository struct{}
+type mockUserRepository struct {
+	fields   []string    // Fields of the last update.
+	updated  *model.User // User of the last update.
+	password string      // Stored password hash of the queried user.
+
+	deletedBefore time.Time // Cutoff of the last read of deleted users.
+}
 
 func (m *mockUserRepository) CreateUser(ctx context.Context, user *model.User) (*string, error) {
+	if user.Email == "taken@example.com" {
+		return nil, model.NewAlreadyExistsError("user", "email", errors.New("E11000 duplicate key error"))
+	}
 	id := uuid.NewString()
 	return &id, nil
 }
 
-func (m *mockUserRepository) UpdateUser(ctx context.Context, user *model.User) (*model.User, error) {
+func (m *mockUserRepository) CreateUsers(ctx context.Context, users []*model.User) ([]error, error) {
+	errs := make([]error, len(users))
+	for i, user := range users {
+		_, errs[i] = m.CreateUser(ctx, user)
+	}
+	return errs, nil
+}
+
+func (m *mockUserRepository) GetUsers(ctx context.Context, ids []string) ([]model.User, error) {
+	var users []model.User
+	for _, id := range ids {
+		if user, err := m.GetUser(ctx, id); err == nil {
+			users = append(users, *user)
+		}
+	}
+	return users, nil
+}
+
+func (m *mockUserRepository) GetUser(ctx context.Context, id string) (*model.User, error) {
+	switch id {
+	case "missing":
+		return nil, model.NewNotFoundError("user", id)
+	case "deleted":
+		deletedAt := time.Now()
+		return &model.User{ID: id, DeletedAt: &deletedAt}, nil
+	}
+	return &model.User{ID: id, FirstName: "Test", Email: "testuser@example.com", Password: m.password, Version: 4}, nil
+}
+
+func (m *mockUserRepository) UpdateUser(ctx context.Context, user *model.User, fields []string) (*model.User, error) {
+	m.fields = fields
+	m.updated = user
 	return user, nil
 }
 
-func (m *mockUserRepository) DeleteUser(ctx context.Context, id string) (*string, error) {
-	return &id, nil
+func (m *mockUserRepository) DeleteUser(ctx context.Context, id string, version int64) (*model.User, error) {
+	return &model.User{ID: id}, nil
+}
+
+func (m *mockUserRepository) RestoreUser(ctx context.Context, id string, version int64) (*model.User, error) {
+	return &model.User{ID: id}, nil
+}
+
+func (m *mockUserRepository) PurgeUser(ctx context.Context, id string) (*model.User, error) {
+	if id == "restored" {
+		return nil, model.NewFailedPreconditionError("user", id, "User must be deleted before it is purged.")
+	}
+	return &model.User{ID: id}, nil
+}
+
+func (m *mockUserRepository) DeletedUsers(ctx context.Context, before time.Time, limit int64) ([]model.User, error) {
+	m.deletedBefore = before
+	return []model.User{{ID: "1"}, {ID: "restored"}, {ID: "2"}}, nil
 }
 
-func (m *mockUserRepository) QueryUsers(ctx context.Context, filter *model.UserQuery) ([]model.User, error) {
+func (m *mockUserRepository) QueryUsers(ctx context.Context, filter *model.UserQuery) ([]model.User, *model.UserPage, error) {
 	users := []model.User{
 		{
 			ID:        "123",
@@ -36,16 +95,46 @@ func (m *mockUserRepository) QueryUsers(ctx context.Context, filter *model.UserQ
 			Email:     "testuser@example.com",
 			CreatedAt: time.Now(),
 			UpdatedAt: time.Now(),
-			Password:  "password",
+			Password:  m.password,
 		},
 	}
-	return users, nil
+	return users, model.NewUserPage(1, 10, 1), nil
+}
+
+func (m *mockUserRepository) StreamUsers(ctx context.Context, filter *model.UserQuery, fn func(*model.User) error) error {
+	users, _, _ := m.QueryUsers(ctx, filter)
+	for i := range users {
+		if err := fn(&users[i]); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (m *mockUserRepository) HealthCheck(ctx context.Context) error {
 	return nil
 }
 
+// Keeps the events of committed transactions.
+type mockOutbox struct {
+	events  []*model.OutboxEvent
+	pending []*model.OutboxEvent
+}
+
+func (m *mockOutbox) InTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	m.pending = nil
+	if err := fn(ctx); err != nil {
+		return err
+	}
+	m.events = append(m.events, m.pending...)
+	return nil
+}
+
+func (m *mockOutbox) AddEvent(ctx context.Context, event *model.OutboxEvent) error {
+	m.pending = append(m.pending, event)
+	return nil
+}
+
 func TestUserServiceCreate(t *testing.T) {
 	userService := NewService(&mockUserRepository{}, log.Default())
 	testUser := &model.User{
@@ -65,6 +154,16 @@ func TestUserServiceCreate(t *testing.T) {
 	}
 }
 
+func TestUserServiceCreateDuplicate(t *testing.T) {
+	userService := NewService(&mockUserRepository{}, log.Default())
+
+	_, err := userService.Create(context.Background(), &model.User{Email: "taken@example.com"})
+	var domainErr *model.Error
+	if !errors.As(err, &domainErr) || !errors.Is(err, model.ErrAlreadyExists) || domainErr.Field != "email" {
+		t.Errorf("Create returned unexpected error: %v", err)
+	}
+}
+
 func TestUserServiceUpdate(t *testing.T) {
 	userService := NewService(&mockUserRepository{}, log.Default())
 	testUser := &model.User{
@@ -76,7 +175,7 @@ func TestUserServiceUpdate(t *testing.T) {
 	}
 
 	ctx := context.Background()
-	updatedUser, err := userService.Update(ctx, testUser)
+	updatedUser, err := userService.Update(ctx, testUser, nil, 0)
 	if err != nil {
 		t.Fatalf("Update returned unexpected error: %v", err)
 	}
@@ -85,16 +184,361 @@ func TestUserServiceUpdate(t *testing.T) {
 	}
 }
 
+func TestUserServiceUpdateMask(t *testing.T) {
+	repository := &mockUserRepository{}
+	userService := NewService(repository, log.Default())
+	ctx := context.Background()
+
+	_, err := userService.Update(ctx, &model.User{ID: "123", Country: "TR"}, []string{"country"}, 0)
+	if err != nil {
+		t.Fatalf("Update returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"country"}, repository.fields); diff != "" {
+		t.Errorf("Update passed unexpected fields (-want +got):\n%s", diff)
+	}
+
+	_, err = userService.Update(ctx, &model.User{ID: "123"}, nil, 0)
+	if err != nil {
+		t.Fatalf("Update returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(model.UpdateFields, repository.fields); diff != "" {
+		t.Errorf("Update passed unexpected fields (-want +got):\n%s", diff)
+	}
+
+	_, err = userService.Update(ctx, &model.User{ID: "123"}, []string{"created_at"}, 0)
+	if !errors.Is(err, model.ErrInvalidArgument) {
+		t.Errorf("Update returned unexpected error: %v", err)
+	}
+}
+
+func TestUserServiceUpdateVersion(t *testing.T) {
+	repository := &mockUserRepository{}
+	userService := NewService(repository, log.Default())
+	ctx := context.Background()
+
+	// The version of the payload is not an expected version.
+	_, err := userService.Update(ctx, &model.User{ID: "123", Country: "TR", Version: 7}, []string{"country"}, 0)
+	if err != nil {
+		t.Fatalf("Update returned unexpected error: %v", err)
+	}
+	if repository.updated.Version != 0 {
+		t.Errorf("Update guarded on the payload version: %d", repository.updated.Version)
+	}
+
+	_, err = userService.Update(ctx, &model.User{ID: "123", Country: "TR", Version: 7}, []string{"country"}, 3)
+	if err != nil {
+		t.Fatalf("Update returned unexpected error: %v", err)
+	}
+	if repository.updated.Version != 3 {
+		t.Errorf("Update did not guard on the expected version: %d", repository.updated.Version)
+	}
+}
+
+func TestUserServiceUpdateRejectsPassword(t *testing.T) {
+	userService := NewService(&mockUserRepository{}, log.Default())
+
+	_, err := userService.Update(context.Background(), &model.User{ID: "123", Password: "secret"}, []string{"password"}, 0)
+	if !errors.Is(err, model.ErrInvalidArgument) {
+		t.Errorf("Update returned unexpected error: %v", err)
+	}
+}
+
+func TestUserServiceChangePassword(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("current"), bcrypt.MinCost)
+	repository := &mockUserRepository{password: string(hash)}
+	userService := NewService(repository, log.Default())
+	ctx := context.Background()
+
+	_, err := userService.ChangePassword(ctx, "123", "wrong", "new-password")
+	if !errors.Is(err, model.ErrPermissionDenied) {
+		t.Errorf("ChangePassword returned unexpected error: %v", err)
+	}
+	if repository.updated != nil {
+		t.Error("ChangePassword stored password although current password did not match")
+	}
+
+	_, err = userService.ChangePassword(ctx, "123", "current", "")
+	if !errors.Is(err, model.ErrInvalidArgument) {
+		t.Errorf("ChangePassword returned unexpected error: %v", err)
+	}
+
+	changed, err := userService.ChangePassword(ctx, "123", "current", "new-password")
+	if err != nil {
+		t.Fatalf("ChangePassword returned unexpected error: %v", err)
+	}
+	if changed.ID != "123" {
+		t.Errorf("ChangePassword returned unexpected ID: %s", changed.ID)
+	}
+	if repository.updated.Version != 4 {
+		t.Errorf("ChangePassword did not guard on the read version: %d", repository.updated.Version)
+	}
+	if diff := cmp.Diff([]string{"password"}, repository.fields); diff != "" {
+		t.Errorf("ChangePassword passed unexpected fields (-want +got):\n%s", diff)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(repository.updated.Password), []byte("new-password")); err != nil {
+		t.Errorf("ChangePassword did not store a hash of the new password: %s", err)
+	}
+}
+
+func TestUserServiceGet(t *testing.T) {
+	userService := NewService(&mockUserRepository{}, log.Default())
+	ctx := context.Background()
+
+	user, err := userService.Get(ctx, "123", false)
+	if err != nil {
+		t.Fatalf("Get returned unexpected error: %v", err)
+	}
+	if user.ID != "123" {
+		t.Errorf("Get returned unexpected ID: %s", user.ID)
+	}
+	if _, err := userService.Get(ctx, "", false); !errors.Is(err, model.ErrInvalidArgument) {
+		t.Errorf("Get returned unexpected error: %v", err)
+	}
+	if _, err := userService.Get(ctx, "missing", false); !errors.Is(err, model.ErrNotFound) {
+		t.Errorf("Get returned unexpected error: %v", err)
+	}
+	if _, err := userService.Get(ctx, "deleted", false); !errors.Is(err, model.ErrNotFound) {
+		t.Errorf("Get returned unexpected error for deleted user: %v", err)
+	}
+	if _, err := userService.Get(ctx, "deleted", true); err != nil {
+		t.Errorf("Get returned unexpected error for deleted user: %v", err)
+	}
+}
+
+func TestUserServiceBatchCreate(t *testing.T) {
+	userService := NewService(&mockUserRepository{}, log.Default())
+	ctx := context.Background()
+
+	users := []*model.User{
+		{FirstName: "John", Email: "john@example.com", Password: "secret"},
+		{FirstName: "Jane", Email: "taken@example.com", Password: "secret"},
+	}
+	results, err := userService.BatchCreate(ctx, users)
+	if err != nil {
+		t.Fatalf("BatchCreate returned unexpected error: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("BatchCreate returned %d results, want 2", len(results))
+	}
+	if results[0].Err != nil || results[0].User.ID == "" {
+		t.Errorf("BatchCreate returned unexpected first result: %+v", results[0])
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(results[0].User.Password), []byte("secret")); err != nil {
+		t.Errorf("BatchCreate did not hash the password: %s", err)
+	}
+	if !errors.Is(results[1].Err, model.ErrAlreadyExists) {
+		t.Errorf("BatchCreate returned unexpected error: %v", results[1].Err)
+	}
+
+	if _, err := userService.BatchCreate(ctx, nil); !errors.Is(err, model.ErrInvalidArgument) {
+		t.Errorf("BatchCreate returned unexpected error for empty batch: %v", err)
+	}
+	if _, err := userService.BatchCreate(ctx, make([]*model.User, model.MaxBatchSize+1)); !errors.Is(err, model.ErrInvalidArgument) {
+		t.Errorf("BatchCreate returned unexpected error for large batch: %v", err)
+	}
+}
+
+func TestUserServiceImport(t *testing.T) {
+	userService := NewService(&mockUserRepository{}, log.Default())
+	ctx := context.Background()
+	legacy, _ := bcrypt.GenerateFromPassword([]byte("legacy"), bcrypt.MinCost)
+
+	users := func() []model.ImportUser {
+		return []model.ImportUser{
+			{User: &model.User{Email: "john@example.com", Password: string(legacy)}, PasswordHashed: true},
+			{User: &model.User{Email: "jane@example.com", Password: "not-a-hash"}, PasswordHashed: true},
+			{User: &model.User{Email: "joe@example.com", Password: "secret"}},
+		}
+	}
+
+	results, err := userService.Import(ctx, users(), true)
+	if err != nil {
+		t.Fatalf("Import returned unexpected error: %v", err)
+	}
+	if results[0].Err != nil || results[2].Err != nil || !errors.Is(results[1].Err, model.ErrInvalidArgument) {
+		t.Errorf("Import dry run returned unexpected results: %+v", results)
+	}
+	if results[2].User.ID != "" || results[2].User.Password != "secret" {
+		t.Error("Import dry run stored or hashed a user")
+	}
+
+	results, err = userService.Import(ctx, users(), false)
+	if err != nil {
+		t.Fatalf("Import returned unexpected error: %v", err)
+	}
+	if !errors.Is(results[1].Err, model.ErrInvalidArgument) {
+		t.Errorf("Import returned unexpected error: %v", results[1].Err)
+	}
+	if results[0].User.Password != string(legacy) {
+		t.Error("Import did not keep the password hash")
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(results[2].User.Password), []byte("secret")); err != nil {
+		t.Errorf("Import did not hash the password: %s", err)
+	}
+}
+
+func TestUserServiceOutbox(t *testing.T) {
+	outbox := &mockOutbox{}
+	userService := NewService(&mockUserRepository{}, log.Default(), WithOutbox(outbox))
+	ctx := context.Background()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+
+	results, err := userService.Import(ctx, []model.ImportUser{
+		{User: &model.User{Email: "john@example.com", Password: string(hash)}, PasswordHashed: true},
+		{User: &model.User{Email: "taken@example.com", Password: string(hash)}, PasswordHashed: true},
+		{User: &model.User{Email: "jane@example.com", Password: string(hash)}, PasswordHashed: true},
+	}, false)
+	if err != nil {
+		t.Fatalf("Import returned unexpected error: %v", err)
+	}
+	if !errors.Is(results[1].Err, model.ErrAlreadyExists) || results[0].User.Version != 1 {
+		t.Errorf("Import returned unexpected results: %+v", results)
+	}
+	if _, err := userService.Delete(ctx, "123", 0); err != nil {
+		t.Fatalf("Delete returned unexpected error: %v", err)
+	}
+
+	var got []string
+	for _, event := range outbox.events {
+		var message map[string]any
+		if err := json.Unmarshal(event.Payload, &message); err != nil {
+			t.Fatalf("Outbox event is not JSON: %v", err)
+		}
+		if message["id"] != event.ID || message["specversion"] != "1.0" || event.Topic != model.UserTopic {
+			t.Errorf("Outbox event has unexpected attributes: %v", message)
+		}
+		data := message["data"].(map[string]any)
+		if _, ok := data["password"]; ok {
+			t.Error("Outbox event carries the password")
+		}
+		if data["id"] != message["subject"] {
+			t.Errorf("Outbox event has unexpected subject: %v", message["subject"])
+		}
+		got = append(got, fmt.Sprintf("%s %s", message["type"], message["subject"]))
+	}
+	want := []string{
+		model.EventTypePrefix + model.EventUserCreated + " " + results[0].User.ID,
+		model.EventTypePrefix + model.EventUserCreated + " " + results[2].User.ID,
+		model.EventTypePrefix + model.EventUserDeleted + " 123",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Outbox has unexpected events (-want +got):\n%s", diff)
+	}
+}
+
+func TestHashPasswordsCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	users := []*model.User{{Password: "secret"}}
+	if _, err := hashPasswords(ctx, users, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("hashPasswords returned unexpected error: %v", err)
+	}
+	if users[0].Password != "secret" {
+		t.Error("hashPasswords hashed a password after the context was done")
+	}
+}
+
+func TestUserServiceBatchGet(t *testing.T) {
+	userService := NewService(&mockUserRepository{}, log.Default())
+	ctx := context.Background()
+
+	results, err := userService.BatchGet(ctx, []string{"123", "missing", "", "deleted"}, false)
+	if err != nil {
+		t.Fatalf("BatchGet returned unexpected error: %v", err)
+	}
+	if results[0].Err != nil || results[0].User.ID != "123" {
+		t.Errorf("BatchGet returned unexpected first result: %+v", results[0])
+	}
+	for i, kind := range map[int]error{1: model.ErrNotFound, 2: model.ErrInvalidArgument, 3: model.ErrNotFound} {
+		if !errors.Is(results[i].Err, kind) {
+			t.Errorf("BatchGet returned unexpected error at %d: %v", i, results[i].Err)
+		}
+	}
+
+	results, err = userService.BatchGet(ctx, []string{"deleted"}, true)
+	if err != nil || results[0].Err != nil {
+		t.Errorf("BatchGet returned unexpected error for deleted user: %v %v", err, results[0].Err)
+	}
+}
+
+func TestUserServiceStream(t *testing.T) {
+	userService := NewService(&mockUserRepository{}, log.Default())
+
+	var ids []string
+	err := userService.Stream(context.Background(), &model.UserQuery{}, func(u *model.User) error {
+		ids = append(ids, u.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Stream returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"123"}, ids); diff != "" {
+		t.Errorf("Stream returned unexpected users (-want +got):\n%s", diff)
+	}
+
+	stop := errors.New("stop")
+	if err := userService.Stream(context.Background(), &model.UserQuery{}, func(u *model.User) error { return stop }); err != stop {
+		t.Errorf("Stream returned unexpected error: %v", err)
+	}
+}
+
 func TestUserServiceDelete(t *testing.T) {
 	userService := NewService(&mockUserRepository{}, log.Default())
 
 	ctx := context.Background()
-	deletedId, err := userService.Delete(ctx, "123")
+	deleted, err := userService.Delete(ctx, "123", 0)
 	if err != nil {
 		t.Fatalf("Delete returned unexpected error: %v", err)
 	}
-	if *deletedId != "123" {
-		t.Errorf("Delete returned unexpected ID: %s", *deletedId)
+	if deleted.ID != "123" {
+		t.Errorf("Delete returned unexpected ID: %s", deleted.ID)
+	}
+}
+
+func TestUserServiceRequiresID(t *testing.T) {
+	userService := NewService(&mockUserRepository{}, log.Default())
+
+	ctx := context.Background()
+	_, err := userService.Update(ctx, &model.User{FirstName: "John"}, nil, 0)
+	if !errors.Is(err, model.ErrInvalidArgument) {
+		t.Errorf("Update returned unexpected error: %v", err)
+	}
+	_, err = userService.Delete(ctx, "", 0)
+	if !errors.Is(err, model.ErrInvalidArgument) {
+		t.Errorf("Delete returned unexpected error: %v", err)
+	}
+}
+
+func TestUserServicePurgeExpired(t *testing.T) {
+	repository := &mockUserRepository{}
+	outbox := &mockOutbox{}
+	userService := NewService(repository, log.Default(), WithOutbox(outbox))
+
+	var ids []string
+	purged, err := userService.PurgeExpired(context.Background(), time.Hour, func(user *model.User) {
+		ids = append(ids, user.ID)
+	})
+	if err != nil {
+		t.Fatalf("PurgeExpired returned unexpected error: %v", err)
+	}
+	if purged != 2 {
+		t.Errorf("PurgeExpired returned unexpected count: %d", purged)
+	}
+	if cutoff := time.Since(repository.deletedBefore); cutoff < time.Hour || cutoff > time.Hour+time.Minute {
+		t.Errorf("PurgeExpired used unexpected cutoff: %s", repository.deletedBefore)
+	}
+	// The restored user is skipped.
+	if diff := cmp.Diff([]string{"1", "2"}, ids); diff != "" {
+		t.Errorf("PurgeExpired reported unexpected users (-want +got):\n%s", diff)
+	}
+	if len(outbox.events) != 2 {
+		t.Errorf("PurgeExpired stored unexpected events: %d", len(outbox.events))
+	}
+
+	_, err = userService.Purge(context.Background(), "")
+	if !errors.Is(err, model.ErrInvalidArgument) {
+		t.Errorf("Purge returned unexpected error: %v", err)
 	}
 }
 